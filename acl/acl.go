@@ -0,0 +1,290 @@
+// Package acl contains the access control engine deciding which
+// clients may reach which destinations through the proxy
+package acl
+
+import (
+	"fmt"
+	"hiteshkotian/ssl-tunnel/config"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Commands of the requests
+const (
+	CommandConnect      = "connect"
+	CommandBind         = "bind"
+	CommandUDPAssociate = "udp_associate"
+)
+
+// DefaultRules are evaluated after the configured rules. They deny
+// the loopback, private and link-local ranges, which hold the cloud
+// metadata services, and allow every other destination.
+var DefaultRules = []config.Rule{
+	{Name: "default-deny-loopback", Action: "deny",
+		Destinations: []string{"127.0.0.0/8", "::1/128", "0.0.0.0/8", "::/128"}},
+	{Name: "default-deny-private", Action: "deny",
+		Destinations: []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}},
+	{Name: "default-deny-link-local", Action: "deny",
+		Destinations: []string{"169.254.0.0/16", "fe80::/10"}},
+	{Name: "default-allow", Action: "allow"},
+}
+
+// Request holds the properties of a request the rules are matched
+// against. The destination is unknown when both Domain and IP are
+// empty, rules matching destinations or ports then do not apply.
+type Request struct {
+	// Client is the address of the client
+	Client net.IP
+	// User is the authenticated user, empty without authentication
+	User string
+	// Command is one of the Command constants
+	Command string
+	// Domain is the destination name when given as a domain
+	Domain string
+	// IP is the destination address, the resolved one for domains
+	IP net.IP
+	// Port is the destination port
+	Port uint16
+}
+
+// String implementation of Request for logging
+func (request *Request) String() string {
+	destination := request.Domain
+	if request.IP != nil {
+		if destination != "" {
+			destination += "/"
+		}
+		destination += request.IP.String()
+	}
+	if destination == "" {
+		return fmt.Sprintf("%s from %s", request.Command, request.Client)
+	}
+	return fmt.Sprintf("%s from %s to %s", request.Command, request.Client,
+		net.JoinHostPort(destination, fmt.Sprint(request.Port)))
+}
+
+// hasDestination returns true when the destination is known
+func (request *Request) hasDestination() bool {
+	return request.Domain != "" || request.IP != nil
+}
+
+// Rule is a compiled access rule. Every condition set must match
+// for the rule to apply, a condition matches when any of its
+// values does.
+type Rule struct {
+	// Name of the rule, its position when not configured
+	Name string
+	// Allow is true for allow rules, false for deny rules
+	Allow bool
+
+	clients      []*net.IPNet
+	users        map[string]bool
+	destinations []*net.IPNet
+	domains      []domainPattern
+	ports        []portRange
+	commands     map[string]bool
+}
+
+// domainPattern matches a domain name
+type domainPattern func(domain string) bool
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	low, high uint16
+}
+
+// ACL is an ordered list of rules, the first rule
+// matching a request decides
+type ACL struct {
+	rules []*Rule
+}
+
+// New compiles the rules, followed by the default rules
+func New(rules []config.Rule) (*ACL, error) {
+	acl := &ACL{}
+	for i, rule := range append(append([]config.Rule{}, rules...), DefaultRules...) {
+		compiled, err := NewRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %v", i, err)
+		}
+		if compiled.Name == "" {
+			compiled.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		acl.rules = append(acl.rules, compiled)
+	}
+	return acl, nil
+}
+
+// NewRule compiles a rule of the configuration
+func NewRule(rule config.Rule) (*Rule, error) {
+	compiled := &Rule{Name: rule.Name}
+	switch rule.Action {
+	case "allow":
+		compiled.Allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("unknown action %q", rule.Action)
+	}
+
+	for _, client := range rule.Clients {
+		network, err := config.ParseNetwork(client)
+		if err != nil {
+			return nil, err
+		}
+		compiled.clients = append(compiled.clients, network)
+	}
+	for _, destination := range rule.Destinations {
+		network, err := config.ParseNetwork(destination)
+		if err != nil {
+			return nil, err
+		}
+		compiled.destinations = append(compiled.destinations, network)
+	}
+	for _, domain := range rule.Domains {
+		pattern, err := compileDomain(domain)
+		if err != nil {
+			return nil, err
+		}
+		compiled.domains = append(compiled.domains, pattern)
+	}
+	for _, ports := range rule.Ports {
+		low, high, err := config.ParsePortRange(ports)
+		if err != nil {
+			return nil, err
+		}
+		compiled.ports = append(compiled.ports, portRange{low, high})
+	}
+	compiled.users = toSet(rule.Users)
+	compiled.commands = toSet(rule.Commands)
+	return compiled, nil
+}
+
+// toSet converts the values to a set, nil when empty
+func toSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// compileDomain compiles a domain pattern. A pattern is either an
+// exact name, a suffix starting with a dot matching the domain and
+// its subdomains, a glob or a regular expression prefixed with a
+// tilde. Names are compared case insensitively.
+func compileDomain(pattern string) (domainPattern, error) {
+	switch {
+	case strings.HasPrefix(pattern, "~"):
+		expression, err := regexp.Compile("(?i)" + pattern[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain expression %q: %v", pattern, err)
+		}
+		return expression.MatchString, nil
+	case strings.ContainsAny(pattern, "*?["):
+		glob := canonicalName(pattern)
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid domain glob %q: %v", pattern, err)
+		}
+		return func(domain string) bool {
+			matched, _ := path.Match(glob, domain)
+			return matched
+		}, nil
+	case strings.HasPrefix(pattern, "."):
+		suffix := canonicalName(pattern)
+		return func(domain string) bool {
+			return domain == suffix[1:] || strings.HasSuffix(domain, suffix)
+		}, nil
+	}
+
+	name := canonicalName(pattern)
+	return func(domain string) bool {
+		return domain == name
+	}, nil
+}
+
+// canonicalName lowercases the name and removes its trailing dot
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Match returns true when the rule applies to the request
+func (rule *Rule) Match(request *Request) bool {
+	if rule.commands != nil && !rule.commands[request.Command] {
+		return false
+	}
+	if rule.users != nil && !rule.users[request.User] {
+		return false
+	}
+	if rule.clients != nil && !containsIP(rule.clients, request.Client) {
+		return false
+	}
+
+	if rule.destinations == nil && rule.domains == nil && rule.ports == nil {
+		return true
+	}
+	if !request.hasDestination() {
+		return false
+	}
+	if rule.destinations != nil && !containsIP(rule.destinations, request.IP) {
+		return false
+	}
+	if rule.domains != nil && !rule.matchDomain(request.Domain) {
+		return false
+	}
+	if rule.ports != nil && !rule.matchPort(request.Port) {
+		return false
+	}
+	return true
+}
+
+// containsIP returns true when one of the networks holds the address
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	domain = canonicalName(domain)
+	for _, pattern := range rule.domains {
+		if pattern(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) matchPort(port uint16) bool {
+	for _, ports := range rule.ports {
+		if port >= ports.low && port <= ports.high {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed returns true when the request is allowed, and the
+// first rule matching it which decides. The request is allowed
+// when no rule matches.
+func (acl *ACL) Allowed(request *Request) (bool, *Rule) {
+	for _, rule := range acl.rules {
+		if rule.Match(request) {
+			return rule.Allow, rule
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,132 @@
+package acl
+
+import (
+	"hiteshkotian/ssl-tunnel/config"
+	"net"
+	"testing"
+)
+
+func TestDomainPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		domain  string
+		match   bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"example.com", "www.example.com", false},
+		{".example.com", "example.com", true},
+		{".example.com", "www.example.com", true},
+		{".example.com", "badexample.com", false},
+		{"*.example.com", "api.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"api-?.example.com", "api-1.example.com", true},
+		{"~^(www|api)\\.example\\.org$", "API.example.org", true},
+		{"~^(www|api)\\.example\\.org$", "mail.example.org", false},
+	}
+
+	for _, test := range tests {
+		rule, err := NewRule(config.Rule{Action: "deny", Domains: []string{test.pattern}})
+		if err != nil {
+			t.Fatalf("Unable to compile %q: %v", test.pattern, err)
+		}
+		request := &Request{Domain: test.domain, Port: 443}
+		if match := rule.Match(request); match != test.match {
+			t.Errorf("Pattern %q on %q: expected %v", test.pattern, test.domain, test.match)
+		}
+	}
+}
+
+func TestRuleConditions(t *testing.T) {
+	rule, err := NewRule(config.Rule{
+		Name:         "office",
+		Action:       "allow",
+		Clients:      []string{"192.0.2.0/24"},
+		Users:        []string{"alice"},
+		Destinations: []string{"198.51.100.0/24", "2001:db8::/32"},
+		Ports:        []string{"443", "8000-8080"},
+		Commands:     []string{"connect"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := Request{Client: net.ParseIP("192.0.2.7"), User: "alice",
+		Command: CommandConnect, IP: net.ParseIP("198.51.100.1"), Port: 8080}
+	if !rule.Match(&base) {
+		t.Errorf("Rule not matching %s", &base)
+	}
+
+	changes := []func(*Request){
+		func(request *Request) { request.Client = net.ParseIP("203.0.113.1") },
+		func(request *Request) { request.User = "bob" },
+		func(request *Request) { request.Command = CommandBind },
+		func(request *Request) { request.IP = net.ParseIP("203.0.113.1") },
+		func(request *Request) { request.Port = 8081 },
+		func(request *Request) { request.IP = nil },
+	}
+	for _, change := range changes {
+		request := base
+		change(&request)
+		if rule.Match(&request) {
+			t.Errorf("Rule matching %s", &request)
+		}
+	}
+
+	ipv6 := base
+	ipv6.IP = net.ParseIP("2001:db8::1")
+	if !rule.Match(&ipv6) {
+		t.Errorf("Rule not matching %s", &ipv6)
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	acl, err := New([]config.Rule{
+		{Name: "internal-api", Action: "allow", Destinations: []string{"10.1.0.0/16"}, Ports: []string{"443"}},
+		{Action: "deny", Domains: []string{".blocked.example"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		request Request
+		allowed bool
+		rule    string
+	}{
+		{Request{IP: net.ParseIP("127.0.0.1"), Port: 22}, false, "default-deny-loopback"},
+		{Request{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 22}, false, "default-deny-loopback"},
+		{Request{IP: net.ParseIP("169.254.169.254"), Port: 80}, false, "default-deny-link-local"},
+		{Request{IP: net.ParseIP("192.168.1.1"), Port: 80}, false, "default-deny-private"},
+		{Request{IP: net.ParseIP("fd00::1"), Port: 80}, false, "default-deny-private"},
+		{Request{IP: net.ParseIP("10.1.2.3"), Port: 443}, true, "internal-api"},
+		{Request{IP: net.ParseIP("10.1.2.3"), Port: 80}, false, "default-deny-private"},
+		{Request{Domain: "www.blocked.example", Port: 443}, false, "rules[1]"},
+		{Request{Domain: "www.example.com", Port: 443}, true, "default-allow"},
+		{Request{IP: net.ParseIP("93.184.216.34"), Port: 443}, true, "default-allow"},
+		{Request{Command: CommandUDPAssociate}, true, "default-allow"},
+	}
+
+	for _, test := range tests {
+		allowed, rule := acl.Allowed(&test.request)
+		if allowed != test.allowed || rule == nil || rule.Name != test.rule {
+			t.Errorf("%s: expected %v by %s, received %v by %+v",
+				&test.request, test.allowed, test.rule, allowed, rule)
+		}
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	invalid := []config.Rule{
+		{Action: "drop"},
+		{Action: "deny", Clients: []string{"192.0.2.0/33"}},
+		{Action: "deny", Domains: []string{"~("}},
+		{Action: "deny", Domains: []string{"[a-"}},
+		{Action: "deny", Ports: []string{"90-80"}},
+	}
+	for _, rule := range invalid {
+		if _, err := New([]config.Rule{rule}); err == nil {
+			t.Errorf("Invalid rule %+v not reported", rule)
+		}
+	}
+}
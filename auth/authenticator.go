@@ -0,0 +1,29 @@
+// Package auth contains the credential stores used by the proxy
+// to authenticate clients during the username/password
+// sub-negotiation
+package auth
+
+import (
+	"crypto/subtle"
+)
+
+// Authenticator interface defines the function to be
+// implemented by a credential store
+type Authenticator interface {
+	// Authenticate returns true if the username and
+	// password pair is valid
+	Authenticate(username, password string) bool
+}
+
+// StaticCredentials is an in-memory credential store
+// mapping usernames to plain text passwords
+type StaticCredentials map[string]string
+
+// Authenticate implementation for static credentials
+func (credentials StaticCredentials) Authenticate(username, password string) bool {
+	expected, ok := credentials[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
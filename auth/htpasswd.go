@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/logging"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const defaultWatchInterval = 10 * time.Second
+
+// HtpasswdFile is a credential store backed by an Apache
+// htpasswd style file. Supported hash formats are bcrypt
+// ($2y$, $2a$, $2b$), SHA1 ({SHA}) and plain text.
+type HtpasswdFile struct {
+	path string
+	// lock guards the entries and the modification
+	// time of the loaded file
+	lock    sync.RWMutex
+	entries map[string]string
+	modTime time.Time
+	size    int64
+	// stop channel used to terminate the watcher
+	stop     chan bool
+	stopOnce sync.Once
+}
+
+// NewHtpasswdFile creates a credential store from the
+// provided htpasswd file
+func NewHtpasswdFile(path string) (*HtpasswdFile, error) {
+	store := &HtpasswdFile{path: path, stop: make(chan bool)}
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Authenticate implementation for htpasswd file
+func (store *HtpasswdFile) Authenticate(username, password string) bool {
+	store.lock.RLock()
+	hash, ok := store.entries[username]
+	store.lock.RUnlock()
+
+	if !ok {
+		return false
+	}
+	return checkHash(hash, password)
+}
+
+// Reload reads the htpasswd file and replaces the
+// loaded entries. On failure the previous entries are kept.
+func (store *HtpasswdFile) Reload() error {
+	info, err := os.Stat(store.path)
+	if err != nil {
+		return err
+	}
+
+	entries, err := parseHtpasswd(store.path)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	store.entries = entries
+	store.modTime = info.ModTime()
+	store.size = info.Size()
+	store.lock.Unlock()
+
+	logging.Info("Loaded %d credentials from %s", len(entries), store.path)
+	return nil
+}
+
+// Watch starts polling the htpasswd file at the provided
+// interval and reloads it when it changes. Sessions already
+// authenticated are not affected by a reload.
+func (store *HtpasswdFile) Watch(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		// pending is the state of a change not yet loaded
+		var pending os.FileInfo
+		for {
+			select {
+			case <-store.stop:
+				return
+			case <-ticker.C:
+				info, changed := store.changed()
+				if !changed {
+					pending = nil
+					continue
+				}
+
+				// The file is reloaded once unchanged for an interval
+				// so a file being written is not loaded partially
+				if pending == nil || !sameState(pending, info) {
+					pending = info
+					continue
+				}
+				pending = nil
+				if err := store.Reload(); err != nil {
+					logging.Error("Unable to reload %s, keeping previous credentials",
+						err, store.path)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the file watcher
+func (store *HtpasswdFile) Close() {
+	store.stopOnce.Do(func() {
+		close(store.stop)
+	})
+}
+
+// changed checks if the file was modified since the last load
+func (store *HtpasswdFile) changed() (os.FileInfo, bool) {
+	info, err := os.Stat(store.path)
+	if err != nil {
+		logging.Error("Unable to stat %s", err, store.path)
+		return nil, false
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return info, !info.ModTime().Equal(store.modTime) || info.Size() != store.size
+}
+
+// sameState checks if two states of the file have
+// the same modification time and size
+func sameState(a, b os.FileInfo) bool {
+	return a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// parseHtpasswd reads the "user:hash" entries from the file.
+// Blank lines and lines starting with '#' are ignored.
+func parseHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		index := strings.Index(line, ":")
+		if index <= 0 {
+			return nil, fmt.Errorf("%s:%d: malformed htpasswd entry", path, lineNumber)
+		}
+
+		user, hash := line[:index], line[index+1:]
+		if strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "$1$") {
+			return nil, fmt.Errorf("%s:%d: unsupported MD5 hash for user %s",
+				path, lineNumber, user)
+		}
+		entries[user] = hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// checkHash compares the password against the htpasswd hash
+func checkHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"),
+		strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		encoded := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[len("{SHA}"):]),
+			[]byte(encoded)) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+}
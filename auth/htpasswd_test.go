@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, path string, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Unable to write htpasswd file: %v", err)
+	}
+}
+
+func TestHtpasswdFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("bcryptpw"), bcrypt.MinCost)
+	// htpasswd -B generates $2y$ hashes
+	bcryptY := "$2y$" + string(bcryptHash[4:])
+
+	path := filepath.Join(dir, "htpasswd")
+	writeHtpasswd(t, path, "# proxy users\n"+
+		"alice:"+string(bcryptHash)+"\n"+
+		"bob:"+bcryptY+"\n"+
+		"carol:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"+
+		"\n"+
+		"dave:plainpw\n")
+
+	store, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatalf("Unable to load htpasswd file: %v", err)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		valid    bool
+	}{
+		{"alice", "bcryptpw", true},
+		{"alice", "wrong", false},
+		{"bob", "bcryptpw", true},
+		{"carol", "password", true},
+		{"carol", "Password", false},
+		{"dave", "plainpw", true},
+		{"dave", "plain", false},
+		{"eve", "plainpw", false},
+	}
+
+	for _, test := range tests {
+		if store.Authenticate(test.username, test.password) != test.valid {
+			t.Errorf("Authenticate(%s, %s) expected %t", test.username,
+				test.password, test.valid)
+		}
+	}
+}
+
+func TestHtpasswdMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	for _, content := range []string{"nocolon\n", ":nouser\n",
+		"user:$apr1$salt$hash\n"} {
+		writeHtpasswd(t, path, content)
+		if _, err := NewHtpasswdFile(path); err == nil {
+			t.Errorf("Malformed htpasswd %q not detected", content)
+		}
+	}
+
+	if _, err := NewHtpasswdFile(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Missing htpasswd file not detected")
+	}
+}
+
+func TestHtpasswdWatchReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	writeHtpasswd(t, path, "user:oldpw\n")
+
+	store, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatalf("Unable to load htpasswd file: %v", err)
+	}
+	store.Watch(10 * time.Millisecond)
+	defer store.Close()
+
+	writeHtpasswd(t, path, "user:newpassword\n")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !store.Authenticate("user", "newpassword") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Rotated password not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if store.Authenticate("user", "oldpw") {
+		t.Errorf("Old password still accepted after reload")
+	}
+
+	// An invalid file must keep the previous credentials
+	writeHtpasswd(t, path, "broken line without separator\n")
+	time.Sleep(50 * time.Millisecond)
+	if !store.Authenticate("user", "newpassword") {
+		t.Errorf("Credentials dropped after invalid reload")
+	}
+}
+
+func TestHtpasswdWatchWaitsForStableFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "htpasswd")
+	writeHtpasswd(t, path, "user:oldpw\n")
+
+	store, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatalf("Unable to load htpasswd file: %v", err)
+	}
+	store.Watch(50 * time.Millisecond)
+	defer store.Close()
+
+	// The file keeps growing for several intervals,
+	// every partial state is a valid file
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("user:")
+	for _, char := range "newpassword-being-written-slowly" {
+		file.WriteString(string(char))
+		time.Sleep(10 * time.Millisecond)
+		if store.Authenticate("user", "") || !store.Authenticate("user", "oldpw") {
+			file.Close()
+			t.Fatalf("File reloaded while being written")
+		}
+	}
+	file.WriteString("\n")
+	file.Close()
+
+	// Reloaded once unchanged for an interval
+	deadline := time.Now().Add(2 * time.Second)
+	for !store.Authenticate("user", "newpassword-being-written-slowly") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Written file not reloaded once stable")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
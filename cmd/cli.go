@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/config"
+	"io"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: proxy <command> [flags]
+
+Commands:
+  serve          start the proxy (default)
+  check-config   validate a configuration file without starting
+  version        print the version
+
+Run "proxy <command> -h" for the flags of a command.
+`
+
+// listFlag is a flag that can be repeated or hold
+// comma separated values
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			*list = append(*list, element)
+		}
+	}
+	return nil
+}
+
+// serveOptions are the flags of the serve command. The flags
+// explicitly set override the values of the configuration file.
+type serveOptions struct {
+	flags            *flag.FlagSet
+	configPath       string
+	listen           listFlag
+	maxConnections   int
+	debug            bool
+	handshakeTimeout time.Duration
+	connectTimeout   time.Duration
+	idleTimeout      time.Duration
+	maxSession       time.Duration
+	bindTimeout      time.Duration
+	shutdownTimeout  time.Duration
+}
+
+// newServeOptions registers the flags of the serve command
+func newServeOptions(name string, output io.Writer) *serveOptions {
+	options := &serveOptions{flags: flag.NewFlagSet(name, flag.ContinueOnError)}
+	flags := options.flags
+	flags.SetOutput(output)
+
+	flags.StringVar(&options.configPath, "config", "", "path of the configuration file")
+	flags.Var(&options.listen, "listen", "address to listen on, may be repeated (default \":1080\")")
+	flags.IntVar(&options.maxConnections, "max-conns", config.DefaultMaxConnections,
+		"maximum number of concurrent connections")
+	flags.BoolVar(&options.debug, "debug", false, "enable debug logging")
+	flags.DurationVar(&options.handshakeTimeout, "handshake-timeout", config.DefaultHandshakeTimeout,
+		"deadline for the SOCKS handshake")
+	flags.DurationVar(&options.connectTimeout, "connect-timeout", 0,
+		"timeout for connecting to the destination, 0 uses the system timeout")
+	flags.DurationVar(&options.idleTimeout, "idle-timeout", config.DefaultIdleTimeout,
+		"time a connection is kept open while idle in both directions, negative does not limit it")
+	flags.DurationVar(&options.maxSession, "max-session", 0,
+		"maximum lifetime of a session, 0 does not limit it")
+	flags.DurationVar(&options.bindTimeout, "bind-timeout", config.DefaultBindTimeout,
+		"time a BIND request waits for the inbound connection")
+	flags.DurationVar(&options.shutdownTimeout, "shutdown-timeout", config.DefaultShutdownTimeout,
+		"time sessions are given to complete when stopping")
+	return options
+}
+
+// load reads the configuration file, or the defaults when no file
+// is given, and applies the flags set on the command line
+func (options *serveOptions) load() (*config.Config, error) {
+	proxyConfig := config.Default()
+	if options.configPath != "" {
+		var err error
+		if proxyConfig, err = config.Load(options.configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	options.flags.Visit(func(set *flag.Flag) {
+		switch set.Name {
+		case "listen":
+			proxyConfig.Listeners = nil
+			for _, address := range options.listen {
+				proxyConfig.Listeners = append(proxyConfig.Listeners,
+					config.Listener{Address: address})
+			}
+		case "max-conns":
+			proxyConfig.MaxConnections = options.maxConnections
+		case "debug":
+			if options.debug {
+				proxyConfig.Logging.Level = "debug"
+			} else {
+				proxyConfig.Logging.Level = "info"
+			}
+		case "handshake-timeout":
+			proxyConfig.Timeouts.Handshake.Duration = options.handshakeTimeout
+		case "connect-timeout":
+			proxyConfig.Timeouts.Connect.Duration = options.connectTimeout
+		case "idle-timeout":
+			proxyConfig.Timeouts.Idle.Duration = options.idleTimeout
+		case "max-session":
+			proxyConfig.Timeouts.MaxSession.Duration = options.maxSession
+		case "bind-timeout":
+			proxyConfig.Timeouts.Bind.Duration = options.bindTimeout
+		case "shutdown-timeout":
+			proxyConfig.Timeouts.Shutdown.Duration = options.shutdownTimeout
+		}
+	})
+
+	// Overridden values are validated again
+	if err := proxyConfig.Validate(); err != nil {
+		return nil, err
+	}
+	return proxyConfig, nil
+}
+
+// checkConfig validates the configuration file given
+// as flag or argument. It returns the exit code.
+func checkConfig(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	configPath := flags.String("config", "", "path of the configuration file")
+	if err := flags.Parse(args); err != nil {
+		return parseExitCode(err)
+	}
+
+	if *configPath == "" && flags.NArg() == 1 {
+		*configPath = flags.Arg(0)
+	}
+	if *configPath == "" || flags.NArg() > 1 {
+		fmt.Fprintln(stderr, "Usage: proxy check-config [-config] <path>")
+		return 2
+	}
+
+	if _, err := config.Load(*configPath); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: configuration is valid\n", *configPath)
+	return 0
+}
+
+// printVersion prints the version set at build time
+func printVersion(stdout io.Writer) int {
+	if version == "" {
+		fmt.Fprintln(stdout, "proxy version unknown")
+	} else {
+		fmt.Fprintf(stdout, "proxy version %s\n", version)
+	}
+	return 0
+}
+
+// run executes the command given on the command
+// line and returns the exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		return serve(args, stderr)
+	case "check-config":
+		return checkConfig(args, stdout, stderr)
+	case "version":
+		return printVersion(stdout)
+	case "help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "Unknown command %q\n\n%s", command, usage)
+	return 2
+}
+
+// parseExitCode returns the exit code for a flag parsing error,
+// asking for the usage is not an error
+func parseExitCode(err error) int {
+	if err == flag.ErrHelp {
+		return 0
+	}
+	return 2
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "proxy.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestServeFlagsOverrideConfig(t *testing.T) {
+	path, cleanup := writeConfig(t, `name: edge
+listeners:
+  - address: 127.0.0.1:1080
+max_connections: 50
+timeouts:
+  connect: 3s
+`)
+	defer cleanup()
+
+	options := newServeOptions("serve", ioutil.Discard)
+	err := options.flags.Parse([]string{"-config", path, "-listen", "127.0.0.1:2080,127.0.0.1:2081",
+		"-debug", "-handshake-timeout", "5s", "-idle-timeout", "1h", "-max-session", "12h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyConfig, err := options.load()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// Values only set in the file are kept
+	if proxyConfig.Name != "edge" || proxyConfig.MaxConnections != 50 ||
+		proxyConfig.Timeouts.Connect.Duration != 3*time.Second {
+		t.Errorf("File values not kept %+v", proxyConfig)
+	}
+	addresses := proxyConfig.ListenAddresses()
+	if len(addresses) != 2 || addresses[0] != "127.0.0.1:2080" || addresses[1] != "127.0.0.1:2081" {
+		t.Errorf("Listen flag not applied %v", addresses)
+	}
+	if proxyConfig.Logging.Level != "debug" || proxyConfig.Timeouts.Handshake.Duration != 5*time.Second ||
+		proxyConfig.Timeouts.Idle.Duration != time.Hour || proxyConfig.Timeouts.MaxSession.Duration != 12*time.Hour {
+		t.Errorf("Flags not applied %+v", proxyConfig)
+	}
+}
+
+func TestServeInvalidFlags(t *testing.T) {
+	options := newServeOptions("serve", ioutil.Discard)
+	options.flags.Parse([]string{"-listen", "localhost", "-max-conns", "-1"})
+
+	_, err := options.load()
+	if err == nil || !strings.Contains(err.Error(), "localhost") ||
+		!strings.Contains(err.Error(), "max_connections") {
+		t.Errorf("Invalid flags not reported %v", err)
+	}
+}
+
+func TestServeNoConnections(t *testing.T) {
+	options := newServeOptions("serve", ioutil.Discard)
+	options.flags.Parse([]string{"-max-conns", "0"})
+
+	// The server would accept connections without serving any
+	if _, err := options.load(); err == nil || !strings.Contains(err.Error(), "max_connections") {
+		t.Errorf("Zero connections not reported %v", err)
+	}
+}
+
+func TestServeNoListener(t *testing.T) {
+	options := newServeOptions("serve", ioutil.Discard)
+	options.flags.Parse([]string{"-listen", ""})
+
+	// Without listener the server would bind a random port
+	if _, err := options.load(); err == nil || !strings.Contains(err.Error(), "listener") {
+		t.Errorf("Missing listener not reported %v", err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	valid, cleanupValid := writeConfig(t, "name: edge\n")
+	defer cleanupValid()
+	invalid, cleanupInvalid := writeConfig(t, "max_connections: -1\nlogging:\n  level: loud\n")
+	defer cleanupInvalid()
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		output string
+	}{
+		{"valid", []string{"check-config", valid}, 0, "configuration is valid"},
+		{"valid flag", []string{"check-config", "-config", valid}, 0, "configuration is valid"},
+		{"invalid", []string{"check-config", invalid}, 1, "proxy.yaml:3:10: "},
+		{"missing path", []string{"check-config"}, 2, "Usage"},
+	}
+
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		code := run(test.args, &stdout, &stderr)
+		output := stdout.String() + stderr.String()
+		if code != test.code || !strings.Contains(output, test.output) {
+			t.Errorf("%s: exited %d with %q", test.name, code, output)
+		}
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	version = "1.2.3"
+	defer func() { version = "" }()
+
+	var stdout bytes.Buffer
+	if code := run([]string{"version"}, &stdout, ioutil.Discard); code != 0 ||
+		stdout.String() != "proxy version 1.2.3\n" {
+		t.Errorf("Version printed %q, exited %d", stdout.String(), code)
+	}
+
+	if code := run([]string{"start"}, ioutil.Discard, ioutil.Discard); code != 2 {
+		t.Errorf("Unknown command exited %d", code)
+	}
+}
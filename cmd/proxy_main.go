@@ -2,11 +2,15 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/config"
 	"hiteshkotian/ssl-tunnel/logging"
 	"hiteshkotian/ssl-tunnel/proxy"
+	"io"
 	"os"
 	"os/signal"
-	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -14,37 +18,109 @@ var version string
 
 // Main entry point of the proxy
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// serve starts the proxy with the configuration built from
+// the configuration file and the flags
+func serve(args []string, stderr io.Writer) int {
+	options := newServeOptions("serve", stderr)
+	if err := options.flags.Parse(args); err != nil {
+		return parseExitCode(err)
+	}
+	if options.flags.NArg() > 0 {
+		fmt.Fprintf(stderr, "Unexpected arguments %v\n", options.flags.Args())
+		return 2
+	}
+
+	proxyConfig, err := options.load()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
 	logging.Info("Iniitializing proxy tunnel version: %s", version)
 
-	// Set the proxy properties
-	// TODO either accept flags or configuration file
-	// to bootstrap the proxy
-	name := "server1"
-	port := 1080
-	maxConnCount := 200
 	// Create an instance of the proxy
-	proxy := proxy.New(name, port, maxConnCount)
+	server, err := proxy.NewWithConfig(proxyConfig)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
 
 	// Setup the close handlers to handle interrupts
-	setupCloseHandler(proxy)
+	// The configuration in use, replaced on reload
+	active := &atomic.Value{}
+	active.Store(proxyConfig)
+	shutdown := setupCloseHandler(server, active)
+	setupReloadHandler(server, options, active)
 
 	// Start the proxy
-	proxy.Start()
+	err = server.Start()
+	if err == proxy.ErrServerClosed {
+		<-shutdown
+		err = nil
+	}
+	logging.Flush()
+
+	if err != nil {
+		return 1
+	}
+	return 0
 }
 
 // setupCloseHandler function registers SIGTERM signal
-// to gracefully shutdown the server
-func setupCloseHandler(proxy *proxy.Server) {
+// to gracefully shutdown the server. The sessions in progress are
+// given the shutdown timeout to complete, a second signal closes them
+// immediately. The returned channel is closed once done.
+func setupCloseHandler(server *proxy.Server, active *atomic.Value) <-chan struct{} {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
 	go func() {
 		<-c
 		logging.Info("Shutting down proxy server")
-		once := sync.Once{}
-		onceBody := func() {
-			proxy.Stop()
+
+		timeout := active.Load().(*config.Config).Timeouts.Shutdown.Duration
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		go func() {
+			select {
+			case <-c:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		result, err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			logging.Info("Shutdown timeout expired")
+		}
+		logging.Info("Shutdown complete, %d sessions drained, %d closed",
+			result.Drained, result.Killed)
+		close(done)
+	}()
+	return done
+}
+
+// setupReloadHandler registers SIGHUP to reload the configuration
+// file. An invalid configuration is logged and the one in use kept.
+func setupReloadHandler(proxy *proxy.Server, options *serveOptions, active *atomic.Value) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			logging.Info("Reloading configuration")
+			proxyConfig, err := options.load()
+			if err == nil {
+				err = proxy.Reload(proxyConfig)
+			}
+			if err != nil {
+				logging.Error("Configuration rejected, keeping the current one", err)
+				continue
+			}
+			active.Store(proxyConfig)
+			logging.Info("Configuration reloaded")
 		}
-		once.Do(onceBody)
-		os.Exit(0)
 	}()
 }
@@ -0,0 +1,447 @@
+// Package config contains the declarative configuration
+// of the proxy and its validation
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultName is the name of the proxy when none is configured
+	DefaultName = "server1"
+	// DefaultListenAddress is the address listened on when no
+	// listener is configured
+	DefaultListenAddress = ":1080"
+	// DefaultMaxConnections is the default number of
+	// concurrent connections
+	DefaultMaxConnections = 200
+	// DefaultHandshakeTimeout is the default deadline for
+	// the SOCKS handshake
+	DefaultHandshakeTimeout = 10 * time.Second
+	// DefaultIdleTimeout is the default time a relay is kept
+	// open while no data flows in either direction
+	DefaultIdleTimeout = 5 * time.Minute
+	// DefaultBindTimeout is the default time a BIND request
+	// waits for the inbound connection
+	DefaultBindTimeout = 2 * time.Minute
+	// DefaultShutdownTimeout is the default time sessions
+	// are given to complete when the proxy stops
+	DefaultShutdownTimeout = 30 * time.Second
+	// DefaultReloadInterval is the default interval the
+	// htpasswd file is checked for changes
+	DefaultReloadInterval = 10 * time.Second
+	// DefaultDNSTTL is the default time answers without
+	// a known TTL are cached for
+	DefaultDNSTTL = time.Minute
+	// DefaultDNSNegativeTTL is the default time names
+	// not found are cached for
+	DefaultDNSNegativeTTL = 10 * time.Second
+	// DefaultDNSMaxTTL is the default maximum time
+	// answers are cached for
+	DefaultDNSMaxTTL = time.Hour
+	// DefaultPoolStrategy is the default strategy of the pools
+	DefaultPoolStrategy = "round_robin"
+	// DefaultMaxFailures is the default number of consecutive
+	// failures ejecting an upstream from its pool
+	DefaultMaxFailures = 3
+	// DefaultEjectTime is the default time an upstream
+	// is ejected from its pool
+	DefaultEjectTime = 30 * time.Second
+	// DefaultHealthCheckInterval is the default interval
+	// of the health checks of the pools
+	DefaultHealthCheckInterval = 10 * time.Second
+	// DefaultHealthCheckTimeout is the default timeout
+	// of a health check
+	DefaultHealthCheckTimeout = 5 * time.Second
+)
+
+// Config is the root of the configuration file
+type Config struct {
+	// Name of the proxy instance
+	Name string `yaml:"name"`
+	// Listeners the proxy accepts client connections on
+	Listeners []Listener `yaml:"listeners"`
+	// MaxConnections is the number of connections
+	// processed concurrently
+	MaxConnections int `yaml:"max_connections"`
+	// Timeouts applied to client sessions
+	Timeouts Timeouts `yaml:"timeouts"`
+	// Authentication of clients
+	Authentication Authentication `yaml:"authentication"`
+	// Rules is the ordered list of access rules
+	Rules []Rule `yaml:"rules"`
+	// Logging settings
+	Logging Logging `yaml:"logging"`
+	// DNS configures the resolution of domain name destinations
+	DNS DNS `yaml:"dns"`
+	// Upstreams are the parent proxies available for routing
+	Upstreams []Upstream `yaml:"upstreams"`
+	// Pools are groups of upstreams connections are balanced over
+	Pools []Pool `yaml:"pools"`
+	// Routing selects how connections reach their destination
+	Routing Routing `yaml:"routing"`
+	// Outbound configures the connections to the destinations
+	Outbound Outbound `yaml:"outbound"`
+
+	// path of the file the configuration was loaded from
+	path string
+	// root node of the document, used to locate errors
+	root *yaml.Node
+}
+
+// Listener is an address the proxy accepts connections on
+type Listener struct {
+	Address string `yaml:"address"`
+}
+
+// Timeouts applied to client sessions
+type Timeouts struct {
+	// Handshake is the deadline for the SOCKS handshake
+	Handshake Duration `yaml:"handshake"`
+	// Connect is the outbound connection timeout. Zero uses
+	// the operating system timeout.
+	Connect Duration `yaml:"connect"`
+	// Idle is how long a relay is kept open while no data
+	// flows in either direction. A negative value does
+	// not limit it.
+	Idle Duration `yaml:"idle"`
+	// MaxSession is the maximum lifetime of a session.
+	// Zero does not limit it.
+	MaxSession Duration `yaml:"max_session"`
+	// Bind is how long a BIND request waits for the
+	// inbound connection
+	Bind Duration `yaml:"bind"`
+	// Shutdown is how long sessions are given to complete
+	// when the proxy stops before they are closed
+	Shutdown Duration `yaml:"shutdown"`
+}
+
+// Authentication configures the credentials clients
+// authenticate with. When neither an htpasswd file nor users
+// are configured no authentication is required.
+type Authentication struct {
+	// Htpasswd is the path of an htpasswd file
+	Htpasswd string `yaml:"htpasswd"`
+	// ReloadInterval is how often the htpasswd file is
+	// checked for changes
+	ReloadInterval Duration `yaml:"reload_interval"`
+	// Users maps usernames to plain text passwords
+	Users map[string]string `yaml:"users"`
+}
+
+// Rule is an access rule. A rule matches when every
+// non empty criteria matches.
+type Rule struct {
+	Name         string   `yaml:"name"`
+	Action       string   `yaml:"action"`
+	Clients      []string `yaml:"clients"`
+	Users        []string `yaml:"users"`
+	Destinations []string `yaml:"destinations"`
+	Domains      []string `yaml:"domains"`
+	Ports        []string `yaml:"ports"`
+	Commands     []string `yaml:"commands"`
+}
+
+// Logging settings
+type Logging struct {
+	// Level is either "info" or "debug"
+	Level string `yaml:"level"`
+}
+
+// DNS configures the resolution of domain name destinations.
+// Names are looked up in the hosts first, then resolved by the
+// server of the longest suffix they end with or by the system
+// resolver.
+type DNS struct {
+	// Cache of the answers of the servers
+	Cache DNSCache `yaml:"cache"`
+	// Hosts maps host names to the addresses they resolve to
+	Hosts map[string][]string `yaml:"hosts"`
+	// Servers resolve the names ending with their suffix
+	Servers []DNSServer `yaml:"servers"`
+}
+
+// DNSCache configures the cache of the answers
+type DNSCache struct {
+	// Disabled turns the cache off
+	Disabled bool `yaml:"disabled"`
+	// TTL is used for answers without a known TTL
+	TTL Duration `yaml:"ttl"`
+	// NegativeTTL is how long names not found are cached for
+	NegativeTTL Duration `yaml:"negative_ttl"`
+	// MaxTTL caps the TTL of the answers
+	MaxTTL Duration `yaml:"max_ttl"`
+}
+
+// DNSServer is a DNS server resolving the names of a
+// domain, such as "corp" for every name ending in ".corp"
+type DNSServer struct {
+	Suffix string `yaml:"suffix"`
+	// Address of the server, the port defaults to 53
+	Address string `yaml:"address"`
+}
+
+// Upstream is a parent proxy
+type Upstream struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Pool is a group of upstreams connections are balanced over.
+// A connection failing through an upstream is retried through
+// the next one.
+type Pool struct {
+	Name string `yaml:"name"`
+	// Strategy is one of round_robin, least_conn or consistent_hash.
+	// Consistent hashing sends the connections to a destination
+	// host through the same upstream.
+	Strategy string `yaml:"strategy"`
+	// Upstreams are the names of the upstreams of the pool
+	Upstreams []string `yaml:"upstreams"`
+	// MaxFailures is the number of consecutive connection
+	// failures ejecting an upstream from the pool
+	MaxFailures int `yaml:"max_failures"`
+	// EjectTime is how long an upstream is ejected
+	EjectTime Duration `yaml:"eject_time"`
+	// AttemptTimeout limits each attempt through an upstream
+	// so the next one is tried. Zero does not limit it.
+	AttemptTimeout Duration `yaml:"attempt_timeout"`
+	// HealthCheck configures the active health checks
+	HealthCheck HealthCheck `yaml:"health_check"`
+}
+
+// HealthCheck periodically connects to a probe target through
+// every upstream of a pool. Upstreams failing the check are not
+// used until it succeeds again.
+type HealthCheck struct {
+	// Target is the host:port connected to,
+	// health checks are disabled when empty
+	Target string `yaml:"target"`
+	// Interval between two checks of an upstream
+	Interval Duration `yaml:"interval"`
+	// Timeout of a check
+	Timeout Duration `yaml:"timeout"`
+}
+
+// Route types
+const (
+	// RouteDirect connects to the destination directly
+	RouteDirect = "direct"
+	// RouteUpstream connects through an upstream
+	RouteUpstream = "upstream"
+	// RouteBlock refuses the connection
+	RouteBlock = "block"
+)
+
+// Routing selects the outbound route of the connections. The
+// routes "direct" and "block" are always defined.
+type Routing struct {
+	// Default is the route used when no rule matches,
+	// "direct" when empty
+	Default string `yaml:"default"`
+	// Routes are the named outbound routes
+	Routes []Route `yaml:"routes"`
+	// Rules is the ordered list of routing rules,
+	// the first rule matching a connection decides
+	Rules []RouteRule `yaml:"rules"`
+}
+
+// Route is a named way of reaching destinations
+type Route struct {
+	Name string `yaml:"name"`
+	// Type is one of direct, upstream or block
+	Type string `yaml:"type"`
+	// Upstreams is the chain of upstreams or pools of upstream
+	// routes, the first one is connected to and the last one
+	// connects to the destination
+	Upstreams []string `yaml:"upstreams"`
+}
+
+// RouteRule selects a route. A rule matches when every
+// non empty criteria matches.
+type RouteRule struct {
+	Name         string   `yaml:"name"`
+	Route        string   `yaml:"route"`
+	Users        []string `yaml:"users"`
+	Destinations []string `yaml:"destinations"`
+	Domains      []string `yaml:"domains"`
+	Ports        []string `yaml:"ports"`
+}
+
+// Outbound configures the connections to the destinations
+type Outbound struct {
+	// LocalAddress is the IP address connections are made from
+	LocalAddress string `yaml:"local_address"`
+	// KeepAlive is the interval of the TCP keep-alive probes,
+	// a negative value disables them
+	KeepAlive Duration `yaml:"keepalive"`
+	// Mark is the SO_MARK set on the sockets, Linux only
+	Mark int `yaml:"mark"`
+	// Interface the sockets are bound to, Linux only
+	Interface string `yaml:"interface"`
+	// BufferSize is the size of the buffers relaying the data
+	// when the kernel cannot copy it. Zero uses the default.
+	BufferSize int `yaml:"buffer_size"`
+}
+
+// Duration is a time.Duration read from a
+// string such as "10s" or "1m30s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalYAML implementation for Duration
+func (duration *Duration) UnmarshalYAML(node *yaml.Node) error {
+	value, err := time.ParseDuration(node.Value)
+	if err != nil || node.Kind != yaml.ScalarNode {
+		return &yaml.TypeError{Errors: []string{
+			fmt.Sprintf("line %d: invalid duration %q", node.Line, node.Value)}}
+	}
+	duration.Duration = value
+	return nil
+}
+
+// MarshalYAML implementation for Duration
+func (duration Duration) MarshalYAML() (interface{}, error) {
+	return duration.String(), nil
+}
+
+// Default returns the configuration matching the
+// behaviour of the proxy when no file is provided
+func Default() *Config {
+	config := &Config{}
+	config.applyDefaults()
+	return config
+}
+
+// Load reads, decodes and validates the configuration file.
+// Every error found is reported with its location in the file.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse decodes and validates the configuration. The path
+// is only used to report the location of errors.
+func Parse(path string, data []byte) (*Config, error) {
+	config := &Config{path: path}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, newErrorList(path, err)
+	}
+	config.root = &root
+
+	// Type errors do not stop the decoder, the remaining values
+	// are still validated so every error is reported at once
+	var list ErrorList
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && len(root.Content) > 0 {
+		var typeError *yaml.TypeError
+		if !errors.As(err, &typeError) {
+			return nil, newErrorList(path, err)
+		}
+		list = newErrorList(path, err)
+	}
+
+	config.applyDefaults()
+	if err := config.Validate(); err != nil {
+		list = append(list, err.(ErrorList)...)
+	}
+	if len(list) > 0 {
+		sort.SliceStable(list, func(i, j int) bool {
+			if list[i].Line != list[j].Line {
+				return list[i].Line < list[j].Line
+			}
+			return list[i].Column < list[j].Column
+		})
+		return nil, list
+	}
+	return config, nil
+}
+
+// Path returns the path the configuration was loaded from
+func (config *Config) Path() string {
+	return config.path
+}
+
+// ListenAddresses returns the addresses of the listeners
+func (config *Config) ListenAddresses() []string {
+	addresses := make([]string, 0, len(config.Listeners))
+	for _, listener := range config.Listeners {
+		addresses = append(addresses, listener.Address)
+	}
+	return addresses
+}
+
+// applyDefaults fills in the values not set in the file
+func (config *Config) applyDefaults() {
+	if config.Name == "" {
+		config.Name = DefaultName
+	}
+	if len(config.Listeners) == 0 {
+		config.Listeners = []Listener{{Address: DefaultListenAddress}}
+	}
+	if config.MaxConnections == 0 {
+		config.MaxConnections = DefaultMaxConnections
+	}
+	if config.Timeouts.Handshake.Duration == 0 {
+		config.Timeouts.Handshake.Duration = DefaultHandshakeTimeout
+	}
+	if config.Timeouts.Idle.Duration == 0 {
+		config.Timeouts.Idle.Duration = DefaultIdleTimeout
+	}
+	if config.Timeouts.Bind.Duration == 0 {
+		config.Timeouts.Bind.Duration = DefaultBindTimeout
+	}
+	if config.Timeouts.Shutdown.Duration == 0 {
+		config.Timeouts.Shutdown.Duration = DefaultShutdownTimeout
+	}
+	if config.Authentication.ReloadInterval.Duration == 0 {
+		config.Authentication.ReloadInterval.Duration = DefaultReloadInterval
+	}
+	if config.Logging.Level == "" {
+		config.Logging.Level = "info"
+	}
+	if config.DNS.Cache.TTL.Duration == 0 {
+		config.DNS.Cache.TTL.Duration = DefaultDNSTTL
+	}
+	if config.DNS.Cache.NegativeTTL.Duration == 0 {
+		config.DNS.Cache.NegativeTTL.Duration = DefaultDNSNegativeTTL
+	}
+	if config.DNS.Cache.MaxTTL.Duration == 0 {
+		config.DNS.Cache.MaxTTL.Duration = DefaultDNSMaxTTL
+	}
+	for i := range config.Pools {
+		pool := &config.Pools[i]
+		if pool.Strategy == "" {
+			pool.Strategy = DefaultPoolStrategy
+		}
+		if pool.MaxFailures == 0 {
+			pool.MaxFailures = DefaultMaxFailures
+		}
+		if pool.EjectTime.Duration == 0 {
+			pool.EjectTime.Duration = DefaultEjectTime
+		}
+		if pool.HealthCheck.Interval.Duration == 0 {
+			pool.HealthCheck.Interval.Duration = DefaultHealthCheckInterval
+		}
+		if pool.HealthCheck.Timeout.Duration == 0 {
+			pool.HealthCheck.Timeout.Duration = DefaultHealthCheckTimeout
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefault(t *testing.T) {
+	config := Default()
+	if config.Name != "server1" || config.MaxConnections != 200 {
+		t.Errorf("Config: unexpected defaults %+v", config)
+	}
+	if addresses := config.ListenAddresses(); len(addresses) != 1 || addresses[0] != ":1080" {
+		t.Errorf("Config: unexpected default listeners %v", addresses)
+	}
+	if config.Timeouts.Handshake.Duration != 10*time.Second || config.Logging.Level != "info" {
+		t.Errorf("Config: unexpected default timeouts %+v", config.Timeouts)
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("Config: defaults are invalid: %v", err)
+	}
+}
+
+func TestParseEmpty(t *testing.T) {
+	config, err := Parse("empty.yaml", []byte(""))
+	if err != nil || config.Name != DefaultName || config.MaxConnections != DefaultMaxConnections {
+		t.Errorf("Config: empty file parsed %+v, %v", config, err)
+	}
+}
+
+func TestParseComplete(t *testing.T) {
+	document := `
+name: edge
+listeners:
+  - address: 127.0.0.1:1080
+  - address: "[::1]:1080"
+max_connections: 50
+timeouts:
+  handshake: 5s
+  connect: 3s
+  idle: 90s
+  max_session: 8h
+  bind: 1m
+authentication:
+  users:
+    alice: secret
+rules:
+  - name: no-smtp
+    action: deny
+    ports: ["25", "465-587"]
+  - action: allow
+    clients: [10.0.0.0/8, 192.168.1.1]
+    domains: [example.com, .example.org, "*.test", "~^api[0-9]+\\.io$"]
+    commands: [connect, udp_associate]
+logging:
+  level: debug
+upstreams:
+  - name: parent
+    type: socks5
+    address: proxy.internal:1080
+    username: edge
+    password: secret
+`
+	config, err := Parse("complete.yaml", []byte(document))
+	if err != nil {
+		t.Fatalf("Config: unexpected error %v", err)
+	}
+
+	if config.Name != "edge" || config.MaxConnections != 50 ||
+		len(config.Listeners) != 2 || config.Listeners[1].Address != "[::1]:1080" {
+		t.Errorf("Config: unexpected values %+v", config)
+	}
+	if config.Timeouts.Connect.Duration != 3*time.Second ||
+		config.Timeouts.Idle.Duration != 90*time.Second ||
+		config.Timeouts.MaxSession.Duration != 8*time.Hour ||
+		config.Timeouts.Bind.Duration != time.Minute {
+		t.Errorf("Config: unexpected timeouts %+v", config.Timeouts)
+	}
+	if config.Authentication.Users["alice"] != "secret" {
+		t.Errorf("Config: unexpected users %v", config.Authentication.Users)
+	}
+	if len(config.Rules) != 2 || config.Rules[0].Action != "deny" || len(config.Rules[1].Domains) != 4 {
+		t.Errorf("Config: unexpected rules %+v", config.Rules)
+	}
+	if len(config.Upstreams) != 1 || config.Upstreams[0].Address != "proxy.internal:1080" {
+		t.Errorf("Config: unexpected upstreams %+v", config.Upstreams)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	document := `name: edge
+listeners:
+  - address: localhost
+max_connections: -1
+timeouts:
+  handshake: soon
+rules:
+  - action: reject
+    clients: [10.0.0.0/33]
+    ports: ["90-80"]
+logging:
+  level: verbose
+upstreams:
+  - name: parent
+    type: ftp
+    address: proxy.internal:1080
+`
+	_, err := Parse("invalid.yaml", []byte(document))
+	list, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("Config: unexpected error %v", err)
+	}
+
+	// Decoding and validation errors are reported together
+	expected := []string{
+		"invalid.yaml:3:14: ",
+		"invalid.yaml:4:18: ",
+		"invalid.yaml:6: invalid duration",
+		"invalid.yaml:8:13: ",
+		"invalid.yaml:9:15: ",
+		"invalid.yaml:10:13: ",
+		"invalid.yaml:12:10: ",
+		"invalid.yaml:15:11: ",
+	}
+	if len(list) != len(expected) {
+		t.Fatalf("Config: expected %d errors, received:\n%v", len(expected), err)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(list[i].Error(), prefix) {
+			t.Errorf("Config: expected %q, received %q", prefix, list[i].Error())
+		}
+	}
+}
+
+func TestParseUnknownFields(t *testing.T) {
+	document := `name: edge
+max_conections: 10
+timeouts:
+  linger: 10s
+`
+	_, err := Parse("unknown.yaml", []byte(document))
+	list, ok := err.(ErrorList)
+	if !ok || len(list) != 2 || list[0].Line != 2 || list[1].Line != 4 {
+		t.Errorf("Config: unknown fields not reported %v", err)
+	}
+}
+
+func TestParseSyntaxError(t *testing.T) {
+	_, err := Parse("syntax.yaml", []byte("name: edge\n  listeners: [\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "syntax.yaml:") {
+		t.Errorf("Config: syntax error not reported %v", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "proxy.yaml")
+	ioutil.WriteFile(path, []byte("name: loaded\n"), 0600)
+
+	config, err := Load(path)
+	if err != nil || config.Name != "loaded" || config.Path() != path {
+		t.Errorf("Config: load failed %+v, %v", config, err)
+	}
+
+	if _, err := Load(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("Config: missing file not reported")
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		ports string
+		low   uint16
+		high  uint16
+		fail  bool
+	}{
+		{"80", 80, 80, false},
+		{"8000-8080", 8000, 8080, false},
+		{"0-65535", 0, 65535, false},
+		{"8080-8000", 0, 0, true},
+		{"65536", 0, 0, true},
+		{"http", 0, 0, true},
+		{"", 0, 0, true},
+	}
+
+	for _, test := range tests {
+		low, high, err := ParsePortRange(test.ports)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Config: %q: error not detected", test.ports)
+			}
+			continue
+		}
+		if err != nil || low != test.low || high != test.high {
+			t.Errorf("Config: %q: parsed %d-%d, %v", test.ports, low, high, err)
+		}
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		network  string
+		expected string
+		fail     bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"192.168.1.1", "192.168.1.1/32", false},
+		{"fe80::/10", "fe80::/10", false},
+		{"::1", "::1/128", false},
+		{"10.0.0.0/33", "", true},
+		{"example.com", "", true},
+	}
+
+	for _, test := range tests {
+		network, err := ParseNetwork(test.network)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Config: %q: error not detected", test.network)
+			}
+			continue
+		}
+		if err != nil || network.String() != test.expected {
+			t.Errorf("Config: %q: parsed %v, %v", test.network, network, err)
+		}
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	if _, err := Load("proxy.example.yaml"); err != nil {
+		t.Errorf("Config: example is invalid: %v", err)
+	}
+}
+
+func TestParseDNS(t *testing.T) {
+	config, err := Parse("dns.yaml", []byte(`dns:
+  cache:
+    negative_ttl: 30s
+  hosts:
+    intranet.example: [10.0.0.5, "2001:db8::5"]
+  servers:
+    - suffix: corp
+      address: 10.0.0.53
+`))
+	if err != nil || len(config.DNS.Hosts["intranet.example"]) != 2 || len(config.DNS.Servers) != 1 ||
+		config.DNS.Cache.NegativeTTL.Duration != 30*time.Second ||
+		config.DNS.Cache.TTL.Duration != DefaultDNSTTL || config.DNS.Cache.MaxTTL.Duration != DefaultDNSMaxTTL {
+		t.Errorf("Config: unexpected dns %+v, %v", config.DNS, err)
+	}
+
+	_, err = Parse("dns.yaml", []byte(`dns:
+  cache:
+    ttl: -1s
+  hosts:
+    intranet.example: [intranet]
+  servers:
+    - suffix: corp
+      address: dns.corp:53
+    - suffix: "."
+      address: 10.0.0.53:dns
+`))
+	list, ok := err.(ErrorList)
+	expected := []int{3, 5, 8, 9, 10}
+	if !ok || len(list) != len(expected) {
+		t.Fatalf("Config: invalid dns not reported %v", err)
+	}
+	for i, line := range expected {
+		if list[i].Line != line {
+			t.Errorf("Config: expected error on line %d, received %q", line, list[i].Error())
+		}
+	}
+}
+
+func TestParseOutbound(t *testing.T) {
+	config, err := Parse("outbound.yaml", []byte(`outbound:
+  local_address: 192.0.2.10
+  keepalive: -1s
+  buffer_size: 65536
+`))
+	if err != nil || config.Outbound.LocalAddress != "192.0.2.10" ||
+		config.Outbound.KeepAlive.Duration != -time.Second || config.Outbound.BufferSize != 65536 {
+		t.Errorf("Config: unexpected outbound %+v, %v", config.Outbound, err)
+	}
+
+	_, err = Parse("outbound.yaml", []byte(`outbound:
+  local_address: eth0
+  mark: -1
+  buffer_size: 16
+`))
+	list, ok := err.(ErrorList)
+	if !ok || len(list) != 3 || list[0].Line != 2 || list[1].Line != 3 || list[2].Line != 4 {
+		t.Errorf("Config: invalid outbound not reported %v", err)
+	}
+}
+
+func TestParseRouting(t *testing.T) {
+	config, err := Parse("routing.yaml", []byte(`upstreams:
+  - name: parent
+    type: socks5
+    address: proxy.internal:1080
+routing:
+  default: corp
+  routes:
+    - name: corp
+      type: upstream
+      upstreams: [parent]
+  rules:
+    - route: direct
+      domains: [.intranet.example]
+    - route: block
+      destinations: [203.0.113.0/24]
+      ports: ["80"]
+`))
+	if err != nil || config.Routing.Default != "corp" || len(config.Routing.Routes) != 1 ||
+		len(config.Routing.Rules) != 2 || config.Routing.Rules[1].Route != "block" {
+		t.Errorf("Config: unexpected routing %+v, %v", config.Routing, err)
+	}
+
+	_, err = Parse("routing.yaml", []byte(`routing:
+  default: missing
+  routes:
+    - name: corp
+      type: upstream
+      upstreams: [parent]
+    - name: direct
+      type: direct
+  rules:
+    - route: corp
+      domains: ["[a-"]
+      ports: ["http"]
+`))
+	list, ok := err.(ErrorList)
+	expected := []int{2, 6, 7, 11, 12}
+	if !ok || len(list) != len(expected) {
+		t.Fatalf("Config: invalid routing not reported %v", err)
+	}
+	for i, line := range expected {
+		if list[i].Line != line {
+			t.Errorf("Config: expected error on line %d, received %q", line, list[i].Error())
+		}
+	}
+}
+
+func TestParsePools(t *testing.T) {
+	config, err := Parse("pools.yaml", []byte(`upstreams:
+  - name: first
+    type: socks5
+    address: first.internal:1080
+  - name: second
+    type: http
+    address: second.internal:3128
+pools:
+  - name: egress
+    upstreams: [first, second]
+    health_check:
+      target: www.example.com:443
+routing:
+  default: egress
+  routes:
+    - name: egress
+      type: upstream
+      upstreams: [egress]
+`))
+	if err != nil || len(config.Pools) != 1 {
+		t.Fatalf("Config: unexpected pools %+v, %v", config.Pools, err)
+	}
+	pool := config.Pools[0]
+	if pool.Strategy != DefaultPoolStrategy || pool.MaxFailures != DefaultMaxFailures ||
+		pool.EjectTime.Duration != DefaultEjectTime || pool.AttemptTimeout.Duration != 0 ||
+		pool.HealthCheck.Interval.Duration != DefaultHealthCheckInterval ||
+		pool.HealthCheck.Timeout.Duration != DefaultHealthCheckTimeout {
+		t.Errorf("Config: defaults not applied to the pool %+v", pool)
+	}
+
+	_, err = Parse("pools.yaml", []byte(`upstreams:
+  - name: first
+    type: socks5
+    address: first.internal:1080
+pools:
+  - name: first
+    strategy: random
+    upstreams: [first, first, missing]
+    eject_time: -1s
+    health_check:
+      target: www.example.com
+`))
+	list, ok := err.(ErrorList)
+	expected := []int{6, 7, 8, 8, 9, 11}
+	if !ok || len(list) != len(expected) {
+		t.Fatalf("Config: invalid pools not reported %v", err)
+	}
+	for i, line := range expected {
+		if list[i].Line != line {
+			t.Errorf("Config: expected error on line %d, received %q", line, list[i].Error())
+		}
+	}
+}
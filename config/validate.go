@@ -0,0 +1,573 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FieldError is an error found in the configuration file
+type FieldError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+// Error implementation of FieldError
+func (err FieldError) Error() string {
+	switch {
+	case err.Line == 0:
+		return fmt.Sprintf("%s: %s", err.File, err.Message)
+	case err.Column == 0:
+		return fmt.Sprintf("%s:%d: %s", err.File, err.Line, err.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", err.File, err.Line, err.Column, err.Message)
+}
+
+// ErrorList holds every error found in the configuration file
+type ErrorList []FieldError
+
+// Error implementation of ErrorList, one error per line
+func (list ErrorList) Error() string {
+	messages := make([]string, len(list))
+	for i, err := range list {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Bounds of the relay buffer size
+const (
+	minBufferSize = 1024
+	maxBufferSize = 1 << 20
+)
+
+// yamlLine extracts the line from the messages of the yaml decoder
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// newErrorList converts the errors returned by the
+// yaml decoder to an ErrorList
+func newErrorList(file string, err error) ErrorList {
+	var messages []string
+	var typeError *yaml.TypeError
+	if errors.As(err, &typeError) {
+		messages = typeError.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	list := ErrorList{}
+	for _, message := range messages {
+		fieldError := FieldError{File: file, Message: message}
+		if match := yamlLine.FindStringSubmatch(message); match != nil {
+			fieldError.Line, _ = strconv.Atoi(match[1])
+			fieldError.Message = match[2]
+		}
+		list = append(list, fieldError)
+	}
+	return list
+}
+
+// validator collects the errors found while validating
+type validator struct {
+	config *Config
+	errors ErrorList
+}
+
+// errorf records an error for the value at the given path.
+// The path is a sequence of mapping keys and sequence indexes.
+func (v *validator) errorf(location []interface{}, format string, args ...interface{}) {
+	fieldError := FieldError{File: v.config.path, Message: fmt.Sprintf(format, args...)}
+	if node := locate(v.config.root, location); node != nil {
+		fieldError.Line = node.Line
+		fieldError.Column = node.Column
+	}
+	v.errors = append(v.errors, fieldError)
+}
+
+// locate returns the node at the given path. When the path does
+// not exist in the document the closest parent is returned.
+func locate(root *yaml.Node, location []interface{}) *yaml.Node {
+	if root == nil || len(root.Content) == 0 {
+		return nil
+	}
+	node := root.Content[0]
+
+	for _, key := range location {
+		var next *yaml.Node
+		switch key := key.(type) {
+		case string:
+			if node.Kind != yaml.MappingNode {
+				return node
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next = node.Content[i+1]
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && key < len(node.Content) {
+				next = node.Content[key]
+			}
+		}
+		if next == nil {
+			return node
+		}
+		node = next
+	}
+	return node
+}
+
+// at builds a location from its elements
+func at(elements ...interface{}) []interface{} {
+	return elements
+}
+
+// Validate checks the configuration and returns an
+// ErrorList holding every error found
+func (config *Config) Validate() error {
+	v := &validator{config: config}
+
+	if config.Name == "" {
+		v.errorf(at("name"), "name must not be empty")
+	}
+	v.validateListeners()
+
+	if config.MaxConnections <= 0 {
+		v.errorf(at("max_connections"), "max_connections must be positive")
+	}
+
+	timeouts := map[string]Duration{
+		"handshake":   config.Timeouts.Handshake,
+		"connect":     config.Timeouts.Connect,
+		"max_session": config.Timeouts.MaxSession,
+		"bind":        config.Timeouts.Bind,
+		"shutdown":    config.Timeouts.Shutdown,
+	}
+	// A negative idle timeout disables it
+	for _, name := range []string{"handshake", "connect", "max_session", "bind", "shutdown"} {
+		if timeouts[name].Duration < 0 {
+			v.errorf(at("timeouts", name), "%s timeout must not be negative", name)
+		}
+	}
+
+	v.validateAuthentication()
+	v.validateRules()
+
+	if level := config.Logging.Level; level != "info" && level != "debug" {
+		v.errorf(at("logging", "level"), "unknown log level %q, expected info or debug", level)
+	}
+
+	v.validateDNS()
+	v.validateUpstreams()
+	v.validatePools()
+	v.validateRouting()
+	v.validateOutbound()
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+func (v *validator) validateListeners() {
+	if len(v.config.Listeners) == 0 {
+		v.errorf(at("listeners"), "at least one listener is required")
+	}
+	seen := map[string]bool{}
+	for i, listener := range v.config.Listeners {
+		location := at("listeners", i, "address")
+		if err := checkAddress(listener.Address); err != nil {
+			v.errorf(location, "invalid listener address %q: %v", listener.Address, err)
+			continue
+		}
+		if seen[listener.Address] {
+			v.errorf(location, "duplicate listener address %q", listener.Address)
+		}
+		seen[listener.Address] = true
+	}
+}
+
+func (v *validator) validateAuthentication() {
+	authentication := v.config.Authentication
+
+	if authentication.Htpasswd != "" && len(authentication.Users) > 0 {
+		v.errorf(at("authentication", "users"), "users and htpasswd are mutually exclusive")
+	}
+	if authentication.ReloadInterval.Duration < 0 {
+		v.errorf(at("authentication", "reload_interval"), "reload_interval must not be negative")
+	}
+	// Sorted so errors at the same position keep their order
+	usernames := make([]string, 0, len(authentication.Users))
+	for username := range authentication.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		password := authentication.Users[username]
+		if username == "" || len(username) > 255 {
+			v.errorf(at("authentication", "users"), "username must be between 1 and 255 bytes")
+		}
+		if len(password) > 255 {
+			v.errorf(at("authentication", "users", username), "password of %q exceeds 255 bytes", username)
+		}
+	}
+}
+
+func (v *validator) validateRules() {
+	for i, rule := range v.config.Rules {
+		if rule.Action != "allow" && rule.Action != "deny" {
+			v.errorf(at("rules", i, "action"), "unknown action %q, expected allow or deny", rule.Action)
+		}
+		for j, client := range rule.Clients {
+			if _, err := ParseNetwork(client); err != nil {
+				v.errorf(at("rules", i, "clients", j), "%v", err)
+			}
+		}
+		for j, user := range rule.Users {
+			if user == "" {
+				v.errorf(at("rules", i, "users", j), "user must not be empty")
+			}
+		}
+		for j, destination := range rule.Destinations {
+			if _, err := ParseNetwork(destination); err != nil {
+				v.errorf(at("rules", i, "destinations", j), "%v", err)
+			}
+		}
+		for j, domain := range rule.Domains {
+			if err := checkDomainPattern(domain); err != nil {
+				v.errorf(at("rules", i, "domains", j), "%v", err)
+			}
+		}
+		for j, ports := range rule.Ports {
+			if _, _, err := ParsePortRange(ports); err != nil {
+				v.errorf(at("rules", i, "ports", j), "%v", err)
+			}
+		}
+		for j, command := range rule.Commands {
+			if command != "connect" && command != "bind" && command != "udp_associate" {
+				v.errorf(at("rules", i, "commands", j),
+					"unknown command %q, expected connect, bind or udp_associate", command)
+			}
+		}
+	}
+}
+
+func (v *validator) validateDNS() {
+	dns := v.config.DNS
+
+	cache := map[string]Duration{
+		"ttl":          dns.Cache.TTL,
+		"negative_ttl": dns.Cache.NegativeTTL,
+		"max_ttl":      dns.Cache.MaxTTL,
+	}
+	for _, name := range []string{"ttl", "negative_ttl", "max_ttl"} {
+		if cache[name].Duration < 0 {
+			v.errorf(at("dns", "cache", name), "%s must not be negative", name)
+		}
+	}
+
+	hosts := make([]string, 0, len(dns.Hosts))
+	for host := range dns.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		addresses := dns.Hosts[host]
+		if host == "" {
+			v.errorf(at("dns", "hosts"), "host name must not be empty")
+		}
+		if len(addresses) == 0 {
+			v.errorf(at("dns", "hosts", host), "host %q without addresses", host)
+		}
+		for i, address := range addresses {
+			if net.ParseIP(address) == nil {
+				v.errorf(at("dns", "hosts", host, i), "invalid address %q", address)
+			}
+		}
+	}
+
+	for i, server := range dns.Servers {
+		if strings.Trim(server.Suffix, ".") == "" {
+			v.errorf(at("dns", "servers", i), "suffix must not be empty")
+		}
+		host := server.Address
+		if _, _, err := net.SplitHostPort(server.Address); err == nil {
+			if err := checkAddress(server.Address); err != nil {
+				v.errorf(at("dns", "servers", i, "address"), "invalid address %q: %v", server.Address, err)
+				continue
+			}
+			host, _, _ = net.SplitHostPort(server.Address)
+		}
+		if net.ParseIP(host) == nil {
+			v.errorf(at("dns", "servers", i, "address"), "invalid address %q, expected an IP address", server.Address)
+		}
+	}
+}
+
+func (v *validator) validateUpstreams() {
+	seen := map[string]bool{}
+	for i, upstream := range v.config.Upstreams {
+		if upstream.Name == "" {
+			v.errorf(at("upstreams", i), "upstream name must not be empty")
+		} else if seen[upstream.Name] {
+			v.errorf(at("upstreams", i, "name"), "duplicate upstream %q", upstream.Name)
+		}
+		seen[upstream.Name] = true
+
+		if upstream.Type != "socks5" && upstream.Type != "http" {
+			v.errorf(at("upstreams", i, "type"), "unknown upstream type %q, expected socks5 or http", upstream.Type)
+		}
+		if err := checkAddress(upstream.Address); err != nil {
+			v.errorf(at("upstreams", i, "address"), "invalid upstream address %q: %v", upstream.Address, err)
+		}
+		if upstream.Password != "" && upstream.Username == "" {
+			v.errorf(at("upstreams", i, "password"), "password set without username")
+		}
+	}
+}
+
+func (v *validator) validatePools() {
+	upstreams := map[string]bool{}
+	for _, upstream := range v.config.Upstreams {
+		upstreams[upstream.Name] = true
+	}
+
+	seen := map[string]bool{}
+	for i, pool := range v.config.Pools {
+		if pool.Name == "" {
+			v.errorf(at("pools", i), "pool name must not be empty")
+		} else if seen[pool.Name] {
+			v.errorf(at("pools", i, "name"), "duplicate pool %q", pool.Name)
+		} else if upstreams[pool.Name] {
+			v.errorf(at("pools", i, "name"), "pool %q has the name of an upstream", pool.Name)
+		}
+		seen[pool.Name] = true
+
+		switch pool.Strategy {
+		case "round_robin", "least_conn", "consistent_hash":
+		default:
+			v.errorf(at("pools", i, "strategy"),
+				"unknown strategy %q, expected round_robin, least_conn or consistent_hash", pool.Strategy)
+		}
+
+		if len(pool.Upstreams) == 0 {
+			v.errorf(at("pools", i), "pool without upstreams")
+		}
+		members := map[string]bool{}
+		for j, upstream := range pool.Upstreams {
+			if !upstreams[upstream] {
+				v.errorf(at("pools", i, "upstreams", j), "unknown upstream %q", upstream)
+			} else if members[upstream] {
+				v.errorf(at("pools", i, "upstreams", j), "upstream %q repeated in the pool", upstream)
+			}
+			members[upstream] = true
+		}
+
+		if pool.MaxFailures < 0 {
+			v.errorf(at("pools", i, "max_failures"), "max_failures must not be negative")
+		}
+		if pool.EjectTime.Duration < 0 {
+			v.errorf(at("pools", i, "eject_time"), "eject_time must not be negative")
+		}
+		if pool.AttemptTimeout.Duration < 0 {
+			v.errorf(at("pools", i, "attempt_timeout"), "attempt_timeout must not be negative")
+		}
+
+		check := pool.HealthCheck
+		if check.Target != "" {
+			if err := checkAddress(check.Target); err != nil {
+				v.errorf(at("pools", i, "health_check", "target"), "invalid health check target %q: %v",
+					check.Target, err)
+			}
+		}
+		if check.Interval.Duration < 0 {
+			v.errorf(at("pools", i, "health_check", "interval"), "health check interval must not be negative")
+		}
+		if check.Timeout.Duration < 0 {
+			v.errorf(at("pools", i, "health_check", "timeout"), "health check timeout must not be negative")
+		}
+	}
+}
+
+func (v *validator) validateRouting() {
+	routing := v.config.Routing
+
+	// Chains are made of upstreams and pools
+	upstreams := map[string]bool{}
+	for _, upstream := range v.config.Upstreams {
+		upstreams[upstream.Name] = true
+	}
+	for _, pool := range v.config.Pools {
+		upstreams[pool.Name] = true
+	}
+
+	routes := map[string]bool{RouteDirect: true, RouteBlock: true}
+	for i, route := range routing.Routes {
+		if route.Name == "" {
+			v.errorf(at("routing", "routes", i), "route name must not be empty")
+		} else if routes[route.Name] {
+			v.errorf(at("routing", "routes", i, "name"), "duplicate route %q", route.Name)
+		}
+		routes[route.Name] = true
+
+		switch route.Type {
+		case RouteUpstream:
+			if len(route.Upstreams) == 0 {
+				v.errorf(at("routing", "routes", i), "upstream route without upstreams")
+			}
+			chain := map[string]bool{}
+			for j, upstream := range route.Upstreams {
+				if !upstreams[upstream] {
+					v.errorf(at("routing", "routes", i, "upstreams", j), "unknown upstream or pool %q", upstream)
+				} else if chain[upstream] {
+					v.errorf(at("routing", "routes", i, "upstreams", j), "upstream %q repeated in the chain", upstream)
+				}
+				chain[upstream] = true
+			}
+		case RouteDirect, RouteBlock:
+			if len(route.Upstreams) > 0 {
+				v.errorf(at("routing", "routes", i, "upstreams"), "upstreams set on a %s route", route.Type)
+			}
+		default:
+			v.errorf(at("routing", "routes", i, "type"),
+				"unknown route type %q, expected direct, upstream or block", route.Type)
+		}
+	}
+
+	if routing.Default != "" && !routes[routing.Default] {
+		v.errorf(at("routing", "default"), "unknown route %q", routing.Default)
+	}
+
+	for i, rule := range routing.Rules {
+		if !routes[rule.Route] {
+			v.errorf(at("routing", "rules", i, "route"), "unknown route %q", rule.Route)
+		}
+		for j, user := range rule.Users {
+			if user == "" {
+				v.errorf(at("routing", "rules", i, "users", j), "user must not be empty")
+			}
+		}
+		for j, destination := range rule.Destinations {
+			if _, err := ParseNetwork(destination); err != nil {
+				v.errorf(at("routing", "rules", i, "destinations", j), "%v", err)
+			}
+		}
+		for j, domain := range rule.Domains {
+			if err := checkDomainPattern(domain); err != nil {
+				v.errorf(at("routing", "rules", i, "domains", j), "%v", err)
+			}
+		}
+		for j, ports := range rule.Ports {
+			if _, _, err := ParsePortRange(ports); err != nil {
+				v.errorf(at("routing", "rules", i, "ports", j), "%v", err)
+			}
+		}
+	}
+}
+
+func (v *validator) validateOutbound() {
+	outbound := v.config.Outbound
+
+	if outbound.LocalAddress != "" && net.ParseIP(outbound.LocalAddress) == nil {
+		v.errorf(at("outbound", "local_address"), "invalid local address %q", outbound.LocalAddress)
+	}
+	if outbound.Mark < 0 {
+		v.errorf(at("outbound", "mark"), "mark must not be negative")
+	}
+	if size := outbound.BufferSize; size != 0 && (size < minBufferSize || size > maxBufferSize) {
+		v.errorf(at("outbound", "buffer_size"), "buffer_size must be between %d and %d",
+			minBufferSize, maxBufferSize)
+	}
+	if runtime.GOOS != "linux" {
+		if outbound.Mark != 0 {
+			v.errorf(at("outbound", "mark"), "mark is only supported on Linux")
+		}
+		if outbound.Interface != "" {
+			v.errorf(at("outbound", "interface"), "interface is only supported on Linux")
+		}
+	}
+}
+
+// checkAddress validates a host:port address
+func checkAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// checkDomainPattern validates a domain pattern. A pattern is
+// either an exact name, a suffix starting with a dot, a glob
+// or a regular expression prefixed with a tilde.
+func checkDomainPattern(pattern string) error {
+	switch {
+	case pattern == "" || pattern == ".":
+		return errors.New("domain must not be empty")
+	case strings.HasPrefix(pattern, "~"):
+		if _, err := regexp.Compile(pattern[1:]); err != nil {
+			return fmt.Errorf("invalid domain expression %q: %v", pattern, err)
+		}
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid domain glob %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// ParseNetwork parses a CIDR or a single IP address
+func ParseNetwork(network string) (*net.IPNet, error) {
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", network)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network %q", network)
+	}
+	return ipNet, nil
+}
+
+// ParsePortRange parses a single port or an inclusive
+// range of ports such as "8000-8080"
+func ParsePortRange(ports string) (low uint16, high uint16, err error) {
+	bounds := strings.SplitN(ports, "-", 2)
+	values := make([]uint16, len(bounds))
+	for i, bound := range bounds {
+		value, parseErr := strconv.ParseUint(strings.TrimSpace(bound), 10, 16)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid port range %q", ports)
+			return
+		}
+		values[i] = uint16(value)
+	}
+
+	low, high = values[0], values[len(values)-1]
+	if low > high {
+		err = fmt.Errorf("invalid port range %q, %d is greater than %d", ports, low, high)
+	}
+	return
+}
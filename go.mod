@@ -1,3 +1,9 @@
 module hiteshkotian/ssl-tunnel
 
-go 1.13
+go 1.17
+
+require (
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -2,83 +2,91 @@ package handler
 
 import (
 	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/netutil"
 	"hiteshkotian/ssl-tunnel/socks5"
 	"net"
 	"time"
 )
 
+// CloseWriter is implemented by connections able to shut down their
+// writing side while still reading, such as *net.TCPConn. The end of
+// stream of one direction is propagated to the other side with it.
+type CloseWriter = netutil.CloseWriter
+
 type OutboundHandler struct {
+	// IdleTimeout is how long the connections are kept open while
+	// no data flows in either direction. Zero does not limit it.
+	IdleTimeout time.Duration
+	// BufferSize is the size of the buffers relaying the data when
+	// the kernel cannot copy it, DefaultBufferSize when zero
+	BufferSize int
 }
 
-// proxyData function will read the data from the "from" channel
-// and synchronously write it to the "to" channel.
-// On operation complete the function will write true to the done and the
-// complete channel.
-// If the other read go routine is done, the signal will be received in the
-// otherDone channel, at which point the function will stop all action.
+// proxyData function will copy the data of the direction until the end
+// of stream or an error.
+// The end of stream is propagated to the destination when it supports
+// half-closing.
+// On completion the function writes to the complete channel whether the
+// direction ended cleanly, in which case the other direction can go on.
 // NOTE: We could make this to stop on read "\r\n\r\n" but then we are just
 // delimiting it for HTTP requests, we want this function to work for any TCP
 // data proxying.
-func proxyData(from net.Conn, to net.Conn, complete chan bool,
-	done chan bool, otherDone chan bool) {
-	var err error = nil
-	var bytes []byte = make([]byte, 1024)
-	var read int = 0
-	for {
-		select {
-		// If the other channel is done processing, mark this channel
-		// as done and move on
-		case <-otherDone:
-			complete <- true
-			return
-		default:
-			// Enforce a small read deadline to make sure there is no
-			// bottleneck
-			from.SetReadDeadline(time.Now().Add(time.Second * 5))
-			read, err = from.Read(bytes)
-			// If any errors occured, write to complete as we are done (one of the
-			// connections closed.)
-			if err != nil {
-				complete <- true
-				done <- true
-				logging.Error("Error while proxying request", err)
-				return
-			}
-			// Write data to the destination.
-			to.SetWriteDeadline(time.Now().Add(time.Second * 5))
-			_, err = to.Write(bytes[:read])
-			if err != nil {
-				complete <- true
-				done <- true
-				return
-			}
-		}
+func proxyData(relay *relay, direction *direction, complete chan bool) {
+	eof, err := relay.copy(direction)
+	if eof {
+		complete <- closeWrite(direction.dst)
+		return
+	}
+	if err != errRelayStopped && !isTimeout(err) {
+		logging.Error("Error while proxying request", err)
+	}
+	complete <- false
+}
+
+// closeWrite shuts down the writing side of the connection. It
+// returns false when the connection does not support it.
+func closeWrite(conn net.Conn) bool {
+	closeWriter, ok := conn.(CloseWriter)
+	if !ok {
+		return false
+	}
+	if err := closeWriter.CloseWrite(); err != nil {
+		logging.Debug("Unable to half-close %s: %s", conn.RemoteAddr(), err)
+		return false
 	}
+	return true
 }
 
 // HandleRequest implementation for Outbound handler.
 // This function will handle sending the request from
-// the client to the destination server
+// the client to the destination server. Once both
+// directions are done the connections are closed.
 func (outbound *OutboundHandler) HandleRequest(request *socks5.Request) error {
-
-	client := request.ClientConnection
-	remote := request.OutboundConnection
-
-	// defer func() {
-	// 	request.State = RequestStateTerminating
-	// 	// remote.Close()
-	// }()
+	relay := newRelay(request.ClientConnection, request.OutboundConnection,
+		outbound.IdleTimeout, outbound.BufferSize)
 
 	complete := make(chan bool, 2)
-	ch1 := make(chan bool, 1)
-	ch2 := make(chan bool, 1)
+	for _, direction := range relay.directions {
+		go proxyData(relay, direction, complete)
+	}
 
-	go proxyData(client, remote, complete, ch1, ch2)
-	go proxyData(remote, client, complete, ch2, ch1)
+	// Cancelling the session context ends the relay
+	finished := make(chan bool)
+	go func() {
+		select {
+		case <-request.Context().Done():
+			relay.stop()
+		case <-finished:
+		}
+	}()
 
+	// A direction ending cleanly was half-closed and the other one
+	// keeps flowing until it ends too. Otherwise both are stopped.
+	if halfClosed := <-complete; !halfClosed {
+		relay.stop()
+	}
 	<-complete
-	<-complete
-
-	return nil
+	close(finished)
 
+	return request.Close()
 }
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"hiteshkotian/ssl-tunnel/socks5"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// benchmarkChunk is the size of the writes of the benchmarks
+const benchmarkChunk = 64 * 1024
+
+// plainConn hides the type of the connection, disabling
+// the copy by the kernel
+type plainConn struct {
+	net.Conn
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(b testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return conn, <-accepted
+}
+
+func TestRelayIdleOneDirection(t *testing.T) {
+	client, proxyClient := tcpPair(t)
+	proxyRemote, destination := tcpPair(t)
+	defer client.Close()
+	defer destination.Close()
+	go io.Copy(ioutil.Discard, destination)
+
+	request := socks5.NewRequest(proxyClient)
+	request.OutboundConnection = proxyRemote
+	relayed := make(chan error, 1)
+	handler := OutboundHandler{IdleTimeout: 200 * time.Millisecond}
+	go func() { relayed <- handler.HandleRequest(request) }()
+
+	// Data flowing in a single direction keeps the relay open
+	for i := 0; i < 30; i++ {
+		if _, err := client.Write([]byte("data")); err != nil {
+			t.Fatalf("Relay closed while active: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	select {
+	case <-relayed:
+		t.Fatalf("Relay closed while active")
+	default:
+	}
+
+	// Once idle in both directions the relay is closed
+	select {
+	case <-relayed:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Relay not closed once idle")
+	}
+}
+
+// benchmarkRelay relays b.N chunks from the client to the
+// destination through the handler
+func benchmarkRelay(b *testing.B, handler OutboundHandler,
+	pair func(*testing.B) (net.Conn, net.Conn)) {
+	client, proxyClient := pair(b)
+	proxyRemote, destination := pair(b)
+
+	request := socks5.NewRequest(proxyClient)
+	request.OutboundConnection = proxyRemote
+	relayed := make(chan error)
+	go func() { relayed <- handler.HandleRequest(request) }()
+
+	received := make(chan error)
+	go func() {
+		_, err := io.CopyN(ioutil.Discard, destination, int64(b.N)*benchmarkChunk)
+		received <- err
+	}()
+
+	chunk := make([]byte, benchmarkChunk)
+	b.SetBytes(benchmarkChunk)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := <-received; err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+
+	client.Close()
+	destination.Close()
+	<-relayed
+}
+
+// BenchmarkRelayTCP relays between TCP connections, copied
+// by the kernel where splice(2) is available
+func BenchmarkRelayTCP(b *testing.B) {
+	benchmarkRelay(b, OutboundHandler{}, func(b *testing.B) (net.Conn, net.Conn) {
+		return tcpPair(b)
+	})
+}
+
+// BenchmarkRelayTCPBuffered relays between TCP connections
+// through the pooled buffers
+func BenchmarkRelayTCPBuffered(b *testing.B) {
+	benchmarkRelay(b, OutboundHandler{}, func(b *testing.B) (net.Conn, net.Conn) {
+		first, second := tcpPair(b)
+		return plainConn{first}, plainConn{second}
+	})
+}
+
+// BenchmarkRelayTCPSmallBuffer relays through 1024 bytes
+// buffers, the size used by the previous data path
+func BenchmarkRelayTCPSmallBuffer(b *testing.B) {
+	benchmarkRelay(b, OutboundHandler{BufferSize: 1024}, func(b *testing.B) (net.Conn, net.Conn) {
+		first, second := tcpPair(b)
+		return plainConn{first}, plainConn{second}
+	})
+}
+
+// BenchmarkRelayPipe relays between in-process connections
+func BenchmarkRelayPipe(b *testing.B) {
+	benchmarkRelay(b, OutboundHandler{}, func(*testing.B) (net.Conn, net.Conn) {
+		return net.Pipe()
+	})
+}
+
+// BenchmarkRelayIdleTimeout relays between TCP connections
+// with the idle timeout enabled
+func BenchmarkRelayIdleTimeout(b *testing.B) {
+	benchmarkRelay(b, OutboundHandler{IdleTimeout: time.Minute}, func(b *testing.B) (net.Conn, net.Conn) {
+		return tcpPair(b)
+	})
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBufferSize is the size of the buffers used to relay
+// data between connections that are not both TCP
+const DefaultBufferSize = 32 * 1024
+
+// errRelayStopped is returned by the directions of a stopped relay
+var errRelayStopped = errors.New("relay stopped")
+
+// bufferPools holds a pool of buffers per buffer size
+var bufferPools sync.Map
+
+// getBuffer returns a buffer of the size from its pool
+func getBuffer(size int) *[]byte {
+	pool, _ := bufferPools.LoadOrStore(size, &sync.Pool{
+		New: func() interface{} {
+			buffer := make([]byte, size)
+			return &buffer
+		},
+	})
+	return pool.(*sync.Pool).Get().(*[]byte)
+}
+
+// putBuffer returns the buffer to its pool
+func putBuffer(buffer *[]byte) {
+	if pool, ok := bufferPools.Load(len(*buffer)); ok {
+		pool.(*sync.Pool).Put(buffer)
+	}
+}
+
+// readerOnly and writerOnly hide the ReaderFrom and WriterTo
+// implementations of the connections so the pooled buffer is used
+type readerOnly struct{ io.Reader }
+type writerOnly struct{ io.Writer }
+
+// copyData copies from src to dst until the end of stream or an
+// error. Between TCP connections the copy is done by the kernel with
+// splice(2) where available, otherwise through a pooled buffer.
+func copyData(dst, src net.Conn, bufferSize int) (int64, error) {
+	if readerFrom, ok := dst.(io.ReaderFrom); ok {
+		if _, ok := src.(*net.TCPConn); ok {
+			return readerFrom.ReadFrom(src)
+		}
+	}
+
+	buffer := getBuffer(bufferSize)
+	defer putBuffer(buffer)
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buffer)
+}
+
+// relay copies the data between two connections in both directions.
+// The connections are closed once no data flowed in either direction
+// for the idle timeout. As a copy only reports the data it transferred
+// when it returns, each direction copies until the read deadline of its
+// source expires. A direction finding the relay idle interrupts the
+// other one, which reports its progress and closes the relay when it
+// has none.
+type relay struct {
+	// activity is the time data was last reported, in nanoseconds.
+	// First for the alignment required by atomic operations.
+	activity    int64
+	idleTimeout time.Duration
+	bufferSize  int
+	// stopped is set once the relay is interrupted
+	stopped int32
+	// directions copying from the client and from the remote
+	directions [2]*direction
+}
+
+// direction is the copy of the data read from src to dst
+type direction struct {
+	src, dst net.Conn
+	other    *direction
+	// running is cleared once the direction is complete
+	running int32
+	// interrupted is set when the other direction expired
+	// the read deadline of src to get its progress
+	interrupted int32
+	// waitingFor is the activity recorded when the direction asked
+	// the other one for its progress, zero when not waiting
+	waitingFor int64
+}
+
+// newRelay creates the relay between client and remote
+func newRelay(client, remote net.Conn, idleTimeout time.Duration, bufferSize int) *relay {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	upstream := &direction{src: client, dst: remote, running: 1}
+	downstream := &direction{src: remote, dst: client, running: 1}
+	upstream.other, downstream.other = downstream, upstream
+
+	return &relay{
+		idleTimeout: idleTimeout,
+		bufferSize:  bufferSize,
+		activity:    time.Now().UnixNano(),
+		directions:  [2]*direction{upstream, downstream},
+	}
+}
+
+// touch records data flowing
+func (relay *relay) touch() {
+	atomic.StoreInt64(&relay.activity, time.Now().UnixNano())
+}
+
+// idle returns true when no data flowed for the idle timeout
+func (relay *relay) idle() bool {
+	last := time.Unix(0, atomic.LoadInt64(&relay.activity))
+	return time.Since(last) >= relay.idleTimeout
+}
+
+// stop interrupts both directions
+func (relay *relay) stop() {
+	atomic.StoreInt32(&relay.stopped, 1)
+	for _, direction := range relay.directions {
+		direction.src.SetDeadline(time.Now())
+	}
+}
+
+// copy relays the data of the direction until the end of stream, an
+// error or the relay going idle. It returns whether the end of stream
+// was reached.
+func (relay *relay) copy(direction *direction) (eof bool, err error) {
+	defer atomic.StoreInt32(&direction.running, 0)
+
+	for {
+		if relay.idleTimeout > 0 {
+			direction.src.SetReadDeadline(time.Now().Add(relay.idleTimeout))
+		}
+		// Checked after setting the deadline which could
+		// override the one set by stop
+		if atomic.LoadInt32(&relay.stopped) == 1 {
+			return false, errRelayStopped
+		}
+		written, err := copyData(direction.dst, direction.src, relay.bufferSize)
+		if written > 0 {
+			relay.touch()
+		}
+		if err == nil {
+			return true, nil
+		}
+		if atomic.LoadInt32(&relay.stopped) == 1 || !isTimeout(err) {
+			return false, err
+		}
+
+		// The read deadline expired, either after the idle timeout
+		// or because the other direction asks for the progress
+		interrupted := atomic.SwapInt32(&direction.interrupted, 0) == 1
+		activity := atomic.LoadInt64(&relay.activity)
+		if !relay.idle() {
+			direction.waitingFor = 0
+			continue
+		}
+		if interrupted || direction.waitingFor == activity ||
+			atomic.LoadInt32(&direction.other.running) == 0 {
+			return false, err
+		}
+
+		// Ask the other direction for its progress
+		direction.waitingFor = activity
+		atomic.StoreInt32(&direction.other.interrupted, 1)
+		direction.other.src.SetReadDeadline(time.Now())
+	}
+}
+
+// isTimeout returns true for deadline errors
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
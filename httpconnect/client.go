@@ -0,0 +1,138 @@
+// Package httpconnect contains the client tunneling connections
+// through an HTTP proxy with HTTP/1.1 CONNECT requests
+package httpconnect
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/netutil"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// StatusError is returned when the proxy answers
+// the CONNECT request with a status other than 2xx
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+// Error implementation of StatusError
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("HTTPConnect: Proxy answered %s", err.Status)
+}
+
+// Client connects to destinations through an HTTP proxy. Like the
+// SOCKS5 client it is chained by dialing it with the client of the
+// previous hop.
+type Client struct {
+	// Address of the proxy
+	Address string
+	// Username and Password are sent in a Basic Proxy-Authorization
+	// header. No credentials are sent without Username.
+	Username string
+	Password string
+	// Dialer opens the connection to the proxy,
+	// a net.Dialer when nil
+	Dialer netutil.Dialer
+}
+
+// DialContext connects to the address through the proxy. The address
+// is a host:port pair, names are resolved by the proxy.
+func (client *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("HTTPConnect: Network %s not supported", network)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, err
+	}
+
+	var dialer netutil.Dialer = &net.Dialer{}
+	if client.Dialer != nil {
+		dialer = client.Dialer
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", client.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel, err := client.Connect(ctx, conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// Connect sends the CONNECT request on a connection to the proxy and
+// returns the tunnel. The handshake is abandoned when the context is
+// done, the connection is then left in an undefined state.
+func (client *Client) Connect(ctx context.Context, conn net.Conn, address string) (tunnel net.Conn, err error) {
+	err = netutil.Interruptible(ctx, conn, func() (err error) {
+		tunnel, err = client.handshake(conn, address)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// handshake sends the request and reads the response
+func (client *Client) handshake(conn net.Conn, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if client.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString(
+			[]byte(client.Username + ":" + client.Password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	// The body of a successful CONNECT response is the tunnel
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		response.Body.Close()
+		return nil, &StatusError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+
+	// The proxy may send the first bytes of the destination
+	// along with the response
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the bytes received with the
+// response before reading from the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read implementation of net.Conn
+func (conn *bufferedConn) Read(buffer []byte) (int, error) {
+	return conn.reader.Read(buffer)
+}
+
+// CloseWrite shuts down the writing side of the
+// connection when it supports half-close
+func (conn *bufferedConn) CloseWrite() error {
+	return netutil.CloseWrite(conn.Conn)
+}
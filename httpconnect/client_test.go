@@ -0,0 +1,166 @@
+package httpconnect
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// standIn is an HTTP proxy accepting CONNECT requests with the
+// credentials edge:secret. The greeting is sent along with the
+// response, before the bytes of the destination.
+func standIn(greeting string) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodConnect {
+			http.Error(writer, "only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		// Basic edge:secret
+		if request.Header.Get("Proxy-Authorization") != "Basic ZWRnZTpzZWNyZXQ=" {
+			writer.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			http.Error(writer, "authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+
+		destination, err := net.Dial("tcp", request.Host)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer destination.Close()
+
+		conn, buffered, err := writer.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n" + greeting))
+
+		go io.Copy(destination, buffered)
+		io.Copy(conn, destination)
+	})
+}
+
+// startEcho starts a TCP server echoing everything it receives
+func startEcho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("HTTPConnect: Unable to create listener: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func dial(client *Client, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := client.DialContext(ctx, "tcp", address)
+	if conn != nil {
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+	}
+	return conn, err
+}
+
+func TestConnect(t *testing.T) {
+	destination := startEcho(t)
+	defer destination.Close()
+	proxy := httptest.NewServer(standIn(""))
+	defer proxy.Close()
+
+	client := &Client{Address: proxy.Listener.Addr().String(), Username: "edge", Password: "secret"}
+	conn, err := dial(client, destination.Addr().String())
+	if err != nil {
+		t.Fatalf("HTTPConnect: Connect failed %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("ping"))
+	response := make([]byte, 4)
+	if _, err := io.ReadFull(conn, response); err != nil || string(response) != "ping" {
+		t.Errorf("HTTPConnect: Unexpected echo %q, %v", response, err)
+	}
+}
+
+func TestConnectBytesAfterResponse(t *testing.T) {
+	destination := startEcho(t)
+	defer destination.Close()
+	proxy := httptest.NewServer(standIn("hello"))
+	defer proxy.Close()
+
+	client := &Client{Address: proxy.Listener.Addr().String(), Username: "edge", Password: "secret"}
+	conn, err := dial(client, destination.Addr().String())
+	if err != nil {
+		t.Fatalf("HTTPConnect: Connect failed %v", err)
+	}
+	defer conn.Close()
+
+	// The greeting is read before the echo
+	conn.Write([]byte("ping"))
+	response := make([]byte, 9)
+	if _, err := io.ReadFull(conn, response); err != nil || string(response) != "helloping" {
+		t.Errorf("HTTPConnect: Unexpected data %q, %v", response, err)
+	}
+	if _, ok := conn.(interface{ CloseWrite() error }); !ok {
+		t.Errorf("HTTPConnect: Buffered connection cannot be half-closed")
+	}
+}
+
+func TestConnectStatus(t *testing.T) {
+	proxy := httptest.NewServer(standIn(""))
+	defer proxy.Close()
+
+	// Find a closed port for the proxy to fail connecting
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := listener.Addr().String()
+	listener.Close()
+
+	tests := []struct {
+		password string
+		status   int
+	}{
+		{"wrong", http.StatusProxyAuthRequired},
+		{"secret", http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		client := &Client{Address: proxy.Listener.Addr().String(), Username: "edge", Password: test.password}
+		_, err := dial(client, closed)
+
+		var statusError *StatusError
+		if !errors.As(err, &statusError) || statusError.StatusCode != test.status {
+			t.Errorf("HTTPConnect: Expected status %d, received %v", test.status, err)
+		}
+	}
+}
+
+func TestConnectCancelled(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	// The proxy reads the request but never answers
+	go io.Copy(ioutil.Discard, serverSide)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := (&Client{}).Connect(ctx, clientSide, "www.example.com:443")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("HTTPConnect: Expected the handshake to be abandoned, received %v", err)
+	}
+}
@@ -4,30 +4,61 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync/atomic"
 )
 
 const channelBufferSize = 50
 
 var logger *log.Logger
 var loggerChan chan string
-var debugLog bool
+var debugLog int32
+var flushChan chan chan bool
+var setLoggerChan chan *log.Logger
 
 func init() {
 	logger = log.New(os.Stdout, "Logger :: ", log.Ldate)
 	loggerChan = make(chan string, channelBufferSize)
+	flushChan = make(chan chan bool)
+	setLoggerChan = make(chan *log.Logger)
 	go func() {
-		for msg := range loggerChan {
-			logger.Printf(msg)
+		for {
+			select {
+			case newLogger := <-setLoggerChan:
+				for len(loggerChan) > 0 {
+					logger.Printf(<-loggerChan)
+				}
+				logger = newLogger
+			case msg := <-loggerChan:
+				logger.Printf(msg)
+			case done := <-flushChan:
+				for len(loggerChan) > 0 {
+					logger.Printf(<-loggerChan)
+				}
+				close(done)
+			}
 		}
 	}()
 }
 
+// SetLogger replaces the logger the messages are written to.
+// The messages logged before are written to the previous logger.
+func SetLogger(newLogger *log.Logger) {
+	setLoggerChan <- newLogger
+}
+
+// Flush waits until the messages logged so far are written
+func Flush() {
+	done := make(chan bool)
+	flushChan <- done
+	<-done
+}
+
 func EnableDebug() {
-	debugLog = true
+	atomic.StoreInt32(&debugLog, 1)
 }
 
 func DisableDebug() {
-	debugLog = false
+	atomic.StoreInt32(&debugLog, 0)
 }
 
 func DumpHex(stream []byte, message string, parameters ...interface{}) {
@@ -71,7 +102,7 @@ func Info(message string, parameters ...interface{}) {
 }
 
 func Debug(message string, parameters ...interface{}) {
-	if debugLog {
+	if atomic.LoadInt32(&debugLog) == 1 {
 		var msg string
 		if len(parameters) > 0 {
 			msg = fmt.Sprintf(message, parameters...)
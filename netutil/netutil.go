@@ -0,0 +1,62 @@
+// Package netutil contains the connection helpers shared by
+// the proxy and the clients of its upstreams
+package netutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// Dialer opens connections, like net.Dialer. The clients of the
+// upstreams are dialers too, which is how they are chained.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// CloseWriter is implemented by connections able to shut down their
+// writing side while still reading, such as *net.TCPConn
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// ErrHalfCloseUnsupported is returned by CloseWrite when
+// the connection cannot be half-closed
+var ErrHalfCloseUnsupported = errors.New("netutil: Half-close not supported")
+
+// CloseWrite shuts down the writing side of the connection. It is
+// used by the connection wrappers to forward their CloseWrite.
+func CloseWrite(conn net.Conn) error {
+	if closer, ok := conn.(CloseWriter); ok {
+		return closer.CloseWrite()
+	}
+	return ErrHalfCloseUnsupported
+}
+
+// Interruptible runs the exchange on the connection, such as the
+// handshake with a proxy, until it completes or the context is done.
+// The deadline of the connection is only set once the context is
+// done, so an interrupted exchange returns the context error. The
+// connection is then left in an undefined state.
+func Interruptible(ctx context.Context, conn net.Conn, exchange func() error) error {
+	done := make(chan struct{})
+	interrupted := make(chan struct{})
+	go func() {
+		defer close(interrupted)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	err := exchange()
+
+	close(done)
+	<-interrupted
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
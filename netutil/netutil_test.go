@@ -0,0 +1,58 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInterruptible(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+
+	// The peer never answers
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := Interruptible(ctx, clientSide, func() error {
+		_, err := io.ReadFull(clientSide, make([]byte, 1))
+		return err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Netutil: Expected the exchange to be abandoned, received %v", err)
+	}
+
+	// The error of a completed exchange is returned
+	exchangeError := errors.New("exchange failed")
+	if err := Interruptible(context.Background(), clientSide, func() error {
+		return exchangeError
+	}); err != exchangeError {
+		t.Errorf("Netutil: Expected the error of the exchange, received %v", err)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	if err := CloseWrite(clientSide); err != ErrHalfCloseUnsupported {
+		t.Errorf("Netutil: Expected half-close to be unsupported, received %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := CloseWrite(conn); err != nil {
+		t.Errorf("Netutil: TCP connection not half-closed: %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"net"
+)
+
+// accessRequest builds the request matched against the access rules.
+// The destination of a UDP associate request is the address the
+// client sends from, the destinations are checked per datagram.
+func accessRequest(request *socks5.Request, connectRequest socks5.SockRequest) *acl.Request {
+	access := &acl.Request{User: request.Username}
+	switch connectRequest.GetCommand() {
+	case socks5.CmdConnect:
+		access.Command = acl.CommandConnect
+	case socks5.CmdBind:
+		access.Command = acl.CommandBind
+	case socks5.CmdUDPAssc:
+		access.Command = acl.CommandUDPAssociate
+	}
+	if source, ok := request.SourceAddr.(*net.TCPAddr); ok {
+		access.Client = source.IP
+	}
+	if access.Command == acl.CommandUDPAssociate {
+		return access
+	}
+
+	access.Port = connectRequest.GetDestinationPort()
+	switch connectRequest.GetAddressType() {
+	case socks5.AtypIPV4, socks5.AtypIPV6:
+		access.IP = net.IP(connectRequest.GetDestinationAddress())
+	case socks5.AtypDomain:
+		access.Domain = string(connectRequest.GetDestinationAddress())
+	}
+	return access
+}
+
+// accessAllowed checks the request against the access rules and
+// logs the rule deciding. Everything is allowed without rules.
+func (server *Server) accessAllowed(access *acl.Request) bool {
+	rules := server.currentSettings().rules
+	if rules == nil {
+		return true
+	}
+
+	allowed, rule := rules.Allowed(access)
+	switch {
+	case !allowed:
+		logging.Info("Denied %s by rule %s", access, rule.Name)
+	case rule != nil:
+		logging.Debug("Allowed %s by rule %s", access, rule.Name)
+	}
+	return allowed
+}
+
+// allowedAddresses returns the resolved addresses of a domain
+// destination the access rules allow
+func (server *Server) allowedAddresses(access *acl.Request, addresses []net.IP) []net.IP {
+	allowed := make([]net.IP, 0, len(addresses))
+	for _, ip := range addresses {
+		resolved := *access
+		resolved.IP = ip
+		if server.accessAllowed(&resolved) {
+			allowed = append(allowed, ip)
+		}
+	}
+	return allowed
+}
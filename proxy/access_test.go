@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/config"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connectReply sends a CONNECT request on a new session
+// and returns the reply code
+func connectReply(t *testing.T, server *Server, connect []byte) socks5.ReplyType {
+	client, serverSide := net.Pipe()
+	defer client.Close()
+	go server.ServeConn(context.Background(), serverSide)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte{socks5.Socks5, 0x01, 0x00})
+	io.ReadFull(client, make([]byte, 2))
+	client.Write(connect)
+	return readReply(t, client).GetReply()
+}
+
+func TestAccessRules(t *testing.T) {
+	rules, err := acl.New([]config.Rule{
+		{Name: "no-smtp", Action: "deny", Ports: []string{"25"}},
+		{Name: "intranet", Action: "allow", Domains: []string{".intranet.example"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewWithOptions(Options{
+		Dialer:   &pipeDialer{dialed: make(chan string, 10)},
+		Resolver: staticResolver{net.IPv4(127, 0, 0, 1)},
+		Rules:    rules,
+	})
+
+	tests := []struct {
+		name    string
+		connect []byte
+		reply   socks5.ReplyType
+	}{
+		{"public address", []byte{socks5.Socks5, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x01, 0xbb}, socks5.ReplySucceeded},
+		{"denied port", []byte{socks5.Socks5, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x00, 25}, socks5.ReplyConnDenied},
+		{"metadata address", []byte{socks5.Socks5, 0x01, 0x00, 0x01, 169, 254, 169, 254, 0x00, 80}, socks5.ReplyConnDenied},
+		{"name resolving to loopback", connectRequest("localhost.example.com", 80), socks5.ReplyConnDenied},
+		{"allowed name", connectRequest("wiki.intranet.example", 80), socks5.ReplySucceeded},
+	}
+	for _, test := range tests {
+		if reply := connectReply(t, server, test.connect); reply != test.reply {
+			t.Errorf("%s: expected reply 0x%02x, received 0x%02x", test.name, test.reply, reply)
+		}
+	}
+}
+
+// allowLoopback returns the rules allowing the
+// loopback destinations the tests listen on
+func allowLoopback(t *testing.T) *acl.ACL {
+	rules, err := acl.New([]config.Rule{
+		{Name: "tests", Action: "allow", Destinations: []string{"127.0.0.1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestDefaultAccessRules(t *testing.T) {
+	for _, server := range []*Server{
+		NewWithOptions(Options{}),
+		New("test", 0, 10),
+	} {
+		server.SetDialer(&pipeDialer{dialed: make(chan string, 10)})
+		metadata := []byte{socks5.Socks5, 0x01, 0x00, 0x01, 169, 254, 169, 254, 0x00, 80}
+		if reply := connectReply(t, server, metadata); reply != socks5.ReplyConnDenied {
+			t.Errorf("Metadata address not denied by default, received 0x%02x", reply)
+		}
+		public := []byte{socks5.Socks5, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x01, 0xbb}
+		if reply := connectReply(t, server, public); reply != socks5.ReplySucceeded {
+			t.Errorf("Public address not allowed by default, received 0x%02x", reply)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"context"
+	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"net"
+	"time"
+)
+
+const defaultBindTimeout = 2 * time.Minute
+
+// handleBindLocal processes a BIND request (RFC 1928). A listening
+// socket is opened and its address is sent in the first reply. Once
+// the single inbound connection is accepted the peer address is sent
+// in the second reply and the request moves to proxying.
+func (server *Server) handleBindLocal(ctx context.Context, request *socks5.Request,
+	bindRequest socks5.SockRequest) {
+
+	clientConn := request.ClientConnection
+	request.State = socks5.RequestStateTerminating
+
+	// The inbound connection cannot come through an upstream
+	access := accessRequest(request, bindRequest)
+	if reply := server.directRouteReply(access); reply != socks5.ReplySucceeded {
+		server.sendReply(clientConn, socks5.NewSocksReply(reply, nil))
+		return
+	}
+
+	// The destination in a BIND request is the address of the
+	// application server expected to connect
+	resolveCtx, cancel := handshakeContext(ctx)
+	expected, err := server.resolveDestination(resolveCtx, request, bindRequest)
+	cancel()
+	if err != nil {
+		logging.Error("Error resolving %s", err, request.DestinationFQDN)
+		server.sendReply(clientConn, socks5.NewSocksReply(socks5.ReplyHostUnreachable, nil))
+		return
+	}
+
+	// Listen on the address the client reached us on so the
+	// bind address is reachable by the application server
+	var listenIP string
+	if local, ok := clientConn.LocalAddr().(*net.TCPAddr); ok {
+		listenIP = local.IP.String()
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(listenIP, "0"))
+	if err != nil {
+		logging.Error("Unable to open bind listener", err)
+		server.sendReply(clientConn, socks5.NewSocksReply(socks5.ReplyGeneralFail, nil))
+		return
+	}
+	defer listener.Close()
+
+	logging.Debug("Bind listening on %s for %s", listener.Addr(), request.SourceAddr)
+	if err = server.sendReply(clientConn,
+		socks5.NewSocksReply(socks5.ReplySucceeded, listener.Addr())); err != nil {
+		logging.Error("Error sending first bind reply", err)
+		return
+	}
+
+	// Waiting for the inbound connection is limited by
+	// the bind timeout, not the handshake deadline
+	clientConn.SetDeadline(time.Time{})
+
+	timeout := server.currentSettings().bindTimeout
+	if timeout <= 0 {
+		timeout = defaultBindTimeout
+	}
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(timeout))
+
+	// Cancelling the session stops waiting for the connection
+	accepted := make(chan struct{})
+	defer close(accepted)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-accepted:
+		}
+	}()
+
+	var inbound net.Conn
+	for {
+		inbound, err = listener.Accept()
+		if err != nil {
+			logging.Error("Error waiting for bind connection", err)
+			server.sendReply(clientConn, socks5.NewSocksReply(socks5.ReplyTTLExpired, nil))
+			return
+		}
+
+		if bindPeerAllowed(inbound.RemoteAddr(), expected) {
+			break
+		}
+		logging.Info("Rejecting bind connection from %s", inbound.RemoteAddr())
+		inbound.Close()
+	}
+
+	if err = server.sendReply(clientConn,
+		socks5.NewSocksReply(socks5.ReplySucceeded, inbound.RemoteAddr())); err != nil {
+		logging.Error("Error sending second bind reply", err)
+		inbound.Close()
+		return
+	}
+
+	request.DestinationAddr = inbound.RemoteAddr()
+	request.OutboundConnection = inbound
+	request.State = socks5.RequestStateProxying
+}
+
+// bindPeerAllowed checks if the inbound connection comes from one of
+// the expected addresses. An unspecified address allows any peer.
+func bindPeerAllowed(peer net.Addr, expected []net.IP) bool {
+	peerAddr, ok := peer.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ip := range expected {
+		if ip.IsUnspecified() || ip.Equal(peerAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendReply serializes the reply and writes it to the client
+func (server *Server) sendReply(clientConn net.Conn, reply socks5.SockReply) error {
+	replyStream, err := socks5.GetSocketResponseSerialized(reply)
+	if err != nil {
+		return err
+	}
+	_, err = clientConn.Write(replyStream)
+	return err
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"net"
+	"testing"
+	"time"
+)
+
+// bindRequest builds a BIND request for the IPv4 address
+func bindRequest(ip net.IP, port int) []byte {
+	msg := []byte{socks5.Socks5, 0x02, 0x00, 0x01}
+	msg = append(msg, ip.To4()...)
+	return append(msg, byte(port>>8), byte(port))
+}
+
+// readReply reads and decodes a single reply from the connection
+func readReply(t *testing.T, conn net.Conn) socks5.SockReply {
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		t.Fatalf("Error reading reply: %v", err)
+	}
+
+	reply, err := socks5.GetSocketResponseDeserialized(response[:n])
+	if err != nil {
+		t.Fatalf("Error decoding reply: %v", err)
+	}
+	return reply
+}
+
+func TestBind(t *testing.T) {
+	server := Server{name: "test"}
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+
+	request := &socks5.Request{ClientConnection: writeConn}
+	done := make(chan bool)
+	go func() {
+		server.handleConnectLocal(context.Background(), request)
+		close(done)
+	}()
+
+	readConn.Write(bindRequest(net.IPv4zero, 0))
+
+	first := readReply(t, readConn)
+	if first.GetReply() != socks5.ReplySucceeded || first.GetBindPort() == 0 {
+		t.Fatalf("Invalid first bind reply: 0x%02x port %d", first.GetReply(),
+			first.GetBindPort())
+	}
+
+	peer, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", first.GetBindPort()))
+	if err != nil {
+		t.Fatalf("Unable to connect to bind address: %v", err)
+	}
+	defer peer.Close()
+
+	second := readReply(t, readConn)
+	<-done
+
+	if second.GetReply() != socks5.ReplySucceeded {
+		t.Errorf("Invalid second bind reply: 0x%02x", second.GetReply())
+	}
+
+	localPort := peer.LocalAddr().(*net.TCPAddr).Port
+	if !net.IP(second.GetBindAddress()).IsLoopback() || int(second.GetBindPort()) != localPort {
+		t.Errorf("Second reply does not carry the peer address: %v:%d",
+			net.IP(second.GetBindAddress()), second.GetBindPort())
+	}
+
+	if request.State != socks5.RequestStateProxying || request.OutboundConnection == nil {
+		t.Fatalf("Request not proxying after bind")
+	}
+	defer request.OutboundConnection.Close()
+
+	peer.Write([]byte("hello"))
+	buffer := make([]byte, 5)
+	request.OutboundConnection.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := request.OutboundConnection.Read(buffer); err != nil || string(buffer[:n]) != "hello" {
+		t.Errorf("Inbound connection not usable: %v", err)
+	}
+}
+
+func TestBindUnexpectedPeer(t *testing.T) {
+	server := Server{name: "test"}
+	server.SetBindTimeout(200 * time.Millisecond)
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+
+	request := &socks5.Request{ClientConnection: writeConn}
+	go server.handleConnectLocal(context.Background(), request)
+
+	readConn.Write(bindRequest(net.ParseIP("10.9.9.9"), 0))
+
+	first := readReply(t, readConn)
+	if first.GetReply() != socks5.ReplySucceeded {
+		t.Fatalf("Invalid first bind reply: 0x%02x", first.GetReply())
+	}
+
+	peer, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", first.GetBindPort()))
+	if err != nil {
+		t.Fatalf("Unable to connect to bind address: %v", err)
+	}
+	defer peer.Close()
+
+	second := readReply(t, readConn)
+	if second.GetReply() != socks5.ReplyTTLExpired {
+		t.Errorf("Unexpected peer accepted. Received : 0x%02x", second.GetReply())
+	}
+}
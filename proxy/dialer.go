@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// errSocketOptionsUnsupported is returned when a socket option is
+// configured on a platform not supporting it
+var errSocketOptionsUnsupported = errors.New("socket mark and interface binding are only supported on Linux")
+
+// NetDialer is the default Dialer. The zero value
+// connects like net.Dial.
+type NetDialer struct {
+	// Timeout is the connect timeout. Zero uses
+	// the operating system timeout.
+	Timeout time.Duration
+	// KeepAlive is the interval of the TCP keep-alive probes.
+	// Zero uses the default interval, a negative value
+	// disables them.
+	KeepAlive time.Duration
+	// LocalAddr is the IP address connections are made from
+	LocalAddr net.IP
+	// Mark is the SO_MARK set on the sockets, Linux only
+	Mark int
+	// Interface is the network interface the sockets
+	// are bound to, Linux only
+	Interface string
+}
+
+// DialContext implementation of the Dialer interface
+func (dialer *NetDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	netDialer := &net.Dialer{
+		Timeout:   dialer.Timeout,
+		KeepAlive: dialer.KeepAlive,
+	}
+
+	if dialer.LocalAddr != nil {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			netDialer.LocalAddr = &net.TCPAddr{IP: dialer.LocalAddr}
+		case "udp", "udp4", "udp6":
+			netDialer.LocalAddr = &net.UDPAddr{IP: dialer.LocalAddr}
+		default:
+			return nil, fmt.Errorf("local address not supported for network %s", network)
+		}
+	}
+
+	if dialer.Mark != 0 || dialer.Interface != "" {
+		control, err := socketControl(dialer.Mark, dialer.Interface)
+		if err != nil {
+			return nil, err
+		}
+		netDialer.Control = control
+	}
+
+	return netDialer.DialContext(ctx, network, address)
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"syscall"
+)
+
+// socketControl returns the function setting the
+// mark and the interface on the sockets
+func socketControl(mark int, device string) (func(network, address string, conn syscall.RawConn) error, error) {
+	return func(network, address string, conn syscall.RawConn) error {
+		var err error
+		controlErr := conn.Control(func(fd uintptr) {
+			if mark != 0 {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+				if err != nil {
+					return
+				}
+			}
+			if device != "" {
+				err = syscall.BindToDevice(int(fd), device)
+			}
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"syscall"
+)
+
+// socketControl is not supported outside of Linux
+func socketControl(mark int, device string) (func(network, address string, conn syscall.RawConn) error, error) {
+	return nil, errSocketOptionsUnsupported
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestNetDialerLocalAddress(t *testing.T) {
+	listener := startTCPEcho(t)
+	defer listener.Close()
+
+	dialer := &NetDialer{LocalAddr: net.IPv4(127, 0, 0, 1)}
+	conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	if local := conn.LocalAddr().(*net.TCPAddr); !local.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Unexpected local address %s", local)
+	}
+
+	if _, err := dialer.DialContext(context.Background(), "unix", "/tmp/socket"); err == nil {
+		t.Errorf("Local address accepted for unix sockets")
+	}
+}
+
+func TestNetDialerCancelled(t *testing.T) {
+	listener := startTCPEcho(t)
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dialer := &NetDialer{}
+	if conn, err := dialer.DialContext(ctx, "tcp", listener.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("Cancelled dial succeeded")
+	}
+}
+
+func TestNetDialerSocketOptions(t *testing.T) {
+	listener := startTCPEcho(t)
+	defer listener.Close()
+
+	dialer := &NetDialer{Mark: 100, Interface: "lo"}
+	conn, err := dialer.DialContext(context.Background(), "tcp", listener.Addr().String())
+
+	switch {
+	case runtime.GOOS != "linux":
+		if err != errSocketOptionsUnsupported {
+			t.Errorf("Unsupported socket options not reported %v", err)
+		}
+	case err != nil && (errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENODEV)):
+		t.Skipf("Socket options not permitted: %v", err)
+	case err != nil:
+		t.Errorf("Dial with socket options failed: %v", err)
+	default:
+		conn.Close()
+	}
+}
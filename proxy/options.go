@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/auth"
+	"hiteshkotian/ssl-tunnel/config"
+	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/netutil"
+	"hiteshkotian/ssl-tunnel/resolver"
+	"hiteshkotian/ssl-tunnel/router"
+	"log"
+	"net"
+	"time"
+)
+
+// Dialer opens the connections to the destinations
+type Dialer = netutil.Dialer
+
+// Options configure a server created with NewWithOptions.
+// The zero value of a field selects its default.
+type Options struct {
+	// Name of the server, "server1" by default
+	Name string
+	// MaxConnections is the number of connections processed
+	// concurrently, 200 by default
+	MaxConnections int
+	// Listener is served by Start instead of listening on ":1080"
+	Listener net.Listener
+	// Dialer opens the connections to the destinations, a
+	// NetDialer by default. It is kept when a configuration
+	// is applied with Reload.
+	Dialer Dialer
+	// Resolver looks up domain name destinations, the system
+	// resolver by default. It is kept when a configuration is
+	// applied with Reload.
+	Resolver resolver.Resolver
+	// Authenticator validates the credentials of the clients.
+	// When nil no authentication is required.
+	Authenticator auth.Authenticator
+	// Logger the messages are written to. Logging is process
+	// wide, setting it affects every server.
+	Logger *log.Logger
+	// HandshakeTimeout is the deadline for the SOCKS handshake
+	HandshakeTimeout time.Duration
+	// ConnectTimeout is the timeout for connecting to the
+	// destination. Zero uses the operating system timeout.
+	ConnectTimeout time.Duration
+	// IdleTimeout is how long a relay is kept open while no data
+	// flows in either direction, 5 minutes by default. A negative
+	// value does not limit it.
+	IdleTimeout time.Duration
+	// MaxSessionDuration is the maximum lifetime of a
+	// session. Zero does not limit it.
+	MaxSessionDuration time.Duration
+	// BufferSize is the size of the buffers relaying the data
+	// when the kernel cannot copy it. Zero uses the default.
+	BufferSize int
+	// Rules decide which requests are allowed. When nil the
+	// default rules deny the loopback, private and link-local
+	// ranges and allow every other destination.
+	Rules *acl.ACL
+	// Router selects the route of CONNECT requests. When nil
+	// every destination is connected to directly.
+	Router *router.Router
+	// Upstreams are the dialers of the upstream routes,
+	// by route name
+	Upstreams map[string]Dialer
+	// BindTimeout is how long a BIND request waits for the
+	// inbound connection
+	BindTimeout time.Duration
+}
+
+// NewWithOptions creates a new instance of the proxy
+// for embedding it in another program
+func NewWithOptions(options Options) *Server {
+	if options.Name == "" {
+		options.Name = config.DefaultName
+	}
+	if options.MaxConnections <= 0 {
+		options.MaxConnections = config.DefaultMaxConnections
+	}
+
+	proxy := New(options.Name, 0, options.MaxConnections)
+	proxy.addresses = []string{config.DefaultListenAddress}
+	proxy.listener = options.Listener
+	proxy.dialer = options.Dialer
+	proxy.customDialer = options.Dialer
+	if options.Resolver != nil {
+		proxy.resolver = options.Resolver
+		proxy.customResolver = options.Resolver
+	}
+	proxy.authenticator = options.Authenticator
+	if options.HandshakeTimeout > 0 {
+		proxy.handshakeTimeout = options.HandshakeTimeout
+	}
+	proxy.connectTimeout = options.ConnectTimeout
+	proxy.idleTimeout = relayIdleTimeout(options.IdleTimeout)
+	proxy.maxSessionDuration = options.MaxSessionDuration
+	proxy.bufferSize = options.BufferSize
+	if options.Rules != nil {
+		proxy.rules = options.Rules
+	}
+	proxy.router = options.Router
+	proxy.upstreams = options.Upstreams
+	proxy.bindTimeout = options.BindTimeout
+
+	if options.Logger != nil {
+		logging.SetLogger(options.Logger)
+	}
+	return proxy
+}
+
+// SetDialer configures the dialer opening the connections to the
+// destinations. It is kept when a configuration is applied with
+// Reload, nil restores the dialer of the configuration.
+func (server *Server) SetDialer(dialer Dialer) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.dialer = dialer
+	server.customDialer = dialer
+}
+
+// relayIdleTimeout returns the idle timeout of the relay for the
+// configured one: the default when zero, no limit when negative
+func relayIdleTimeout(timeout time.Duration) time.Duration {
+	switch {
+	case timeout == 0:
+		return defaultIdleTimeout
+	case timeout < 0:
+		return 0
+	}
+	return timeout
+}
+
+// Serve accepts the connections of the listener until it fails or
+// the server is stopped. The listener is closed by Stop but is not
+// affected by configuration reloads.
+func (server *Server) Serve(listener net.Listener) error {
+	server.listenerMutex.Lock()
+	if server.stopped() {
+		server.listenerMutex.Unlock()
+		return ErrServerClosed
+	}
+	if server.external == nil {
+		server.external = map[net.Listener]bool{}
+	}
+	server.external[listener] = true
+	server.acceptors.Add(1)
+	server.listenerMutex.Unlock()
+
+	defer func() {
+		server.listenerMutex.Lock()
+		delete(server.external, listener)
+		server.listenerMutex.Unlock()
+		server.acceptors.Done()
+	}()
+
+	server.handlerOnce.Do(func() {
+		go server.startHandler()
+	})
+
+	err := server.acceptConnections(listener)
+	if server.stopped() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// ListenAndServe listens on the TCP address and accepts connections
+// until the context is done. The sessions in progress are not
+// affected when it returns, see Shutdown.
+func (server *Server) ListenAndServe(ctx context.Context, address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	logging.Info("Listening on %s", listener.Addr())
+
+	served := make(chan struct{})
+	defer close(served)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-served:
+		}
+	}()
+
+	err = server.Serve(listener)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ServeConn processes the session of a single client connection and
+// returns once it is complete. The connection is closed when the
+// context is done.
+func (server *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	sessionCtx, sem, err := server.beginSession(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	server.handleRequest2(sessionCtx, conn, sem)
+	return ctx.Err()
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hiteshkotian/ssl-tunnel/config"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeDialer connects to an in-memory destination echoing a
+// single message, and records the addresses dialed
+type pipeDialer struct {
+	dialed chan string
+}
+
+func (dialer *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer.dialed <- address
+	proxySide, destination := net.Pipe()
+	go func() {
+		buffer := make([]byte, 512)
+		n, err := destination.Read(buffer)
+		if err == nil {
+			destination.Write(buffer[:n])
+		}
+		destination.Close()
+	}()
+	return proxySide, nil
+}
+
+// failingDialer refuses every connection
+type failingDialer struct{}
+
+func (failingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, errors.New("dial refused")
+}
+
+// staticResolver resolves every name to the same address
+type staticResolver struct {
+	ip net.IP
+}
+
+func (resolver staticResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return []net.IP{resolver.ip}, nil
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	current := NewWithOptions(Options{}).currentSettings()
+	if current.idleTimeout != defaultIdleTimeout || current.handshakeTimeout != defaultHandshakeTimeout ||
+		current.maxConnectionCount != config.DefaultMaxConnections {
+		t.Errorf("Defaults not applied %+v", current)
+	}
+	if current = NewWithOptions(Options{IdleTimeout: -1}).currentSettings(); current.idleTimeout != 0 {
+		t.Errorf("Idle timeout not disabled, %s", current.idleTimeout)
+	}
+}
+
+func TestServeConnInMemory(t *testing.T) {
+	dialer := &pipeDialer{dialed: make(chan string, 1)}
+	server := NewWithOptions(Options{
+		Dialer:   dialer,
+		Resolver: staticResolver{net.IPv4(192, 0, 2, 1)},
+	})
+
+	client, serverSide := net.Pipe()
+	defer client.Close()
+
+	served := make(chan error)
+	go func() { served <- server.ServeConn(context.Background(), serverSide) }()
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte{socks5.Socks5, 0x01, 0x00})
+	if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+		t.Fatalf("Error reading method selection: %v", err)
+	}
+
+	client.Write(connectRequest("example.com", 443))
+	reply := readReply(t, client)
+	if reply.GetReply() != socks5.ReplySucceeded {
+		t.Fatalf("Connect failed with 0x%02x", reply.GetReply())
+	}
+	if address := <-dialer.dialed; address != "192.0.2.1:443" {
+		t.Errorf("Unexpected address dialed %s", address)
+	}
+
+	client.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(client, echo); err != nil || !bytes.Equal(echo, []byte("ping")) {
+		t.Errorf("Unexpected echo %q, %v", echo, err)
+	}
+
+	client.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("ServeConn returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("ServeConn did not return")
+	}
+}
+
+func TestServeConnDialFailure(t *testing.T) {
+	server := NewWithOptions(Options{Dialer: failingDialer{}})
+	client, serverSide := net.Pipe()
+	defer client.Close()
+	go server.ServeConn(context.Background(), serverSide)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte{socks5.Socks5, 0x01, 0x00})
+	io.ReadFull(client, make([]byte, 2))
+	client.Write([]byte{socks5.Socks5, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x01, 0xbb})
+	if reply := readReply(t, client); reply.GetReply() != socks5.ReplyGeneralFail {
+		t.Errorf("Expected general failure, received 0x%02x", reply.GetReply())
+	}
+}
+
+func TestServeConnContextCancel(t *testing.T) {
+	server := NewWithOptions(Options{})
+	client, serverSide := net.Pipe()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() { served <- server.ServeConn(ctx, serverSide) }()
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Errorf("ServeConn returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Session not closed when the context was cancelled")
+	}
+}
+
+func TestServeListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewWithOptions(Options{Listener: listener})
+
+	done := make(chan error)
+	go func() { done <- server.Start() }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect %v", err)
+	}
+	if method := greet(t, conn); method != uint8(socks5.MethodNoAuth) {
+		t.Errorf("Unexpected method 0x%02x", method)
+	}
+	conn.Close()
+
+	server.Stop()
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+func TestListenAndServeContext(t *testing.T) {
+	server := NewWithOptions(Options{})
+	address := freeAddress(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- server.ListenAndServe(ctx, address) }()
+
+	var conn net.Conn
+	for i := 0; i < 100 && conn == nil; i++ {
+		conn, _ = net.Dial("tcp", address)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn == nil {
+		t.Fatalf("Server not listening on %s", address)
+	}
+	conn.Close()
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("ListenAndServe returned %v", err)
+	}
+	if conn, err := net.Dial("tcp", address); err == nil {
+		conn.Close()
+		t.Errorf("Listener still open")
+	}
+}
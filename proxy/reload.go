@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/auth"
+	"hiteshkotian/ssl-tunnel/config"
+	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/resolver"
+	"hiteshkotian/ssl-tunnel/router"
+	"net"
+)
+
+// Reload applies a configuration to the server. The configuration is
+// applied as a whole or not at all: when the access rules, the routes,
+// the credentials or the new listeners cannot be set up the settings
+// in use are kept. Sessions already established are not affected. The
+// dialer is replaced by one built from the outbound section, which
+// also reaches the upstreams, and the resolver by one built from the
+// dns section, unless they were set with the options, SetDialer or
+// SetResolver. The health checks of the previous pools
+// are stopped.
+func (server *Server) Reload(proxyConfig *config.Config) error {
+	rules, err := acl.New(proxyConfig.Rules)
+	if err != nil {
+		return err
+	}
+
+	routes, err := router.New(proxyConfig.Routing)
+	if err != nil {
+		return err
+	}
+	server.mutex.RLock()
+	dialer, nameResolver := server.customDialer, server.customResolver
+	server.mutex.RUnlock()
+	if dialer == nil {
+		dialer = newDialer(proxyConfig.Outbound)
+	}
+	if nameResolver == nil {
+		nameResolver = newResolver(proxyConfig.DNS)
+	}
+
+	upstreams, pools, err := newUpstreamDialers(proxyConfig, routes, dialer)
+	if err != nil {
+		return err
+	}
+
+	authenticator, err := newAuthenticator(proxyConfig.Authentication)
+	if err != nil {
+		closePools(pools)
+		return err
+	}
+
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+
+	// Listeners are only managed once the server was started,
+	// new ones are opened before anything is changed
+	addresses := proxyConfig.ListenAddresses()
+	if server.serving {
+		if _, err := server.openListeners(addresses); err != nil {
+			closeAuthenticator(authenticator)
+			closePools(pools)
+			return err
+		}
+	}
+
+	server.mutex.Lock()
+	previous := server.settings
+	next := previous
+	next.authenticator = authenticator
+	next.handshakeTimeout = proxyConfig.Timeouts.Handshake.Duration
+	next.connectTimeout = proxyConfig.Timeouts.Connect.Duration
+	next.idleTimeout = relayIdleTimeout(proxyConfig.Timeouts.Idle.Duration)
+	next.maxSessionDuration = proxyConfig.Timeouts.MaxSession.Duration
+	next.bindTimeout = proxyConfig.Timeouts.Bind.Duration
+	next.dialer = dialer
+	next.resolver = nameResolver
+	next.bufferSize = proxyConfig.Outbound.BufferSize
+	next.rules = rules
+	next.router = routes
+	next.upstreams = upstreams
+	next.pools = pools
+	if next.sem == nil || next.maxConnectionCount != proxyConfig.MaxConnections {
+		// Sessions accepted before keep releasing the previous limiter
+		next.maxConnectionCount = proxyConfig.MaxConnections
+		next.sem = make(chan bool, next.maxConnectionCount)
+	}
+	server.settings = next
+	server.mutex.Unlock()
+
+	closeAuthenticator(previous.authenticator)
+	closePools(previous.pools)
+
+	server.addresses = addresses
+	if server.serving {
+		server.closeListeners(addresses)
+	}
+
+	if proxyConfig.Logging.Level == "debug" {
+		logging.EnableDebug()
+	} else {
+		logging.DisableDebug()
+	}
+	return nil
+}
+
+// newAuthenticator returns the authenticator for the configured
+// credentials, nil when no authentication is required
+func newAuthenticator(authentication config.Authentication) (auth.Authenticator, error) {
+	if authentication.Htpasswd != "" {
+		store, err := auth.NewHtpasswdFile(authentication.Htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		store.Watch(authentication.ReloadInterval.Duration)
+		return store, nil
+	}
+
+	if len(authentication.Users) == 0 {
+		return nil, nil
+	}
+	return auth.StaticCredentials(authentication.Users), nil
+}
+
+// closeAuthenticator releases the resources of an
+// authenticator that is no longer used
+func closeAuthenticator(authenticator auth.Authenticator) {
+	if store, ok := authenticator.(*auth.HtpasswdFile); ok {
+		store.Close()
+	}
+}
+
+// newDialer returns the dialer for the outbound settings
+func newDialer(outbound config.Outbound) Dialer {
+	return &NetDialer{
+		KeepAlive: outbound.KeepAlive.Duration,
+		LocalAddr: net.ParseIP(outbound.LocalAddress),
+		Mark:      outbound.Mark,
+		Interface: outbound.Interface,
+	}
+}
+
+// newResolver returns the resolver for the dns settings: the hosts,
+// then the cache in front of the servers of the suffixes and the
+// system resolver
+func newResolver(dns config.DNS) resolver.Resolver {
+	var nameResolver resolver.Resolver = resolver.SystemResolver{}
+	if len(dns.Servers) > 0 {
+		rules := make([]resolver.SplitRule, 0, len(dns.Servers))
+		for _, server := range dns.Servers {
+			rules = append(rules, resolver.SplitRule{
+				Suffix:   server.Suffix,
+				Resolver: resolver.NewDNSResolver(server.Address),
+			})
+		}
+		nameResolver = resolver.NewSplitResolver(rules, nameResolver)
+	}
+
+	if !dns.Cache.Disabled {
+		cache := resolver.NewCachingResolver(nameResolver)
+		cache.SetTTLs(dns.Cache.TTL.Duration, dns.Cache.NegativeTTL.Duration,
+			dns.Cache.MaxTTL.Duration)
+		nameResolver = cache
+	}
+
+	if len(dns.Hosts) > 0 {
+		hosts := make(map[string][]net.IP, len(dns.Hosts))
+		for host, addresses := range dns.Hosts {
+			for _, address := range addresses {
+				hosts[host] = append(hosts[host], net.ParseIP(address))
+			}
+		}
+		nameResolver = resolver.NewHostsResolver(hosts, nameResolver)
+	}
+	return nameResolver
+}
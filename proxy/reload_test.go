@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/config"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddress returns a loopback address nothing listens on
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func parseConfig(t *testing.T, document string) *config.Config {
+	proxyConfig, err := config.Parse("proxy.yaml", []byte(document))
+	if err != nil {
+		t.Fatalf("Invalid test configuration: %v", err)
+	}
+	return proxyConfig
+}
+
+// greet sends a method selection offering no authentication
+// and returns the method selected by the server
+func greet(t *testing.T, conn net.Conn) uint8 {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{socks5.Socks5, 0x01, 0x00})
+	response := make([]byte, 2)
+	if _, err := conn.Read(response); err != nil {
+		t.Fatalf("Error reading method selection: %v", err)
+	}
+	return response[1]
+}
+
+func TestReloadSettings(t *testing.T) {
+	server, err := NewWithConfig(parseConfig(t, `max_connections: 5
+authentication:
+  users:
+    alice: secret
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousSem := server.currentSettings().sem
+
+	err = server.Reload(parseConfig(t, `max_connections: 10
+timeouts:
+  connect: 4s
+authentication:
+  users:
+    bob: secret
+`))
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	current := server.currentSettings()
+	if current.authenticator.Authenticate("alice", "secret") ||
+		!current.authenticator.Authenticate("bob", "secret") {
+		t.Errorf("Credentials not replaced")
+	}
+	if cap(current.sem) != 10 || current.sem == previousSem || current.connectTimeout != 4*time.Second {
+		t.Errorf("Limits not replaced %+v", current)
+	}
+
+	// A configuration that cannot be applied keeps the current one
+	err = server.Reload(parseConfig(t, `max_connections: 20
+authentication:
+  htpasswd: /nonexistent/htpasswd
+`))
+	if err == nil {
+		t.Errorf("Invalid configuration applied")
+	}
+	if current = server.currentSettings(); cap(current.sem) != 10 ||
+		!current.authenticator.Authenticate("bob", "secret") {
+		t.Errorf("Settings changed by a rejected reload")
+	}
+}
+
+func TestReloadListeners(t *testing.T) {
+	first, second := freeAddress(t), freeAddress(t)
+
+	server, err := NewWithConfig(parseConfig(t, fmt.Sprintf(`listeners:
+  - address: %s
+`, first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- server.Start() }()
+
+	var established net.Conn
+	for i := 0; i < 100 && established == nil; i++ {
+		established, _ = net.Dial("tcp", first)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if established == nil {
+		t.Fatalf("Server not listening on %s", first)
+	}
+	defer established.Close()
+
+	err = server.Reload(parseConfig(t, fmt.Sprintf(`listeners:
+  - address: %s
+`, second)))
+	if err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	// The new address accepts connections, the old one is closed
+	conn, err := net.Dial("tcp", second)
+	if err != nil {
+		t.Fatalf("New listener not opened: %v", err)
+	}
+	if method := greet(t, conn); method != uint8(socks5.MethodNoAuth) {
+		t.Errorf("Unexpected method 0x%02x on new listener", method)
+	}
+	conn.Close()
+
+	if conn, err := net.Dial("tcp", first); err == nil {
+		conn.Close()
+		t.Errorf("Old listener still accepting connections")
+	}
+
+	// Connections accepted by the old listener are served
+	if method := greet(t, established); method != uint8(socks5.MethodNoAuth) {
+		t.Errorf("Unexpected method 0x%02x on established connection", method)
+	}
+
+	// An address that cannot be listened on rejects the reload
+	occupied, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer occupied.Close()
+	err = server.Reload(parseConfig(t, fmt.Sprintf(`listeners:
+  - address: %s
+`, occupied.Addr())))
+	if err == nil {
+		t.Errorf("Reload with an unavailable address applied")
+	}
+	if conn, err := net.Dial("tcp", second); err != nil {
+		t.Errorf("Listener closed by a rejected reload: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	server.Stop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Server did not stop")
+	}
+}
+
+func TestReloadResolver(t *testing.T) {
+	server, err := NewWithConfig(parseConfig(t, `dns:
+  hosts:
+    intranet.example: [10.0.0.5]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func() net.IP {
+		ips, err := server.nameResolver().LookupIP(context.Background(), "intranet.example")
+		if err != nil || len(ips) != 1 {
+			t.Fatalf("Lookup failed: %v, %v", ips, err)
+		}
+		return ips[0]
+	}
+	if ip := lookup(); !ip.Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Errorf("Host override not used, resolved %v", ip)
+	}
+
+	if err := server.Reload(parseConfig(t, `dns:
+  hosts:
+    intranet.example: [10.0.0.6]
+`)); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if ip := lookup(); !ip.Equal(net.IPv4(10, 0, 0, 6)) {
+		t.Errorf("Resolver not replaced, resolved %v", ip)
+	}
+}
+
+func TestReloadKeepsOptions(t *testing.T) {
+	dialer := &pipeDialer{dialed: make(chan string, 1)}
+	nameResolver := &staticResolver{ip: net.ParseIP("192.0.2.1")}
+	server := NewWithOptions(Options{Dialer: dialer, Resolver: nameResolver})
+
+	if err := server.Reload(parseConfig(t, `timeouts:
+  idle: -1s
+`)); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	current := server.currentSettings()
+	if current.dialer != dialer || current.resolver != nameResolver {
+		t.Errorf("Dialer or resolver of the options replaced by the configuration")
+	}
+	if current.idleTimeout != 0 {
+		t.Errorf("Idle timeout not disabled, %s", current.idleTimeout)
+	}
+
+	// Without options the dialer and resolver of the configuration are used
+	server.SetDialer(nil)
+	server.SetResolver(nil)
+	if err := server.Reload(parseConfig(t, "")); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if current = server.currentSettings(); current.dialer == dialer || current.resolver == nil ||
+		current.idleTimeout != config.DefaultIdleTimeout {
+		t.Errorf("Settings of the configuration not applied %+v", current)
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"hiteshkotian/ssl-tunnel/httpconnect"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// replyFromError maps the error returned while resolving or
+// dialing the destination to the SOCKS reply sent to the client
+func replyFromError(err error) socks5.ReplyType {
+	var dnsError *net.DNSError
+	var netError net.Error
+	var replyError *socks5.ReplyError
+	var statusError *httpconnect.StatusError
+
+	switch {
+	case err == nil:
+		return socks5.ReplySucceeded
+	case errors.As(err, &replyError):
+		// The reply of an upstream is passed on
+		return replyError.Reply
+	case errors.As(err, &statusError):
+		return replyFromStatus(statusError.StatusCode)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5.ReplyConnRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+		return socks5.ReplyHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+		return socks5.ReplyNetUnreachable
+	case errors.As(err, &dnsError):
+		return socks5.ReplyHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded):
+		return socks5.ReplyTTLExpired
+	case errors.As(err, &netError) && netError.Timeout():
+		return socks5.ReplyTTLExpired
+	}
+	return socks5.ReplyGeneralFail
+}
+
+// replyFromStatus maps the status an HTTP upstream answered
+// a CONNECT request with to the SOCKS reply
+func replyFromStatus(status int) socks5.ReplyType {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusProxyAuthRequired:
+		return socks5.ReplyConnDenied
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return socks5.ReplyCmdUnsupp
+	case http.StatusNotFound, http.StatusBadGateway:
+		return socks5.ReplyHostUnreachable
+	case http.StatusServiceUnavailable:
+		return socks5.ReplyConnRefused
+	case http.StatusGatewayTimeout, http.StatusRequestTimeout:
+		return socks5.ReplyTTLExpired
+	}
+	return socks5.ReplyGeneralFail
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/httpconnect"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// timeoutError is a net.Error reporting a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func dialError(errno syscall.Errno) error {
+	return &net.OpError{Op: "dial", Net: "tcp",
+		Err: os.NewSyscallError("connect", errno)}
+}
+
+func TestReplyFromError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected socks5.ReplyType
+	}{
+		{"no error", nil, socks5.ReplySucceeded},
+		{"refused", dialError(syscall.ECONNREFUSED), socks5.ReplyConnRefused},
+		{"host unreachable", dialError(syscall.EHOSTUNREACH), socks5.ReplyHostUnreachable},
+		{"network unreachable", dialError(syscall.ENETUNREACH), socks5.ReplyNetUnreachable},
+		{"timeout", &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}},
+			socks5.ReplyTTLExpired},
+		{"context deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded),
+			socks5.ReplyTTLExpired},
+		{"dns", &net.DNSError{Err: "no such host", IsNotFound: true},
+			socks5.ReplyHostUnreachable},
+		{"upstream reply", &socks5.ReplyError{Reply: socks5.ReplyNetUnreachable},
+			socks5.ReplyNetUnreachable},
+		{"http authentication", &httpconnect.StatusError{StatusCode: 407},
+			socks5.ReplyConnDenied},
+		{"http bad gateway", fmt.Errorf("route: %w", &httpconnect.StatusError{StatusCode: 502}),
+			socks5.ReplyHostUnreachable},
+		{"http gateway timeout", &httpconnect.StatusError{StatusCode: 504},
+			socks5.ReplyTTLExpired},
+		{"http server error", &httpconnect.StatusError{StatusCode: 500},
+			socks5.ReplyGeneralFail},
+		{"other", errors.New("failure"), socks5.ReplyGeneralFail},
+	}
+
+	for _, test := range tests {
+		if reply := replyFromError(test.err); reply != test.expected {
+			t.Errorf("%s: expected 0x%02x, received 0x%02x", test.name,
+				test.expected, reply)
+		}
+	}
+}
+
+func TestRequestReplies(t *testing.T) {
+	// Find a closed port to get a connection refused
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	tests := []struct {
+		name     string
+		msg      []byte
+		expected socks5.ReplyType
+	}{
+		{"unsupported command", []byte{socks5.Socks5, 0x09, 0x00, 0x01, 127, 0, 0, 1, 0, 80},
+			socks5.ReplyCmdUnsupp},
+		{"unsupported address type", []byte{socks5.Socks5, 0x01, 0x00, 0x02, 127, 0, 0, 1, 0, 80},
+			socks5.ReplyAddrTypUnsupp},
+		{"invalid version", []byte{0x04, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 80},
+			socks5.ReplyGeneralFail},
+		{"connection refused", []byte{socks5.Socks5, 0x01, 0x00, 0x01, 127, 0, 0, 1,
+			byte(closedPort >> 8), byte(closedPort)}, socks5.ReplyConnRefused},
+	}
+
+	for _, test := range tests {
+		server := Server{name: "test"}
+		writeConn, readConn := net.Pipe()
+
+		request := &socks5.Request{ClientConnection: writeConn}
+		go server.handleConnectLocal(context.Background(), request)
+
+		readConn.Write(test.msg)
+		reply := readReply(t, readConn)
+		if reply.GetReply() != test.expected {
+			t.Errorf("%s: expected 0x%02x, received 0x%02x", test.name,
+				test.expected, reply.GetReply())
+		}
+		readConn.Close()
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"fmt"
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/config"
+	"hiteshkotian/ssl-tunnel/httpconnect"
+	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/router"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"hiteshkotian/ssl-tunnel/upstream"
+	"net"
+	"strconv"
+)
+
+// selectRoute returns the route of the request and logs it.
+// Every destination is connected to directly without router.
+func (server *Server) selectRoute(access *acl.Request) *router.Route {
+	routes := server.currentSettings().router
+	if routes == nil {
+		return router.DirectRoute
+	}
+
+	route, rule := routes.Route(access)
+	if route.Kind == router.Block {
+		logging.Info("Blocked %s by routing rule %s", access, rule)
+	} else {
+		logging.Debug("Routing %s via %s, selected by %s", access, route.Name, rule)
+	}
+	return route
+}
+
+// directRouteReply selects the route of a BIND request or a UDP
+// datagram, which are only relayed directly. It returns the reply
+// refusing the request when the destination is blocked or routed
+// through upstreams, ReplySucceeded otherwise.
+func (server *Server) directRouteReply(access *acl.Request) socks5.ReplyType {
+	route := server.selectRoute(access)
+	switch route.Kind {
+	case router.Block:
+		return socks5.ReplyConnDenied
+	case router.Upstream:
+		logging.Info("Rejected %s: upstream route %s does not support %s",
+			access, route.Name, access.Command)
+		return socks5.ReplyCmdUnsupp
+	}
+	return socks5.ReplySucceeded
+}
+
+// routeDialer returns the dialer connecting through the route
+func (current settings) routeDialer(route *router.Route) (Dialer, error) {
+	switch route.Kind {
+	case router.Direct:
+		if current.dialer != nil {
+			return current.dialer, nil
+		}
+		return &NetDialer{}, nil
+	case router.Upstream:
+		if dialer, ok := current.upstreams[route.Name]; ok {
+			return dialer, nil
+		}
+		return nil, fmt.Errorf("route %s: no upstream dialer", route.Name)
+	}
+	return nil, fmt.Errorf("route %s: %s routes do not connect", route.Name, route.Kind)
+}
+
+// upstreamDestination returns the destination of the connect request
+// sent to an upstream. Domain names are kept for the upstream to
+// resolve them and recorded in the request.
+func upstreamDestination(request *socks5.Request, connectRequest socks5.SockRequest) string {
+	host := string(connectRequest.GetDestinationAddress())
+	if connectRequest.GetAddressType() == socks5.AtypDomain {
+		request.DestinationFQDN = host
+	} else {
+		host = net.IP(connectRequest.GetDestinationAddress()).String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(connectRequest.GetDestinationPort())))
+}
+
+// newUpstreamDialers returns the dialers of the upstream routes by
+// route name, and the pools they use. The first hop of a chain is
+// reached with the forward dialer, every other through the previous
+// one. A pool is shared by the routes using it as their first hop.
+func newUpstreamDialers(proxyConfig *config.Config, routes *router.Router,
+	forward Dialer) (dialers map[string]Dialer, pools []*upstream.Pool, err error) {
+
+	upstreams := map[string]config.Upstream{}
+	for _, upstream := range proxyConfig.Upstreams {
+		upstreams[upstream.Name] = upstream
+	}
+	poolConfigs := map[string]config.Pool{}
+	for _, pool := range proxyConfig.Pools {
+		poolConfigs[pool.Name] = pool
+	}
+
+	defer func() {
+		if err != nil {
+			closePools(pools)
+		}
+	}()
+
+	dialers = map[string]Dialer{}
+	firstHops := map[string]*upstream.Pool{}
+	for _, route := range routes.Routes() {
+		if route.Kind != router.Upstream {
+			continue
+		}
+
+		dialer := forward
+		for hop, name := range route.Upstreams {
+			if poolConfig, ok := poolConfigs[name]; ok {
+				pool := firstHops[name]
+				if pool == nil || hop > 0 {
+					if pool, err = newPool(poolConfig, upstreams, dialer); err != nil {
+						return
+					}
+					pools = append(pools, pool)
+					if hop == 0 {
+						firstHops[name] = pool
+					}
+				}
+				dialer = pool
+				continue
+			}
+
+			upstreamConfig, ok := upstreams[name]
+			if !ok {
+				err = fmt.Errorf("route %s: unknown upstream %q", route.Name, name)
+				return
+			}
+			if dialer, err = newUpstreamDialer(upstreamConfig, dialer); err != nil {
+				return
+			}
+		}
+		dialers[route.Name] = dialer
+	}
+	return
+}
+
+// newPool creates the pool of upstreams, reached with the forward dialer
+func newPool(poolConfig config.Pool, upstreams map[string]config.Upstream,
+	forward Dialer) (*upstream.Pool, error) {
+
+	members := make([]upstream.Member, 0, len(poolConfig.Upstreams))
+	for _, name := range poolConfig.Upstreams {
+		upstreamConfig, ok := upstreams[name]
+		if !ok {
+			return nil, fmt.Errorf("pool %s: unknown upstream %q", poolConfig.Name, name)
+		}
+		dialer, err := newUpstreamDialer(upstreamConfig, forward)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, upstream.Member{Name: name, Dialer: dialer})
+	}
+
+	return upstream.NewPool(poolConfig.Name, members, upstream.Options{
+		Strategy:       poolConfig.Strategy,
+		MaxFailures:    poolConfig.MaxFailures,
+		EjectTime:      poolConfig.EjectTime.Duration,
+		AttemptTimeout: poolConfig.AttemptTimeout.Duration,
+		ProbeTarget:    poolConfig.HealthCheck.Target,
+		ProbeInterval:  poolConfig.HealthCheck.Interval.Duration,
+		ProbeTimeout:   poolConfig.HealthCheck.Timeout.Duration,
+	})
+}
+
+// closePools stops the health checks of pools no longer used
+func closePools(pools []*upstream.Pool) {
+	for _, pool := range pools {
+		pool.Close()
+	}
+}
+
+// newUpstreamDialer returns the dialer connecting through
+// the upstream, reached with the forward dialer
+func newUpstreamDialer(upstream config.Upstream, forward Dialer) (Dialer, error) {
+	switch upstream.Type {
+	case "socks5":
+		return &socks5.Client{
+			Address:  upstream.Address,
+			Username: upstream.Username,
+			Password: upstream.Password,
+			Dialer:   forward,
+		}, nil
+	case "http":
+		return &httpconnect.Client{
+			Address:  upstream.Address,
+			Username: upstream.Username,
+			Password: upstream.Password,
+			Dialer:   forward,
+		}, nil
+	}
+	return nil, fmt.Errorf("upstream %s: %s upstreams are not supported", upstream.Name, upstream.Type)
+}
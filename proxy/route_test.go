@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/auth"
+	"hiteshkotian/ssl-tunnel/config"
+	"hiteshkotian/ssl-tunnel/router"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRouting(t *testing.T) {
+	routes, err := router.New(config.Routing{
+		Routes: []config.Route{{Name: "corp", Type: "upstream", Upstreams: []string{"parent"}}},
+		Rules: []config.RouteRule{
+			{Route: "block", Domains: []string{".ads.example"}},
+			{Route: "corp", Domains: []string{".corp.example"}},
+			{Route: "corp", Destinations: []string{"198.51.100.0/24"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	direct := &pipeDialer{dialed: make(chan string, 10)}
+	parent := &pipeDialer{dialed: make(chan string, 10)}
+	server := NewWithOptions(Options{
+		Dialer:    direct,
+		Resolver:  staticResolver{net.IPv4(192, 0, 2, 5)},
+		Router:    routes,
+		Upstreams: map[string]Dialer{"corp": parent},
+	})
+
+	tests := []struct {
+		name    string
+		connect []byte
+		reply   socks5.ReplyType
+		dialer  *pipeDialer
+		dialed  string
+	}{
+		{"upstream domain", connectRequest("www.corp.example", 443), socks5.ReplySucceeded,
+			parent, "www.corp.example:443"},
+		{"upstream network", []byte{socks5.Socks5, 0x01, 0x00, 0x01, 198, 51, 100, 7, 0x00, 80},
+			socks5.ReplySucceeded, parent, "198.51.100.7:80"},
+		{"direct", connectRequest("www.example.com", 443), socks5.ReplySucceeded,
+			direct, "192.0.2.5:443"},
+		{"blocked", connectRequest("tracker.ads.example", 443), socks5.ReplyConnDenied, nil, ""},
+	}
+	for _, test := range tests {
+		if reply := connectReply(t, server, test.connect); reply != test.reply {
+			t.Errorf("%s: expected reply 0x%02x, received 0x%02x", test.name, test.reply, reply)
+		}
+		if test.dialer == nil {
+			continue
+		}
+		select {
+		case address := <-test.dialer.dialed:
+			if address != test.dialed {
+				t.Errorf("%s: expected %s to be dialed, received %s", test.name, test.dialed, address)
+			}
+		default:
+			t.Errorf("%s: %s not dialed through the route", test.name, test.dialed)
+		}
+	}
+
+	if len(direct.dialed) != 0 || len(parent.dialed) != 0 {
+		t.Errorf("Unexpected connections %d direct, %d through the upstream",
+			len(direct.dialed), len(parent.dialed))
+	}
+}
+
+// recordingDialer records the addresses dialed
+type recordingDialer struct {
+	dialed chan string
+}
+
+func (dialer *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer.dialed <- address
+	return (&NetDialer{}).DialContext(ctx, network, address)
+}
+
+// startHop starts a proxy instance serving on a loopback address
+func startHop(t *testing.T, options Options) (*Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to create listener: %v", err)
+	}
+	if options.Rules == nil {
+		options.Rules = allowLoopback(t)
+	}
+	server := NewWithOptions(options)
+	go server.Serve(listener)
+	return server, listener.Addr().String()
+}
+
+func TestUpstreamChain(t *testing.T) {
+	destination := startTCPEcho(t)
+	defer destination.Close()
+
+	first := &recordingDialer{dialed: make(chan string, 10)}
+	second := &recordingDialer{dialed: make(chan string, 10)}
+	firstHop, firstAddress := startHop(t, Options{Dialer: first})
+	defer firstHop.Stop()
+	secondHop, secondAddress := startHop(t, Options{Dialer: second,
+		Authenticator: auth.StaticCredentials{"edge": "secret"}})
+	defer secondHop.Stop()
+
+	front, err := NewWithConfig(parseConfig(t, fmt.Sprintf(`
+rules:
+  - action: allow
+    destinations: [127.0.0.1]
+upstreams:
+  - name: first
+    type: socks5
+    address: %s
+  - name: second
+    type: socks5
+    address: %s
+    username: edge
+    password: secret
+routing:
+  default: chain
+  routes:
+    - name: chain
+      type: upstream
+      upstreams: [first, second]
+`, firstAddress, secondAddress)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go front.Serve(listener)
+	defer front.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client := &socks5.Client{Address: listener.Addr().String()}
+	conn, err := client.DialContext(ctx, "tcp", destination.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect through the chain: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := echo(conn); err != nil {
+		t.Errorf("Data not relayed through the chain: %v", err)
+	}
+	if address := <-first.dialed; address != secondAddress {
+		t.Errorf("First hop dialed %s instead of the second hop", address)
+	}
+	if address := <-second.dialed; address != destination.Addr().String() {
+		t.Errorf("Second hop dialed %s instead of the destination", address)
+	}
+
+	// The reply of the last hop is passed on
+	_, err = client.DialContext(ctx, "tcp", freeAddress(t))
+	var replyError *socks5.ReplyError
+	if !errors.As(err, &replyError) || replyError.Reply != socks5.ReplyConnRefused {
+		t.Errorf("Expected the connection to be refused, received %v", err)
+	}
+}
+
+// httpStandIn is an HTTP proxy tunneling CONNECT requests
+// sent with the credentials edge:secret
+func httpStandIn() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		username, password, ok := parseProxyAuthorization(request)
+		if !ok || username != "edge" || password != "secret" {
+			http.Error(writer, "authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		destination, err := net.Dial("tcp", request.Host)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer destination.Close()
+
+		conn, buffered, err := writer.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(destination, buffered)
+		io.Copy(conn, destination)
+	}))
+}
+
+// parseProxyAuthorization decodes the Basic Proxy-Authorization header
+func parseProxyAuthorization(request *http.Request) (string, string, bool) {
+	authorization := &http.Request{Header: http.Header{
+		"Authorization": request.Header["Proxy-Authorization"]}}
+	return authorization.BasicAuth()
+}
+
+func TestHTTPUpstream(t *testing.T) {
+	destination := startTCPEcho(t)
+	defer destination.Close()
+	parent := httpStandIn()
+	defer parent.Close()
+
+	front, err := NewWithConfig(parseConfig(t, fmt.Sprintf(`
+rules:
+  - action: allow
+    destinations: [127.0.0.1]
+upstreams:
+  - name: parent
+    type: http
+    address: %[1]s
+    username: edge
+    password: secret
+  - name: intruder
+    type: http
+    address: %[1]s
+    username: edge
+    password: guess
+routing:
+  default: parent
+  routes:
+    - name: parent
+      type: upstream
+      upstreams: [parent]
+    - name: intruder
+      type: upstream
+      upstreams: [intruder]
+  rules:
+    - route: intruder
+      domains: [denied.example]
+`, parent.Listener.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go front.Serve(listener)
+	defer front.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client := &socks5.Client{Address: listener.Addr().String()}
+	conn, err := client.DialContext(ctx, "tcp", destination.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect through the HTTP upstream: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := echo(conn); err != nil {
+		t.Errorf("Data not relayed through the HTTP upstream: %v", err)
+	}
+
+	// The status of the upstream is mapped to the reply
+	_, err = client.DialContext(ctx, "tcp", "denied.example:80")
+	var replyError *socks5.ReplyError
+	if !errors.As(err, &replyError) || replyError.Reply != socks5.ReplyConnDenied {
+		t.Errorf("Expected the connection to be denied, received %v", err)
+	}
+}
+
+func TestUpstreamPoolFailover(t *testing.T) {
+	destination := startTCPEcho(t)
+	defer destination.Close()
+
+	hop, hopAddress := startHop(t, Options{})
+	defer hop.Stop()
+
+	// The first upstream of the pool is down, every
+	// connection is retried through the second one
+	front, err := NewWithConfig(parseConfig(t, fmt.Sprintf(`
+rules:
+  - action: allow
+    destinations: [127.0.0.1]
+upstreams:
+  - name: down
+    type: socks5
+    address: %s
+  - name: up
+    type: socks5
+    address: %s
+pools:
+  - name: parents
+    upstreams: [down, up]
+routing:
+  default: pooled
+  routes:
+    - name: pooled
+      type: upstream
+      upstreams: [parents]
+`, freeAddress(t), hopAddress)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go front.Serve(listener)
+	defer front.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	client := &socks5.Client{Address: listener.Addr().String()}
+	for i := 0; i < 4; i++ {
+		conn, err := client.DialContext(ctx, "tcp", destination.Addr().String())
+		if err != nil {
+			t.Fatalf("Connection not retried through the pool: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if err := echo(conn); err != nil {
+			t.Errorf("Data not relayed through the pool: %v", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestRoutingBindAndUDP(t *testing.T) {
+	allowed := startUDPEcho(t)
+	defer allowed.Close()
+	blocked := startUDPEcho(t)
+	defer blocked.Close()
+	blockedPort := strconv.Itoa(blocked.LocalAddr().(*net.UDPAddr).Port)
+
+	routes, err := router.New(config.Routing{
+		Routes: []config.Route{{Name: "corp", Type: "upstream", Upstreams: []string{"parent"}}},
+		Rules: []config.RouteRule{
+			{Route: "block", Destinations: []string{"198.51.100.0/24"}},
+			{Route: "block", Destinations: []string{"127.0.0.1"}, Ports: []string{blockedPort}},
+			{Route: "corp", Destinations: []string{"203.0.113.0/24"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// BIND requests are only served directly
+	server := NewWithOptions(Options{Router: routes})
+	if reply := connectReply(t, server, bindRequest(net.IPv4(198, 51, 100, 7), 0)); reply != socks5.ReplyConnDenied {
+		t.Errorf("Blocked BIND: expected reply 0x%02x, received 0x%02x", socks5.ReplyConnDenied, reply)
+	}
+	if reply := connectReply(t, server, bindRequest(net.IPv4(203, 0, 113, 7), 0)); reply != socks5.ReplyCmdUnsupp {
+		t.Errorf("Upstream BIND: expected reply 0x%02x, received 0x%02x", socks5.ReplyCmdUnsupp, reply)
+	}
+
+	// Datagrams to blocked destinations are dropped
+	udpServer := Server{name: "test"}
+	udpServer.router = routes
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+	request := &socks5.Request{ClientConnection: writeConn, SourceAddr: writeConn.RemoteAddr()}
+	relay := startUDPAssociation(t, &udpServer, request, readConn, make(chan bool))
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("Unable to create UDP client: %v", err)
+	}
+	defer client.Close()
+
+	buffer := make([]byte, 2048)
+	datagram, _ := socks5.GetSocketUDPSerialized(
+		socks5.NewUDPPacket(allowed.LocalAddr().(*net.UDPAddr), []byte("ping")))
+	client.Write(datagram)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(buffer); err != nil {
+		t.Fatalf("No datagram relayed back: %v", err)
+	}
+
+	datagram, _ = socks5.GetSocketUDPSerialized(
+		socks5.NewUDPPacket(blocked.LocalAddr().(*net.UDPAddr), []byte("ping")))
+	client.Write(datagram)
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := client.Read(buffer); err == nil {
+		t.Errorf("Datagram relayed to a blocked destination")
+	}
+}
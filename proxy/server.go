@@ -2,91 +2,403 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/auth"
+	"hiteshkotian/ssl-tunnel/config"
 	"hiteshkotian/ssl-tunnel/handler"
 	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/resolver"
+	"hiteshkotian/ssl-tunnel/router"
 	"hiteshkotian/ssl-tunnel/socks5"
+	"hiteshkotian/ssl-tunnel/upstream"
+	"io"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
-type ctxKey string
-
 // Server structure represents the main proxy instance
 type Server struct {
 	// Name of the server
 	name string
 	// Port the server is listening for incoming requests
 	port int
-	// Maximum number of concurrent connections
-	// that can be processed at a given time
-	maxConnectionCount int
-	// incoming network listener
+	// addresses the server listens on. When empty the
+	// server listens on all interfaces on port.
+	addresses []string
+	// incoming network listeners by configured address
+	listeners map[string]net.Listener
+	// listener given in the options, served by Start
 	listener net.Listener
+	// external are the listeners passed to Serve
+	external map[net.Listener]bool
+	// handlerOnce starts the connection handler once
+	handlerOnce sync.Once
+	// listenerMutex guards addresses, listeners and serveErr
+	listenerMutex sync.Mutex
+	// acceptors tracks the goroutines accepting connections
+	acceptors sync.WaitGroup
+	// serving is set once ServeTCP accepts connections
+	serving bool
+	// serveErr is the first error of a listener not closed by a reload
+	serveErr error
 	// connectionHandler channel. This channel is used for piping the
 	// incoming connections to the appropriate handler
 	connectHandler chan net.Conn
+	// quit is closed when the server is stopped
+	quit chan struct{}
+	// stopOnce ensures quit is closed once
+	stopOnce sync.Once
+	// sessions in progress by ID
+	sessions map[uint64]sessionEntry
+	// lastSessionID is the ID of the last session started
+	lastSessionID uint64
+	// sessionMutex guards sessions and lastSessionID
+	sessionMutex sync.Mutex
+	// customDialer and customResolver were given by the embedding
+	// program, Reload keeps them instead of building its own
+	customDialer   Dialer
+	customResolver resolver.Resolver
+	// mutex guards the settings and the custom dialer and resolver
+	mutex sync.RWMutex
+	// settings can be replaced while the server is running
+	settings
+}
+
+// settings are the values of the server that can be replaced while it
+// is running. Sessions read them when needed, so a reload only applies
+// to connections accepted afterwards.
+type settings struct {
+	// Maximum number of concurrent connections
+	// that can be processed at a given time
+	maxConnectionCount int
 	// Connection limiter. This channel ensures that at a given time the
 	// configured number of requests are being processed.
 	sem chan bool
+	// authenticator validates the username/password pairs sent by
+	// clients. When nil no authentication is required.
+	authenticator auth.Authenticator
+	// resolver used to look up domain name destinations
+	resolver resolver.Resolver
+	// dialer opens the connections to the destinations.
+	// When nil a NetDialer is used.
+	dialer Dialer
+	// bindTimeout is how long a BIND request waits for the
+	// inbound connection
+	bindTimeout time.Duration
+	// handshakeTimeout is the deadline for the SOCKS handshake
+	handshakeTimeout time.Duration
+	// connectTimeout is the timeout for connecting to the
+	// destination. Zero uses the operating system timeout.
+	connectTimeout time.Duration
+	// idleTimeout is how long a relay is kept open while no data
+	// flows in either direction. Zero does not limit it.
+	idleTimeout time.Duration
+	// maxSessionDuration is the maximum lifetime of a
+	// session. Zero does not limit it.
+	maxSessionDuration time.Duration
+	// bufferSize is the size of the relay buffers,
+	// the default of the handler when zero
+	bufferSize int
+	// rules decide which requests are allowed. When
+	// nil every request is allowed.
+	rules *acl.ACL
+	// router selects the route of CONNECT requests. When
+	// nil every destination is connected to directly.
+	router *router.Router
+	// upstreams are the dialers connecting through
+	// the upstream routes, by route name
+	upstreams map[string]Dialer
+	// pools are the upstream pools of the routes,
+	// closed once they are no longer used
+	pools []*upstream.Pool
 }
 
+// ErrServerClosed is returned by Start and ServeTCP
+// once the server is stopped
+var ErrServerClosed = errors.New("proxy: Server closed")
+
+const (
+	// defaultHandshakeTimeout is the deadline of the
+	// handshake of new client connections
+	defaultHandshakeTimeout = 10 * time.Second
+	// defaultIdleTimeout is how long a relay is kept open
+	// while no data flows in either direction
+	defaultIdleTimeout = 5 * time.Minute
+	// replyWriteTimeout is how long after the handshake
+	// deadline a reply can still be sent
+	replyWriteTimeout = 5 * time.Second
+)
+
 // New creats a new instance of the proxy
 func New(name string, port, maxConnectionCount int) *Server {
 
-	proxy := &Server{name: name, port: port,
-		maxConnectionCount: maxConnectionCount}
+	proxy := &Server{name: name, port: port}
 	proxy.connectHandler = make(chan net.Conn)
+	proxy.quit = make(chan struct{})
+	proxy.listeners = map[string]net.Listener{}
+	proxy.maxConnectionCount = maxConnectionCount
 	proxy.sem = make(chan bool, proxy.maxConnectionCount)
+	proxy.resolver = resolver.SystemResolver{}
+	proxy.handshakeTimeout = defaultHandshakeTimeout
+	proxy.idleTimeout = defaultIdleTimeout
+	// The default rules always compile
+	proxy.rules, _ = acl.New(nil)
 
 	return proxy
 }
 
+// currentSettings returns a copy of the settings in use
+func (server *Server) currentSettings() settings {
+	server.mutex.RLock()
+	defer server.mutex.RUnlock()
+	return server.settings
+}
+
+// SetAuthenticator configures the credential store that clients
+// must authenticate against (RFC 1929). Passing nil disables
+// authentication.
+func (server *Server) SetAuthenticator(authenticator auth.Authenticator) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.authenticator = authenticator
+}
+
+// SetCredentials configures the username/password pairs that clients
+// must authenticate with (RFC 1929). Passing an empty map disables
+// authentication.
+func (server *Server) SetCredentials(credentials map[string]string) {
+	if len(credentials) == 0 {
+		server.SetAuthenticator(nil)
+		return
+	}
+	server.SetAuthenticator(auth.StaticCredentials(credentials))
+}
+
+// SetResolver configures the resolver used to look up domain name
+// destinations. It is kept when a configuration is applied with
+// Reload, nil restores the resolver of the configuration.
+func (server *Server) SetResolver(nameResolver resolver.Resolver) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.resolver = nameResolver
+	server.customResolver = nameResolver
+}
+
+// SetBindTimeout configures how long a BIND request waits
+// for the inbound connection
+func (server *Server) SetBindTimeout(timeout time.Duration) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.bindTimeout = timeout
+}
+
+// SetHandshakeTimeout configures the deadline for
+// the SOCKS handshake
+func (server *Server) SetHandshakeTimeout(timeout time.Duration) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.handshakeTimeout = timeout
+}
+
+// SetConnectTimeout configures the timeout for connecting
+// to the destination
+func (server *Server) SetConnectTimeout(timeout time.Duration) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.connectTimeout = timeout
+}
+
+// SetListenAddresses configures the addresses the server
+// listens on, replacing the port given to New
+func (server *Server) SetListenAddresses(addresses []string) {
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+	server.addresses = addresses
+}
+
 // NewFromConfig reads the provided config file and
 // returns a proxy instance
 func NewFromConfig(configPath string) (*Server, error) {
-	// TODO to implement this
-	return nil, nil
+	proxyConfig, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithConfig(proxyConfig)
+}
+
+// NewWithConfig returns a proxy instance for
+// an already validated configuration
+func NewWithConfig(proxyConfig *config.Config) (*Server, error) {
+	proxy := New(proxyConfig.Name, 0, proxyConfig.MaxConnections)
+	if err := proxy.Reload(proxyConfig); err != nil {
+		return nil, err
+	}
+	return proxy, nil
 }
 
 // Start starts the server and accepts incoming client requests
 func (server *Server) Start() error {
-	var err error
 	logging.Info("Starting Proxy Server")
-	server.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", server.port))
+
+	if server.listener != nil {
+		return server.Serve(server.listener)
+	}
+
+	server.listenerMutex.Lock()
+	addresses := server.addresses
+	if len(addresses) == 0 {
+		addresses = []string{fmt.Sprintf(":%d", server.port)}
+	}
+	_, err := server.openListeners(addresses)
+	server.listenerMutex.Unlock()
 	if err != nil {
-		logging.Error("Unable to start tcp server: ", err)
 		return err
 	}
 
 	return server.ServeTCP()
 }
 
+// openListeners listens on the addresses that do not have a listener
+// yet. When one of them fails the listeners opened are closed again.
+// Must be called with listenerMutex held.
+func (server *Server) openListeners(addresses []string) (opened []string, err error) {
+	if server.listeners == nil {
+		server.listeners = map[string]net.Listener{}
+	}
+
+	for _, address := range addresses {
+		if _, ok := server.listeners[address]; ok {
+			continue
+		}
+
+		var listener net.Listener
+		listener, err = net.Listen("tcp", address)
+		if err != nil {
+			logging.Error("Unable to start tcp server on %s", err, address)
+			for _, address := range opened {
+				server.listeners[address].Close()
+				delete(server.listeners, address)
+			}
+			return nil, err
+		}
+
+		logging.Info("Listening on %s", listener.Addr())
+		server.listeners[address] = listener
+		opened = append(opened, address)
+		if server.serving {
+			server.startAcceptor(address, listener)
+		}
+	}
+	return opened, nil
+}
+
+// closeListeners stops listening on the addresses not in the list.
+// Connections already accepted are not affected. Must be called
+// with listenerMutex held.
+func (server *Server) closeListeners(addresses []string) {
+	keep := map[string]bool{}
+	for _, address := range addresses {
+		keep[address] = true
+	}
+
+	for address, listener := range server.listeners {
+		if !keep[address] {
+			logging.Info("Stopped listening on %s", listener.Addr())
+			delete(server.listeners, address)
+			listener.Close()
+		}
+	}
+}
+
 // ServeTCP will start  accepting TCP connections and will
-// respond to client's connection.
+// respond to client's connection. It returns once every
+// listener is closed.
 func (server *Server) ServeTCP() error {
 
 	// Start the connection handler
-	go server.startHandler()
+	server.handlerOnce.Do(func() {
+		go server.startHandler()
+	})
+
+	server.listenerMutex.Lock()
+	server.serving = true
+	for address, listener := range server.listeners {
+		server.startAcceptor(address, listener)
+	}
+	server.listenerMutex.Unlock()
 
+	server.acceptors.Wait()
+
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+	return server.serveErr
+}
+
+// startAcceptor accepts the connections of a listener in a new
+// goroutine. Must be called with listenerMutex held.
+func (server *Server) startAcceptor(address string, listener net.Listener) {
+	server.acceptors.Add(1)
+	go func() {
+		defer server.acceptors.Done()
+		err := server.acceptConnections(listener)
+		if server.stopped() {
+			err = ErrServerClosed
+		}
+
+		server.listenerMutex.Lock()
+		defer server.listenerMutex.Unlock()
+		// Listeners closed by a reload are removed beforehand
+		if server.listeners[address] == listener && err != ErrServerClosed {
+			logging.Error("Erorr while reading incoming request", err)
+		}
+		if server.serveErr == nil && server.listeners[address] == listener {
+			server.serveErr = err
+		}
+	}()
+}
+
+// acceptConnections accepts the connections of a single listener
+// and passes them to the connection handler
+func (server *Server) acceptConnections(listener net.Listener) error {
 	for {
-		conn, err := server.listener.Accept()
+		conn, err := listener.Accept()
 
 		if err != nil {
-			logging.Error("Erorr while reading incoming request", err)
 			return err
 		}
 
 		logging.Debug("received connection request from %s",
 			conn.RemoteAddr().String())
 
-		// Set all the required timeouts
-		conn.SetReadDeadline(
-			time.Now().Add(10 * time.Second))
-		conn.SetWriteDeadline(
-			time.Now().Add(30 * time.Second))
+		select {
+		case server.connectHandler <- conn:
+		case <-server.quit:
+			conn.Close()
+			return ErrServerClosed
+		}
+	}
+}
 
-		server.connectHandler <- conn
+// handshakeDuration returns the time allowed for the handshake
+func (server *Server) handshakeDuration() time.Duration {
+	timeout := server.currentSettings().handshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	return timeout
+}
+
+// stopped returns true once the server is stopped
+func (server *Server) stopped() bool {
+	select {
+	case <-server.quit:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -96,44 +408,140 @@ func (server *Server) startHandler() {
 
 	for {
 		select {
-		case conn, more := <-server.connectHandler:
-			if !more {
+		case <-server.quit:
+			return
+		case conn := <-server.connectHandler:
+			ctx, sem, err := server.beginSession(context.Background(), conn)
+			if err != nil {
+				conn.Close()
 				return
 			}
-			server.sem <- true
-
-			ctx := context.Background()
-			go server.handleRequest2(ctx, conn, server.sem)
+			go server.handleRequest2(ctx, conn, sem)
 		}
 	}
 }
 
+// beginSession acquires a connection slot and registers the session
+// of the connection. It returns the context of the session and the
+// limiter the slot must be released to.
+func (server *Server) beginSession(ctx context.Context, conn net.Conn) (context.Context, chan bool, error) {
+	// Sessions release the limiter they acquired, a
+	// reload may replace it in the meantime
+	sem := server.currentSettings().sem
+	select {
+	case sem <- true:
+	case <-server.quit:
+		return nil, nil, ErrServerClosed
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	session := &socks5.Session{ClientAddr: conn.RemoteAddr(), Started: time.Now()}
+	session.HandshakeDeadline = session.Started.Add(server.handshakeDuration())
+
+	var sessionCtx context.Context
+	var cancel context.CancelFunc
+	if maxDuration := server.currentSettings().maxSessionDuration; maxDuration > 0 {
+		session.Expires = session.Started.Add(maxDuration)
+		sessionCtx, cancel = context.WithDeadline(ctx, session.Expires)
+	} else {
+		sessionCtx, cancel = context.WithCancel(ctx)
+	}
+	if !server.registerSession(session, cancel) {
+		cancel()
+		<-sem
+		return nil, nil, ErrServerClosed
+	}
+	return socks5.NewSessionContext(sessionCtx, session), sem, nil
+}
+
 func (server *Server) handleRequest2(ctx context.Context,
 	conn net.Conn, sem chan bool) {
 	logging.Debug("Processing incoming client request")
 
 	request := socks5.NewRequest(conn)
+	request.SetContext(ctx)
+
+	// The handshake must complete by the deadline of the session.
+	// Writes are given longer for the reply of a request failing
+	// at the deadline to reach the client.
+	if session, ok := socks5.SessionFromContext(ctx); ok {
+		conn.SetReadDeadline(session.HandshakeDeadline)
+		conn.SetWriteDeadline(session.HandshakeDeadline.Add(replyWriteTimeout))
+	}
+
+	// Cancelling the session expires the deadlines of the client
+	// connection, interrupting the stage in progress. The stages
+	// clearing the deadlines watch the context themselves.
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-finished:
+		}
+	}()
 
 	processRequest := true
 	for processRequest {
 		// Step 1 : Handle Initiial
 		switch request.State {
 		case socks5.RequestStateInit:
-			server.handleInitialLocal(request)
+			server.handleInitialLocal(ctx, request)
+		case socks5.RequestStateAuthenticating:
+			server.handleAuthLocal(ctx, request)
 		case socks5.RequestStateConnecting:
-			server.handleConnectLocal(request)
+			server.handleConnectLocal(ctx, request)
 		case socks5.RequestStateProxying:
-			server.startProxying(request)
+			server.startProxying(ctx, request)
+		case socks5.RequestStateRelayingUDP:
+			server.startUDPRelay(ctx, request)
 		case socks5.RequestStateTerminating:
+			close(finished)
 			request.Close()
+			if session, ok := socks5.SessionFromContext(ctx); ok {
+				server.endSession(session.ID)
+			}
 			<-sem
 			processRequest = false
 		}
 	}
 }
 
-func (server *Server) startProxying(request *socks5.Request) {
-	outboundHandler := handler.OutboundHandler{}
+// handshakeContext returns a context expiring at the
+// handshake deadline of the session
+func handshakeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	session, ok := socks5.SessionFromContext(ctx)
+	if !ok || session.HandshakeDeadline.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, session.HandshakeDeadline)
+}
+
+func (server *Server) startProxying(ctx context.Context, request *socks5.Request) {
+	// Forward the data the client pipelined after the request
+	reader := request.Reader()
+	if buffered := reader.Buffered(); buffered > 0 {
+		data, _ := reader.Peek(buffered)
+		_, err := request.OutboundConnection.Write(data)
+		reader.Discard(buffered)
+		if err != nil {
+			logging.Error("Error forwarding pipelined data", err)
+			request.State = socks5.RequestStateTerminating
+			return
+		}
+	}
+
+	// The handshake is complete, the relay is
+	// only limited by the idle timeout
+	request.ClientConnection.SetDeadline(time.Time{})
+
+	// The handler gets the session context from the request
+	current := server.currentSettings()
+	outboundHandler := handler.OutboundHandler{
+		IdleTimeout: current.idleTimeout,
+		BufferSize:  current.bufferSize,
+	}
 	err := outboundHandler.HandleRequest(request)
 	if err != nil {
 		request.State = socks5.RequestStateTerminating
@@ -143,7 +551,7 @@ func (server *Server) startProxying(request *socks5.Request) {
 	request.State = socks5.RequestStateTerminating
 }
 
-func (server *Server) handleInitialLocal(request *socks5.Request) {
+func (server *Server) handleInitialLocal(ctx context.Context, request *socks5.Request) {
 	// Initial request structre is :
 	// init_request_pkt {
 	// 		version (1) = 0x05
@@ -155,39 +563,89 @@ func (server *Server) handleInitialLocal(request *socks5.Request) {
 	// 		version (1) = 0x05
 	//		method (1)
 	// }
-	// TODO Check how to handle authentication request
 	logging.Debug("Processing init request")
 	clientConn := request.ClientConnection
 
-	requestStream := make([]byte, 260)
-
-	n, e := clientConn.Read(requestStream)
-	if e != nil {
-		logging.Error("Error reading response", e)
-	} else if n < 2 {
-		logging.Error("Insufficient bytes read", nil)
-	}
-
-	logging.DumpHex(requestStream[:n], "INIT Method")
-
-	_, err := socks5.GetSocketInitialSerialized(requestStream[:n])
+	initial, err := socks5.ReadMethodSelection(request.Reader())
 
 	if err != nil {
+		logging.Error("Invalid initial request from %s", err, request.SourceAddr)
 		response, _ := socks5.GetSocketInitialResponseSerialized(0xFF)
 		clientConn.Write(response)
 		request.State = socks5.RequestStateTerminating
 		return
 	}
 
-	// TODO Add support for authentication
+	// Select the method based on whether the server requires
+	// authentication and what the client offered
+	selected := socks5.MethodNoAuth
+	nextState := socks5.RequestStateConnecting
+	if server.currentSettings().authenticator != nil {
+		selected = socks5.MethodUserAuth
+		nextState = socks5.RequestStateAuthenticating
+	}
+
+	if !initial.SupportsMethod(selected) {
+		logging.Debug("Client %s did not offer an acceptable method",
+			request.SourceAddr)
+		response, _ := socks5.GetSocketInitialResponseSerialized(
+			uint8(socks5.MethodNoAcceptable))
+		clientConn.Write(response)
+		request.State = socks5.RequestStateTerminating
+		return
+	}
 
-	response, _ := socks5.GetSocketInitialResponseSerialized(0x00)
+	response, _ := socks5.GetSocketInitialResponseSerialized(uint8(selected))
 	logging.DumpHex(response, "Sending response")
 	clientConn.Write(response)
 	// Change the state
+	request.State = nextState
+}
+
+func (server *Server) handleAuthLocal(ctx context.Context, request *socks5.Request) {
+	// Username/password request structure (RFC 1929) is :
+	// auth_request_pkt {
+	//		version (1) = 0x01
+	//		ulen (1)
+	//		uname (1...255)
+	//		plen (1)
+	//		passwd (1...255)
+	// }
+	// Response structure is :
+	// auth_response_pkt {
+	//		version (1) = 0x01
+	//		status (1)
+	// }
+	logging.Debug("Processing auth request")
+	clientConn := request.ClientConnection
+
+	// A reload may have disabled authentication since the
+	// method was selected, the client is rejected in that case
+	authenticator := server.currentSettings().authenticator
+	authRequest, err := socks5.ReadUserAuth(request.Reader())
+	if err != nil || authenticator == nil || !authenticator.Authenticate(
+		authRequest.Username, authRequest.Password) {
+		logging.Info("Authentication failed for client %s", request.SourceAddr)
+		response, _ := socks5.GetSocketUserAuthResponseSerialized(
+			socks5.UserAuthResponse{Status: socks5.UserAuthFailure})
+		clientConn.Write(response)
+		request.State = socks5.RequestStateTerminating
+		return
+	}
+
+	response, _ := socks5.GetSocketUserAuthResponseSerialized(
+		socks5.UserAuthResponse{Status: socks5.UserAuthSuccess})
+	clientConn.Write(response)
+
+	logging.Debug("Client %s authenticated as %s",
+		request.SourceAddr, authRequest.Username)
+	request.Username = authRequest.Username
+	if session, ok := socks5.SessionFromContext(ctx); ok {
+		session.SetUser(authRequest.Username)
+	}
 	request.State = socks5.RequestStateConnecting
 }
-func (server *Server) handleConnectLocal(request *socks5.Request) {
+func (server *Server) handleConnectLocal(ctx context.Context, request *socks5.Request) {
 	// Connect request format
 	// connect_req_pkt {
 	//		version (1) = 0x05
@@ -208,70 +666,205 @@ func (server *Server) handleConnectLocal(request *socks5.Request) {
 	// }
 
 	clientConn := request.ClientConnection
-	requestStream := make([]byte, 512)
 
-	n, e := clientConn.Read(requestStream)
-	if e != nil || n <= 0 {
-		// Send error
-		response, _ := socks5.GetSocketInitialResponseSerialized(0xFF)
-		clientConn.Write(response)
+	connectRequest, err := socks5.ReadRequest(request.Reader())
+
+	if err == io.EOF {
+		logging.Debug("Client %s closed the connection", request.SourceAddr)
+		request.State = socks5.RequestStateTerminating
+		return
+	} else if err != nil {
+		logging.Error("Invalid request from %s", err, request.SourceAddr)
+		status := socks5.ReplyGeneralFail
+		if errors.Is(err, socks5.ErrAddressTypeUnsupported) {
+			status = socks5.ReplyAddrTypUnsupp
+		}
+		server.sendReply(clientConn, socks5.NewSocksReply(status, nil))
 		request.State = socks5.RequestStateTerminating
 		return
 	}
 
-	connectRequest, err := socks5.GetSocketRequestDeserialized(requestStream[:n])
+	// The access rules are consulted once the request is parsed,
+	// the addresses of domain destinations once resolved
+	access := accessRequest(request, connectRequest)
+	if access.Command != "" && !server.accessAllowed(access) {
+		server.sendReply(clientConn, socks5.NewSocksReply(socks5.ReplyConnDenied, nil))
+		request.State = socks5.RequestStateTerminating
+		return
+	}
 
-	if err != nil {
-		response, _ := socks5.GetSocketInitialResponseSerialized(0xFF)
-		clientConn.Write(response)
+	switch connectRequest.GetCommand() {
+	case socks5.CmdConnect:
+		server.handleTCPConnectLocal(ctx, request, connectRequest)
+	case socks5.CmdBind:
+		server.handleBindLocal(ctx, request, connectRequest)
+	case socks5.CmdUDPAssc:
+		server.handleUDPAssociateLocal(ctx, request, connectRequest)
+	default:
+		logging.Info("Unsupported command 0x%02x from %s",
+			connectRequest.GetCommand(), request.SourceAddr)
+		server.sendReply(clientConn, socks5.NewSocksReply(socks5.ReplyCmdUnsupp, nil))
 		request.State = socks5.RequestStateTerminating
+	}
+}
+
+// handleTCPConnectLocal processes a CONNECT request by
+// opening the outbound connection to the destination
+func (server *Server) handleTCPConnectLocal(ctx context.Context, request *socks5.Request,
+	connectRequest socks5.SockRequest) {
+
+	clientConn := request.ClientConnection
+
+	// The destination must be connected to by the handshake deadline
+	ctx, cancel := handshakeContext(ctx)
+	defer cancel()
+
+	access := accessRequest(request, connectRequest)
+	route := server.selectRoute(access)
+	if route.Kind == router.Block {
+		request.State = socks5.RequestStateTerminating
+		server.sendReply(clientConn, socks5.NewSocksReply(socks5.ReplyConnDenied, nil))
 		return
 	}
 
-	reply := socks5.CreateSocksReply(connectRequest)
+	var destinations []string
+	if route.Kind == router.Upstream {
+		// Domain names are resolved by the upstream
+		destinations = []string{upstreamDestination(request, connectRequest)}
+	} else {
+		// Resolve the destination
+		addresses, err := server.resolveDestination(ctx, request, connectRequest)
+		if err != nil {
+			logging.Error("Error resolving %s", err, request.DestinationFQDN)
+			request.State = socks5.RequestStateTerminating
+			server.sendReply(clientConn, socks5.NewSocksReply(replyFromError(err), nil))
+			return
+		}
+
+		// The addresses of a domain are checked once resolved, as
+		// the name may point to a destination denied by address
+		if connectRequest.GetAddressType() == socks5.AtypDomain {
+			addresses = server.allowedAddresses(access, addresses)
+			if len(addresses) == 0 {
+				request.State = socks5.RequestStateTerminating
+				server.sendReply(clientConn, socks5.NewSocksReply(socks5.ReplyConnDenied, nil))
+				return
+			}
+		}
+
+		port := strconv.Itoa(int(connectRequest.GetDestinationPort()))
+		for _, ip := range addresses {
+			destinations = append(destinations, net.JoinHostPort(ip.String(), port))
+		}
+	}
 
 	// Create connection
-	request.OutboundConnection, err = server.createOuboundConnection(connectRequest)
+	var err error
+	request.OutboundConnection, err = server.createOuboundConnection(ctx, request,
+		route, destinations)
 	if err != nil {
 		logging.Error("Error connecting to remote host", err)
-		reply.SetReply(socks5.ReplyNetUnreachable)
 		request.State = socks5.RequestStateTerminating
-		// return
-	} else {
-		request.State = socks5.RequestStateProxying
+		server.sendReply(clientConn, socks5.NewSocksReply(replyFromError(err), nil))
+		return
 	}
 
-	replyStream, _ := socks5.GetSocketResponseSerialized(reply)
-	clientConn.Write(replyStream)
-	return
+	// The bind address is the local address of the outbound socket
+	request.State = socks5.RequestStateProxying
+	server.sendReply(clientConn, socks5.NewSocksReply(socks5.ReplySucceeded,
+		request.OutboundConnection.LocalAddr()))
 }
 
-func (server *Server) createOuboundConnection(
-	connectRequest socks5.SockRequest) (outConnection net.Conn, err error) {
-
-	var address string
-	var network string
+// resolveDestination returns the IP addresses of the destination
+// in the connect request. Domain names are resolved server side
+// and recorded in the request.
+func (server *Server) resolveDestination(ctx context.Context, request *socks5.Request,
+	connectRequest socks5.SockRequest) ([]net.IP, error) {
 
 	switch connectRequest.GetAddressType() {
-	case socks5.AtypIPV4:
-		network = "tcp"
-		ip := net.IP(connectRequest.GetDestinationAddress())
-		address = fmt.Sprintf("%s:%d", ip.String(), connectRequest.GetDestinationPort())
-	case socks5.AtypIPV6:
-		network = "tcp6"
-		ip := net.IP(connectRequest.GetDestinationAddress())
-		address = fmt.Sprintf("[%s]:%d", ip.String(), connectRequest.GetDestinationPort())
-		// TODO Lookup Domain
-	}
-
-	outConnection, err = net.Dial(network, address)
+	case socks5.AtypIPV4, socks5.AtypIPV6:
+		return []net.IP{net.IP(connectRequest.GetDestinationAddress())}, nil
+	case socks5.AtypDomain:
+		request.DestinationFQDN = string(connectRequest.GetDestinationAddress())
+		ips, err := server.nameResolver().LookupIP(ctx, request.DestinationFQDN)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no addresses found",
+				Name: request.DestinationFQDN, IsNotFound: true}
+		}
+		return ips, nil
+	}
+
+	return nil, fmt.Errorf("unsupported address type 0x%02x",
+		connectRequest.GetAddressType())
+}
+
+// nameResolver returns the configured resolver or
+// the system resolver if none was set
+func (server *Server) nameResolver() resolver.Resolver {
+	nameResolver := server.currentSettings().resolver
+	if nameResolver == nil {
+		return resolver.SystemResolver{}
+	}
+	return nameResolver
+}
+
+// createOuboundConnection dials the destinations through the route in
+// order until one of them succeeds. The address connected to is
+// recorded in the request.
+func (server *Server) createOuboundConnection(ctx context.Context, request *socks5.Request,
+	route *router.Route, destinations []string) (outConnection net.Conn, err error) {
+
+	current := server.currentSettings()
+	dialer, err := current.routeDialer(route)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, destination := range destinations {
+		request.DestinationAddr = nil
+		if host, port, splitErr := net.SplitHostPort(destination); splitErr == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				portNumber, _ := strconv.Atoi(port)
+				request.DestinationAddr = &net.TCPAddr{IP: ip, Port: portNumber}
+			}
+		}
+
+		// The connect timeout applies to every address tried
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if current.connectTimeout > 0 {
+			dialCtx, cancel = context.WithTimeout(ctx, current.connectTimeout)
+		}
+		outConnection, err = dialer.DialContext(dialCtx, "tcp", destination)
+		cancel()
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		logging.Debug("Unable to connect to %s via %s: %s", destination, route.Name, err)
+	}
 	return
 }
 
-// Stop stops the server
+// Stop stops accepting connections. The sessions in
+// progress are not affected, see Shutdown.
 func (server *Server) Stop() {
-	// Closing Channel
+	// Stop accepting connections
 	logging.Info("Stopping Proxy Server")
-	close(server.connectHandler)
-	server.listener.Close()
+	server.stopOnce.Do(func() {
+		close(server.quit)
+	})
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+	for _, listener := range server.listeners {
+		listener.Close()
+	}
+	for listener := range server.external {
+		listener.Close()
+	}
+
+	// Only the health checks stop, sessions
+	// still connect through the pools
+	closePools(server.currentSettings().pools)
 }
@@ -1,10 +1,17 @@
 package proxy
 
 import (
+	"context"
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/config"
 	"hiteshkotian/ssl-tunnel/logging"
 	"hiteshkotian/ssl-tunnel/socks5"
+	"io"
+	"io/ioutil"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Test if socks5 init method works as expected
@@ -14,8 +21,8 @@ func TestInitWithNoMethods(t *testing.T) {
 	expectedVersion := uint8(0x05)
 	// Version
 	clientRequest = append(clientRequest, expectedVersion)
-	// Set Methods
-	clientRequest = append(clientRequest, 0x00)
+	// Set Methods: a single "no authentication" method
+	clientRequest = append(clientRequest, 0x01)
 	clientRequest = append(clientRequest, 0x00)
 
 	server := Server{name: "test"}
@@ -24,7 +31,7 @@ func TestInitWithNoMethods(t *testing.T) {
 
 	go func() {
 		request := &socks5.Request{ClientConnection: writeConn}
-		server.handleInitialLocal(request)
+		server.handleInitialLocal(context.Background(), request)
 		writeConn.Close()
 	}()
 
@@ -67,7 +74,7 @@ func TestInitWithInvalidVersion(t *testing.T) {
 
 	go func() {
 		request := &socks5.Request{ClientConnection: writeConn}
-		server.handleInitialLocal(request)
+		server.handleInitialLocal(context.Background(), request)
 		writeConn.Close()
 	}()
 
@@ -109,7 +116,7 @@ func TestInitWithIncompletePacket(t *testing.T) {
 
 	go func() {
 		request := &socks5.Request{ClientConnection: writeConn}
-		server.handleInitialLocal(request)
+		server.handleInitialLocal(context.Background(), request)
 		writeConn.Close()
 	}()
 
@@ -133,3 +140,519 @@ func TestInitWithIncompletePacket(t *testing.T) {
 		t.Errorf("Invalid command selected. Expected 0xff, received : 0x%02x", response[1])
 	}
 }
+
+func TestInitWithUserAuth(t *testing.T) {
+	server := Server{name: "test"}
+	server.SetCredentials(map[string]string{"user": "secret"})
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+
+	request := &socks5.Request{ClientConnection: writeConn}
+	done := make(chan bool)
+	go func() {
+		server.handleInitialLocal(context.Background(), request)
+		if request.State == socks5.RequestStateAuthenticating {
+			server.handleAuthLocal(context.Background(), request)
+		}
+		writeConn.Close()
+		close(done)
+	}()
+
+	readConn.Write([]byte{socks5.Socks5, 0x02, 0x00, 0x02})
+
+	response := make([]byte, 512)
+	n, e := readConn.Read(response)
+	if e != nil || n != 2 {
+		t.Fatalf("Error reading method response: %v", e)
+	}
+
+	if response[1] != 0x02 {
+		t.Fatalf("Invalid method selected. Expected 0x02, received : 0x%02x", response[1])
+	}
+
+	readConn.Write([]byte{0x01, 0x04, 'u', 's', 'e', 'r', 0x06, 's', 'e', 'c', 'r', 'e', 't'})
+
+	n, e = readConn.Read(response)
+	if e != nil || n != 2 {
+		t.Fatalf("Error reading auth response: %v", e)
+	}
+
+	if response[0] != 0x01 || response[1] != 0x00 {
+		t.Errorf("Authentication failed. Received : 0x%02x 0x%02x", response[0], response[1])
+	}
+
+	<-done
+
+	if request.Username != "user" {
+		t.Errorf("Authenticated user not set on request. Received : %s", request.Username)
+	}
+}
+
+func TestInitWithInvalidUserAuth(t *testing.T) {
+	server := Server{name: "test"}
+	server.SetCredentials(map[string]string{"user": "secret"})
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+
+	request := &socks5.Request{ClientConnection: writeConn}
+	done := make(chan bool)
+	go func() {
+		server.handleInitialLocal(context.Background(), request)
+		if request.State == socks5.RequestStateAuthenticating {
+			server.handleAuthLocal(context.Background(), request)
+		}
+		writeConn.Close()
+		close(done)
+	}()
+
+	readConn.Write([]byte{socks5.Socks5, 0x01, 0x02})
+
+	response := make([]byte, 512)
+	readConn.Read(response)
+
+	readConn.Write([]byte{0x01, 0x04, 'u', 's', 'e', 'r', 0x05, 'w', 'r', 'o', 'n', 'g'})
+
+	n, e := readConn.Read(response)
+	if e != nil || n != 2 {
+		t.Fatalf("Error reading auth response: %v", e)
+	}
+
+	if response[1] != 0x01 {
+		t.Errorf("Invalid credentials accepted. Received : 0x%02x", response[1])
+	}
+
+	<-done
+
+	if request.State != socks5.RequestStateTerminating {
+		t.Errorf("Request not terminated after failed authentication")
+	}
+}
+
+func TestInitWithoutUserAuthOffered(t *testing.T) {
+	server := Server{name: "test"}
+	server.SetCredentials(map[string]string{"user": "secret"})
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+
+	go func() {
+		request := &socks5.Request{ClientConnection: writeConn}
+		server.handleInitialLocal(context.Background(), request)
+		writeConn.Close()
+	}()
+
+	readConn.Write([]byte{socks5.Socks5, 0x01, 0x00})
+
+	response := make([]byte, 512)
+	n, e := readConn.Read(response)
+	if e != nil || n != 2 {
+		t.Fatalf("Error reading method response: %v", e)
+	}
+
+	if response[1] != 0xff {
+		t.Errorf("Invalid method selected. Expected 0xff, received : 0x%02x", response[1])
+	}
+}
+
+// connectRequest builds a CONNECT request for the domain and port
+func connectRequest(domain string, port int) []byte {
+	msg := []byte{socks5.Socks5, 0x01, 0x00, 0x03, byte(len(domain))}
+	msg = append(msg, domain...)
+	return append(msg, byte(port>>8), byte(port))
+}
+
+func TestConnectWithDomain(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to create listener: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	server := Server{name: "test"}
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+
+	request := &socks5.Request{ClientConnection: writeConn}
+	done := make(chan bool)
+	go func() {
+		server.handleConnectLocal(context.Background(), request)
+		close(done)
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	readConn.Write(connectRequest("localhost", port))
+
+	reply := readReply(t, readConn)
+	<-done
+
+	if reply.GetReply() != socks5.ReplySucceeded {
+		t.Fatalf("Connect failed. Expected 0x00, received : 0x%02x", reply.GetReply())
+	}
+
+	// The bind address is the local address of the outbound connection
+	local := request.OutboundConnection.LocalAddr().(*net.TCPAddr)
+	if !net.IP(reply.GetBindAddress()).Equal(local.IP) ||
+		int(reply.GetBindPort()) != local.Port {
+		t.Errorf("Bind address %v:%d does not match outbound socket %v",
+			net.IP(reply.GetBindAddress()), reply.GetBindPort(), local)
+	}
+
+	if request.DestinationFQDN != "localhost" {
+		t.Errorf("Destination FQDN not recorded. Received : %s", request.DestinationFQDN)
+	}
+
+	addr, ok := request.DestinationAddr.(*net.TCPAddr)
+	if !ok || !addr.IP.IsLoopback() || addr.Port != port {
+		t.Errorf("Destination address not recorded. Received : %v", request.DestinationAddr)
+	}
+
+	if request.OutboundConnection != nil {
+		request.OutboundConnection.Close()
+	}
+}
+
+// notFoundResolver fails every lookup with a not found error
+type notFoundResolver struct{}
+
+func (notFoundResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestConnectWithUnresolvableDomain(t *testing.T) {
+	server := Server{name: "test"}
+	server.SetResolver(notFoundResolver{})
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+
+	request := &socks5.Request{ClientConnection: writeConn}
+	go server.handleConnectLocal(context.Background(), request)
+
+	readConn.Write(connectRequest("unresolvable.invalid", 80))
+
+	response := make([]byte, 512)
+	n, e := readConn.Read(response)
+	if e != nil || n < 2 {
+		t.Fatalf("Error reading connect response: %v", e)
+	}
+
+	if response[1] != 0x04 {
+		t.Errorf("Expected host unreachable 0x04, received : 0x%02x", response[1])
+	}
+}
+
+// startTCPEcho starts a TCP server echoing everything it receives
+func startTCPEcho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to create listener: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestPipelinedHandshake(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	port := echo.Addr().(*net.TCPAddr).Port
+
+	server := Server{name: "test"}
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+
+	sem := make(chan bool, 1)
+	sem <- true
+	go server.handleRequest2(context.Background(), writeConn, sem)
+
+	// Greeting, request and payload in a single write
+	stream := []byte{socks5.Socks5, 0x01, 0x00}
+	stream = append(stream, socks5.Socks5, 0x01, 0x00, 0x01, 127, 0, 0, 1,
+		byte(port>>8), byte(port))
+	stream = append(stream, "hello"...)
+	readConn.Write(stream)
+
+	response := make([]byte, 2+10+5)
+	readConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(readConn, response); err != nil {
+		t.Fatalf("Error reading responses: %v", err)
+	}
+
+	if response[1] != 0x00 || response[3] != 0x00 {
+		t.Errorf("Handshake failed: % x", response[:12])
+	}
+
+	if string(response[12:]) != "hello" {
+		t.Errorf("Pipelined payload not forwarded. Received : %q", response[12:])
+	}
+}
+
+func TestSplitHandshake(t *testing.T) {
+	server := Server{name: "test"}
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+
+	go func() {
+		request := &socks5.Request{ClientConnection: writeConn}
+		server.handleInitialLocal(context.Background(), request)
+		writeConn.Close()
+	}()
+
+	// Greeting split across several writes
+	for _, segment := range [][]byte{{socks5.Socks5}, {0x02}, {0x02}, {0x00}} {
+		readConn.Write(segment)
+	}
+
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(readConn, response); err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+
+	if response[1] != 0x00 {
+		t.Errorf("Invalid method selected. Expected 0x00, received : 0x%02x", response[1])
+	}
+}
+
+func TestNewWithConfig(t *testing.T) {
+	document := `name: edge
+listeners:
+  - address: 127.0.0.1:1080
+  - address: 127.0.0.1:1081
+max_connections: 5
+timeouts:
+  handshake: 3s
+  connect: 2s
+authentication:
+  users:
+    alice: secret
+dns:
+  hosts:
+    intranet.example: [10.0.0.5]
+`
+	proxyConfig, err := config.Parse("proxy.yaml", []byte(document))
+	if err != nil {
+		t.Fatalf("Unexpected configuration error %v", err)
+	}
+
+	server, err := NewWithConfig(proxyConfig)
+	if err != nil {
+		t.Fatalf("Unable to create server %v", err)
+	}
+	if server.name != "edge" || cap(server.sem) != 5 || len(server.addresses) != 2 {
+		t.Errorf("Unexpected server %+v", server)
+	}
+	if server.handshakeTimeout != 3*time.Second || server.connectTimeout != 2*time.Second {
+		t.Errorf("Unexpected timeouts %v, %v", server.handshakeTimeout, server.connectTimeout)
+	}
+	if server.authenticator == nil || !server.authenticator.Authenticate("alice", "secret") {
+		t.Errorf("Credentials not configured")
+	}
+	ips, err := server.nameResolver().LookupIP(context.Background(), "intranet.example")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 5)) {
+		t.Errorf("Resolver not configured: %v, %v", ips, err)
+	}
+
+	server, err = NewWithConfig(config.Default())
+	if err != nil || server.name != "server1" || server.authenticator != nil {
+		t.Errorf("Unexpected default server %+v, %v", server, err)
+	}
+
+	proxyConfig.Rules = []config.Rule{{Name: "deny-all", Action: "deny"}}
+	server, err = NewWithConfig(proxyConfig)
+	if err != nil {
+		t.Fatalf("Unable to create server with rules %v", err)
+	}
+	if allowed, rule := server.rules.Allowed(&acl.Request{Command: acl.CommandConnect}); allowed || rule.Name != "deny-all" {
+		t.Errorf("Rules not configured")
+	}
+
+	proxyConfig.Rules = []config.Rule{{Action: "drop"}}
+	if _, err := NewWithConfig(proxyConfig); err == nil {
+		t.Errorf("Invalid rules not reported")
+	}
+
+	if _, err := NewFromConfig("missing.yaml"); err == nil {
+		t.Errorf("Missing configuration not reported")
+	}
+}
+
+// echoDialer connects to an in-memory destination echoing
+// everything until the proxy closes the connection
+type echoDialer struct{}
+
+func (echoDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	proxySide, destination := net.Pipe()
+	go func() {
+		io.Copy(destination, destination)
+		destination.Close()
+	}()
+	return proxySide, nil
+}
+
+// connectEcho opens a session relaying to an echoDialer
+func connectEcho(t *testing.T, server *Server) net.Conn {
+	client, serverSide := net.Pipe()
+	go server.ServeConn(context.Background(), serverSide)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte{socks5.Socks5, 0x01, 0x00})
+	io.ReadFull(client, make([]byte, 2))
+	client.Write([]byte{socks5.Socks5, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x01, 0xbb})
+	if reply := readReply(t, client); reply.GetReply() != socks5.ReplySucceeded {
+		t.Fatalf("Connect failed with 0x%02x", reply.GetReply())
+	}
+	return client
+}
+
+// echo sends a message through the relay and reads it back
+func echo(client net.Conn) error {
+	if _, err := client.Write([]byte("ping")); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(client, make([]byte, 4))
+	return err
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	server := NewWithOptions(Options{
+		Dialer:           echoDialer{},
+		HandshakeTimeout: 100 * time.Millisecond,
+		IdleTimeout:      300 * time.Millisecond,
+	})
+	client := connectEcho(t, server)
+	defer client.Close()
+
+	// Traffic keeps the relay open past the handshake
+	// deadline and the idle timeout
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if err := echo(client); err != nil {
+			t.Fatalf("Relay closed while active: %v", err)
+		}
+	}
+
+	started := time.Now()
+	if _, err := io.Copy(ioutil.Discard, client); err != nil {
+		t.Fatalf("Relay not closed once idle: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Errorf("Relay closed after %s of inactivity", elapsed)
+	}
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	server := NewWithOptions(Options{
+		Dialer:             echoDialer{},
+		MaxSessionDuration: 300 * time.Millisecond,
+	})
+	client := connectEcho(t, server)
+	defer client.Close()
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Expires.Sub(sessions[0].Started) != 300*time.Millisecond {
+		t.Errorf("Session expiry not recorded %+v", sessions)
+	}
+
+	// The session is closed even though it is active
+	var err error
+	for i := 0; i < 50 && err == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		err = echo(client)
+	}
+	if err == nil {
+		t.Errorf("Session not closed once expired")
+	}
+}
+
+// countingConn records the number of times the connection is closed
+type countingConn struct {
+	*net.TCPConn
+	closes *int32
+}
+
+func (conn countingConn) Close() error {
+	atomic.AddInt32(conn.closes, 1)
+	return conn.TCPConn.Close()
+}
+
+// countingDialer dials TCP connections counting their closes
+type countingDialer struct {
+	closes int32
+}
+
+func (dialer *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&NetDialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn.(*net.TCPConn), &dialer.closes}, nil
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	// The destination answers once the client finished sending
+	destination, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer destination.Close()
+	go func() {
+		conn, err := destination.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		conn.Write(append([]byte("received "), data...))
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := &countingDialer{}
+	server := NewWithOptions(Options{Listener: listener, Dialer: dialer, Rules: allowLoopback(t)})
+	go server.Start()
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	greet(t, conn)
+
+	port := destination.Addr().(*net.TCPAddr).Port
+	conn.Write([]byte{socks5.Socks5, 0x01, 0x00, 0x01, 127, 0, 0, 1, byte(port >> 8), byte(port)})
+	if reply := readReply(t, conn); reply.GetReply() != socks5.ReplySucceeded {
+		t.Fatalf("Connect failed with 0x%02x", reply.GetReply())
+	}
+
+	conn.Write([]byte("request"))
+	conn.(*net.TCPConn).CloseWrite()
+	response, err := ioutil.ReadAll(conn)
+	if err != nil || string(response) != "received request" {
+		t.Errorf("Unexpected response %q, %v", response, err)
+	}
+
+	for i := 0; i < 100 && server.activeSessions() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if closes := atomic.LoadInt32(&dialer.closes); closes != 1 {
+		t.Errorf("Outbound connection closed %d times", closes)
+	}
+}
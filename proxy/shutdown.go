@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"sort"
+	"time"
+)
+
+const (
+	// shutdownPollInterval is how often Shutdown checks
+	// whether the sessions have completed
+	shutdownPollInterval = 100 * time.Millisecond
+	// shutdownCloseTimeout is how long Shutdown waits for the
+	// sessions closed at the deadline to release their connections
+	shutdownCloseTimeout = 5 * time.Second
+)
+
+// ShutdownResult reports how the sessions in progress when
+// Shutdown was called ended
+type ShutdownResult struct {
+	// Drained is the number of sessions that completed
+	// before the deadline
+	Drained int
+	// Killed is the number of sessions closed
+	// once the deadline expired
+	Killed int
+}
+
+// Shutdown gracefully stops the server. The listeners are closed
+// first, then Shutdown waits for the sessions in progress to complete.
+// When the context expires before, the remaining sessions are closed
+// and the context error is returned once their connections are closed.
+func (server *Server) Shutdown(ctx context.Context) (ShutdownResult, error) {
+	server.Stop()
+
+	server.sessionMutex.Lock()
+	initial := len(server.sessions)
+	server.sessionMutex.Unlock()
+	logging.Info("Waiting for %d sessions to complete", initial)
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if server.activeSessions() == 0 {
+			return ShutdownResult{Drained: initial}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			killed := server.closeSessions()
+			server.waitSessions(shutdownCloseTimeout)
+			return ShutdownResult{Drained: initial - killed, Killed: killed}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// sessionEntry is a session in progress
+type sessionEntry struct {
+	session *socks5.Session
+	cancel  context.CancelFunc
+}
+
+// registerSession records a session starting and assigns its ID.
+// Once the server is stopped no session can start and false
+// is returned.
+func (server *Server) registerSession(session *socks5.Session,
+	cancel context.CancelFunc) bool {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	if server.stopped() {
+		return false
+	}
+	if server.sessions == nil {
+		server.sessions = map[uint64]sessionEntry{}
+	}
+	server.lastSessionID++
+	session.ID = server.lastSessionID
+	server.sessions[session.ID] = sessionEntry{session: session, cancel: cancel}
+	return true
+}
+
+// endSession removes the session with the ID
+func (server *Server) endSession(id uint64) {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	if entry, ok := server.sessions[id]; ok {
+		entry.cancel()
+		delete(server.sessions, id)
+	}
+}
+
+// Sessions returns the sessions in progress ordered by ID
+func (server *Server) Sessions() []*socks5.Session {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	sessions := make([]*socks5.Session, 0, len(server.sessions))
+	for _, entry := range server.sessions {
+		sessions = append(sessions, entry.session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// CloseSession cancels the session with the ID, aborting the dial or
+// relay in progress. It returns false when no such session exists.
+func (server *Server) CloseSession(id uint64) bool {
+	server.sessionMutex.Lock()
+	entry, ok := server.sessions[id]
+	server.sessionMutex.Unlock()
+
+	if ok {
+		logging.Info("Closing session %d of %s", id, entry.session.ClientAddr)
+		entry.cancel()
+	}
+	return ok
+}
+
+// activeSessions returns the number of sessions in progress
+func (server *Server) activeSessions() int {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+	return len(server.sessions)
+}
+
+// closeSessions cancels the sessions in progress, which closes
+// their connections. It returns the number of sessions closed.
+func (server *Server) closeSessions() int {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	for id, entry := range server.sessions {
+		logging.Info("Closing session %d of %s", id, entry.session.ClientAddr)
+		entry.cancel()
+	}
+	return len(server.sessions)
+}
+
+// waitSessions waits for the sessions to end, at most for the timeout.
+// Sessions end once their connections are closed.
+func (server *Server) waitSessions(timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(shutdownPollInterval / 10)
+	defer ticker.Stop()
+
+	for server.activeSessions() > 0 {
+		select {
+		case <-deadline.C:
+			logging.Info("%d sessions still closing", server.activeSessions())
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer starts a server on a free loopback address and
+// opens a session that stays in the handshake
+func startServer(t *testing.T) (*Server, net.Conn, chan error) {
+	address := freeAddress(t)
+	server := New("test", 0, 10)
+	server.SetListenAddresses([]string{address})
+
+	done := make(chan error, 1)
+	go func() { done <- server.Start() }()
+
+	var client net.Conn
+	for i := 0; i < 100; i++ {
+		if client == nil {
+			client, _ = net.Dial("tcp", address)
+		}
+		if client != nil && server.activeSessions() == 1 {
+			return server, client, done
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Session not started on %s", address)
+	return nil, nil, nil
+}
+
+func TestShutdownDrainsSessions(t *testing.T) {
+	server, client, done := startServer(t)
+
+	type shutdownReturn struct {
+		result ShutdownResult
+		err    error
+	}
+	returned := make(chan shutdownReturn)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result, err := server.Shutdown(ctx)
+		returned <- shutdownReturn{result, err}
+	}()
+
+	// Once Start returns no connection is accepted anymore
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Start returned %v", err)
+	}
+
+	// The session completes when the client goes away
+	client.Close()
+	shutdown := <-returned
+	if shutdown.err != nil || shutdown.result.Drained != 1 || shutdown.result.Killed != 0 {
+		t.Errorf("Unexpected shutdown %+v, %v", shutdown.result, shutdown.err)
+	}
+}
+
+func TestShutdownKillsSessions(t *testing.T) {
+	server, client, done := startServer(t)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	result, err := server.Shutdown(ctx)
+	if err != context.DeadlineExceeded || result.Drained != 0 || result.Killed != 1 {
+		t.Errorf("Unexpected shutdown %+v, %v", result, err)
+	}
+	// Shutdown returns once the killed sessions ended
+	if server.activeSessions() != 0 {
+		t.Errorf("Shutdown returned before the sessions ended")
+	}
+	<-done
+
+	// The client connection was closed by the server
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Session not closed")
+	}
+}
+
+// slowCloseConn takes a while to close, like a connection
+// flushing its data
+type slowCloseConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (conn *slowCloseConn) Close() error {
+	time.Sleep(100 * time.Millisecond)
+	err := conn.Conn.Close()
+	close(conn.closed)
+	return err
+}
+
+func TestShutdownWaitsForKilledSessions(t *testing.T) {
+	server := NewWithOptions(Options{})
+	client, serverSide := net.Pipe()
+	defer client.Close()
+	conn := &slowCloseConn{Conn: serverSide, closed: make(chan struct{})}
+	go server.ServeConn(context.Background(), conn)
+	for i := 0; i < 100 && server.activeSessions() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if result, _ := server.Shutdown(ctx); result.Killed != 1 {
+		t.Fatalf("Unexpected shutdown %+v", result)
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Errorf("Shutdown returned before the connection of the session was closed")
+	}
+}
+
+// blockingDialer waits for the context of the dial to be done,
+// reporting the session it was given
+type blockingDialer struct {
+	sessions chan *socks5.Session
+}
+
+func (dialer *blockingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	session, _ := socks5.SessionFromContext(ctx)
+	dialer.sessions <- session
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// startConnect opens a session on the server and sends a
+// CONNECT request authenticated as user
+func startConnect(t *testing.T, server *Server) net.Conn {
+	client, serverSide := net.Pipe()
+	go server.ServeConn(context.Background(), serverSide)
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte{socks5.Socks5, 0x01, byte(socks5.MethodUserAuth)})
+	io.ReadFull(client, make([]byte, 2))
+	client.Write([]byte{0x01, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'})
+	io.ReadFull(client, make([]byte, 2))
+	client.Write([]byte{socks5.Socks5, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x01, 0xbb})
+	return client
+}
+
+func TestCloseSessionAbortsDial(t *testing.T) {
+	dialer := &blockingDialer{sessions: make(chan *socks5.Session, 1)}
+	server := NewWithOptions(Options{Dialer: dialer})
+	server.SetCredentials(map[string]string{"user": "pass"})
+
+	client := startConnect(t, server)
+	defer client.Close()
+
+	session := <-dialer.sessions
+	if session == nil {
+		t.Fatalf("Dial context carries no session")
+	}
+	if session.User() != "user" || session.ClientAddr == nil {
+		t.Errorf("Unexpected session user %q, client %v", session.User(), session.ClientAddr)
+	}
+	if sessions := server.Sessions(); len(sessions) != 1 || sessions[0] != session {
+		t.Errorf("Unexpected sessions %v", sessions)
+	}
+
+	if !server.CloseSession(session.ID) {
+		t.Fatalf("Session %d not found", session.ID)
+	}
+	// A reply may be sent before the connection is closed
+	if _, err := io.Copy(ioutil.Discard, client); err != nil {
+		t.Errorf("Client connection not closed: %v", err)
+	}
+	for i := 0; i < 100 && server.activeSessions() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.CloseSession(session.ID) {
+		t.Errorf("Session %d still registered", session.ID)
+	}
+}
+
+func TestHandshakeDeadlineAbortsDial(t *testing.T) {
+	dialer := &blockingDialer{sessions: make(chan *socks5.Session, 1)}
+	server := NewWithOptions(Options{Dialer: dialer, HandshakeTimeout: 200 * time.Millisecond})
+	server.SetCredentials(map[string]string{"user": "pass"})
+
+	client := startConnect(t, server)
+	defer client.Close()
+
+	<-dialer.sessions
+	if reply := readReply(t, client); reply.GetReply() != socks5.ReplyTTLExpired {
+		t.Errorf("Expected TTL expired, received 0x%02x", reply.GetReply())
+	}
+}
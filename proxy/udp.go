@@ -0,0 +1,354 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxUDPDatagramSize is the largest datagram read from the relay socket
+	maxUDPDatagramSize = 65535
+	// maxUDPRemotes is the number of destinations an association
+	// accepts replies from. The least recently used are forgotten.
+	maxUDPRemotes = 256
+	// udpRemoteTimeout is how long replies from a destination are
+	// accepted after the last datagram sent to it
+	udpRemoteTimeout = 2 * time.Minute
+	// maxUDPResolutions is the number of domain destinations of an
+	// association resolved at once. Further datagrams are dropped.
+	maxUDPResolutions = 16
+	// udpResolveTimeout bounds the resolution of a datagram destination
+	udpResolveTimeout = 5 * time.Second
+)
+
+// udpAssociation holds the state of a single UDP associate request
+type udpAssociation struct {
+	server *Server
+	// ctx is cancelled when the association or its session terminates
+	ctx   context.Context
+	relay *net.UDPConn
+	// clientIP and clientPort restrict the datagrams accepted from the
+	// client. clientPort is zero until the first datagram is received
+	// when the client did not announce it.
+	clientIP   net.IP
+	clientPort int
+	// remotes holds the destinations the client sent datagrams to
+	// and when the last one was sent. Only datagrams coming from
+	// these are relayed back to the client.
+	remotesLock sync.Mutex
+	remotes     map[string]time.Time
+	// resolutions limits the domain destinations resolved at once,
+	// outside of the relay goroutine
+	resolutions chan struct{}
+	resolving   sync.WaitGroup
+	// reassembler queues the fragments sent by the client
+	reassembler *socks5.UDPReassembler
+	// access is the request of the association the
+	// destinations of the datagrams are checked with
+	access *acl.Request
+}
+
+// handleUDPAssociateLocal processes a UDP ASSOCIATE request (RFC 1928).
+// A relay socket is allocated and its address is sent in the reply.
+func (server *Server) handleUDPAssociateLocal(ctx context.Context, request *socks5.Request,
+	associateRequest socks5.SockRequest) {
+
+	clientConn := request.ClientConnection
+	request.State = socks5.RequestStateTerminating
+
+	// Open the relay on the address the client reached us on
+	var listenIP net.IP
+	if local, ok := clientConn.LocalAddr().(*net.TCPAddr); ok {
+		listenIP = local.IP
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: listenIP})
+	if err != nil {
+		logging.Error("Unable to open UDP relay", err)
+		server.sendReply(clientConn, socks5.NewSocksReply(socks5.ReplyGeneralFail, nil))
+		return
+	}
+
+	if err = server.sendReply(clientConn,
+		socks5.NewSocksReply(socks5.ReplySucceeded, relay.LocalAddr())); err != nil {
+		logging.Error("Error sending UDP associate reply", err)
+		relay.Close()
+		return
+	}
+
+	logging.Debug("UDP relay listening on %s for %s", relay.LocalAddr(), request.SourceAddr)
+
+	// The destination of a UDP associate request is the address
+	// the client will send datagrams from, if known
+	if associateRequest.GetAddressType() != socks5.AtypDomain {
+		request.DestinationAddr = &net.UDPAddr{
+			IP:   net.IP(associateRequest.GetDestinationAddress()),
+			Port: int(associateRequest.GetDestinationPort())}
+	}
+	request.RelayConnection = relay
+	request.State = socks5.RequestStateRelayingUDP
+}
+
+// startUDPRelay relays the datagrams of the association until the
+// controlling TCP connection is closed
+func (server *Server) startUDPRelay(ctx context.Context, request *socks5.Request) {
+	// Pending resolutions are abandoned with the association
+	associationCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	association := &udpAssociation{
+		server:      server,
+		ctx:         associationCtx,
+		relay:       request.RelayConnection.(*net.UDPConn),
+		remotes:     make(map[string]time.Time),
+		resolutions: make(chan struct{}, maxUDPResolutions),
+		reassembler: socks5.NewUDPReassembler(socks5.DefaultReassemblyTimeout),
+		access:      &acl.Request{User: request.Username, Command: acl.CommandUDPAssociate},
+	}
+	if source, ok := request.SourceAddr.(*net.TCPAddr); ok {
+		association.access.Client = source.IP
+	}
+
+	// The client may announce the address it will send from. Fall
+	// back to the address of the controlling connection otherwise.
+	if announced, ok := request.DestinationAddr.(*net.UDPAddr); ok {
+		association.clientIP = announced.IP
+		association.clientPort = announced.Port
+	}
+	if association.clientIP == nil || association.clientIP.IsUnspecified() {
+		association.clientIP = nil
+		if source, ok := request.SourceAddr.(*net.TCPAddr); ok {
+			association.clientIP = source.IP
+		}
+	}
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		association.relayDatagrams()
+	}()
+
+	// The association terminates when the controlling
+	// TCP connection closes
+	request.ClientConnection.SetDeadline(time.Time{})
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			request.ClientConnection.SetDeadline(time.Now())
+		case <-finished:
+		}
+	}()
+	io.Copy(ioutil.Discard, request.Reader())
+	close(finished)
+
+	logging.Debug("Closing UDP relay for %s", request.SourceAddr)
+	cancel()
+	association.relay.Close()
+	wait.Wait()
+	association.resolving.Wait()
+
+	request.State = socks5.RequestStateTerminating
+}
+
+// relayDatagrams reads the datagrams received on the relay
+// socket and forwards them in the right direction
+func (association *udpAssociation) relayDatagrams() {
+	buffer := make([]byte, maxUDPDatagramSize)
+	for {
+		n, from, err := association.relay.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		if association.fromClient(from) {
+			association.forward(from, buffer[:n])
+		} else {
+			association.reply(from, buffer[:n])
+		}
+	}
+}
+
+// fromClient checks if the datagram was sent by the client
+func (association *udpAssociation) fromClient(from *net.UDPAddr) bool {
+	if association.clientIP != nil && !association.clientIP.Equal(from.IP) {
+		return false
+	}
+
+	if association.clientPort == 0 {
+		if association.isRemote(from) {
+			return false
+		}
+		association.clientIP = from.IP
+		association.clientPort = from.Port
+		return true
+	}
+	return association.clientPort == from.Port
+}
+
+// forward strips the SOCKS header from the client datagram
+// and sends the data to the destination
+func (association *udpAssociation) forward(from *net.UDPAddr, datagram []byte) {
+	packet, err := socks5.GetSocketUDPDeserialized(datagram)
+	if err != nil {
+		logging.Debug("Dropping invalid datagram from %s: %s", from, err)
+		return
+	}
+
+	// Fragments are queued until the sequence is complete
+	packet, done, err := association.reassembler.Add(packet)
+	if err != nil {
+		logging.Debug("Dropping fragmented datagram from %s: %s", from, err)
+		return
+	} else if !done {
+		return
+	}
+
+	// Like for CONNECT the route is selected before resolving,
+	// datagrams are only relayed directly
+	access := *association.access
+	access.Port = packet.GetDestinationPort()
+	if packet.GetAddressType() == socks5.AtypDomain {
+		access.Domain = string(packet.GetDestinationAddress())
+	} else {
+		access.IP = net.IP(packet.GetDestinationAddress())
+	}
+	if association.server.directRouteReply(&access) != socks5.ReplySucceeded {
+		return
+	}
+
+	if packet.GetAddressType() != socks5.AtypDomain {
+		association.send(from, packet, access)
+		return
+	}
+
+	// Domains are resolved outside of the relay goroutine
+	// so a slow name does not hold up the other datagrams
+	select {
+	case association.resolutions <- struct{}{}:
+	default:
+		logging.Debug("Dropping datagram from %s: too many pending resolutions", from)
+		return
+	}
+	association.resolving.Add(1)
+	go func() {
+		defer association.resolving.Done()
+		defer func() { <-association.resolutions }()
+		association.send(from, packet, access)
+	}()
+}
+
+// send resolves the destination of the datagram and
+// sends the data if the access rules allow it
+func (association *udpAssociation) send(from *net.UDPAddr, packet socks5.UDPPacket,
+	access acl.Request) {
+
+	destination, err := association.resolve(packet)
+	if err != nil {
+		logging.Debug("Dropping datagram from %s: %s", from, err)
+		return
+	}
+
+	access.IP = destination.IP
+	if !association.server.accessAllowed(&access) {
+		return
+	}
+
+	association.addRemote(destination)
+	if _, err = association.relay.WriteToUDP(packet.GetData(), destination); err != nil {
+		logging.Debug("Unable to send datagram to %s: %s", destination, err)
+	}
+}
+
+// addRemote records that a datagram was sent to the destination.
+// The least recently used destination is forgotten when there are
+// too many.
+func (association *udpAssociation) addRemote(destination *net.UDPAddr) {
+	association.remotesLock.Lock()
+	defer association.remotesLock.Unlock()
+
+	now := time.Now()
+	key := destination.String()
+	if _, ok := association.remotes[key]; !ok && len(association.remotes) >= maxUDPRemotes {
+		var oldest string
+		for remote, lastSent := range association.remotes {
+			if now.Sub(lastSent) > udpRemoteTimeout {
+				delete(association.remotes, remote)
+			} else if oldest == "" || lastSent.Before(association.remotes[oldest]) {
+				oldest = remote
+			}
+		}
+		if len(association.remotes) >= maxUDPRemotes {
+			delete(association.remotes, oldest)
+		}
+	}
+	association.remotes[key] = now
+}
+
+// isRemote checks if a datagram was recently sent to the address
+func (association *udpAssociation) isRemote(from *net.UDPAddr) bool {
+	association.remotesLock.Lock()
+	defer association.remotesLock.Unlock()
+
+	key := from.String()
+	lastSent, ok := association.remotes[key]
+	if ok && time.Since(lastSent) > udpRemoteTimeout {
+		delete(association.remotes, key)
+		return false
+	}
+	return ok
+}
+
+// reply adds the SOCKS header to the datagram received
+// from a destination and sends it to the client
+func (association *udpAssociation) reply(from *net.UDPAddr, datagram []byte) {
+	if association.clientPort == 0 || !association.isRemote(from) {
+		logging.Debug("Dropping datagram from unknown source %s", from)
+		return
+	}
+
+	packet, err := socks5.GetSocketUDPSerialized(socks5.NewUDPPacket(from, datagram))
+	if err != nil {
+		logging.Debug("Unable to encode datagram from %s: %s", from, err)
+		return
+	}
+
+	client := &net.UDPAddr{IP: association.clientIP, Port: association.clientPort}
+	if _, err = association.relay.WriteToUDP(packet, client); err != nil {
+		logging.Debug("Unable to send datagram to client %s: %s", client, err)
+	}
+}
+
+// resolve returns the destination address of the datagram
+func (association *udpAssociation) resolve(packet socks5.UDPPacket) (*net.UDPAddr, error) {
+	port := int(packet.GetDestinationPort())
+
+	switch packet.GetAddressType() {
+	case socks5.AtypIPV4, socks5.AtypIPV6:
+		return &net.UDPAddr{IP: net.IP(packet.GetDestinationAddress()), Port: port}, nil
+	case socks5.AtypDomain:
+		ctx, cancel := context.WithTimeout(association.ctx, udpResolveTimeout)
+		defer cancel()
+		ips, err := association.server.nameResolver().LookupIP(ctx,
+			string(packet.GetDestinationAddress()))
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses found for %s",
+				packet.GetDestinationAddress())
+		}
+		return &net.UDPAddr{IP: ips[0], Port: port}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported address type 0x%02x", packet.GetAddressType())
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPEcho starts a UDP server echoing every datagram
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to start UDP echo server: %v", err)
+	}
+
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buffer[:n], from)
+		}
+	}()
+	return conn
+}
+
+// startUDPAssociation sends a UDP associate request and
+// returns the relay address from the reply
+func startUDPAssociation(t *testing.T, server *Server,
+	request *socks5.Request, control net.Conn, done chan bool) *net.UDPAddr {
+
+	go func() {
+		server.handleConnectLocal(context.Background(), request)
+		if request.State == socks5.RequestStateRelayingUDP {
+			server.startUDPRelay(context.Background(), request)
+		}
+		request.Close()
+		close(done)
+	}()
+
+	control.Write([]byte{socks5.Socks5, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	reply := readReply(t, control)
+	if reply.GetReply() != socks5.ReplySucceeded || reply.GetBindPort() == 0 {
+		t.Fatalf("Invalid UDP associate reply: 0x%02x port %d", reply.GetReply(),
+			reply.GetBindPort())
+	}
+
+	relay, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("127.0.0.1:%d", reply.GetBindPort()))
+	return relay
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	server := Server{name: "test"}
+	writeConn, readConn := net.Pipe()
+	request := &socks5.Request{ClientConnection: writeConn, SourceAddr: writeConn.RemoteAddr()}
+	done := make(chan bool)
+	relay := startUDPAssociation(t, &server, request, readConn, done)
+
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatalf("Unable to create UDP client: %v", err)
+	}
+	defer client.Close()
+
+	datagram, _ := socks5.GetSocketUDPSerialized(
+		socks5.NewUDPPacket(echoAddr, []byte("ping")))
+	client.Write(datagram)
+
+	buffer := make([]byte, 2048)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := client.Read(buffer)
+	if err != nil {
+		t.Fatalf("No datagram relayed back: %v", err)
+	}
+
+	packet, err := socks5.GetSocketUDPDeserialized(buffer[:n])
+	if err != nil {
+		t.Fatalf("Invalid datagram relayed back: %v", err)
+	}
+
+	if !net.IP(packet.GetDestinationAddress()).Equal(echoAddr.IP) ||
+		int(packet.GetDestinationPort()) != echoAddr.Port {
+		t.Errorf("Relayed datagram has wrong source %v:%d",
+			net.IP(packet.GetDestinationAddress()), packet.GetDestinationPort())
+	}
+
+	if string(packet.GetData()) != "ping" {
+		t.Errorf("Relayed datagram has wrong data %q", packet.GetData())
+	}
+
+	// Closing the controlling connection tears down the relay
+	readConn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("UDP association not torn down")
+	}
+
+	client.Write(datagram)
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err = client.Read(buffer); err == nil {
+		t.Errorf("Datagram relayed after association was torn down")
+	}
+}
+
+func TestUDPAssociateRejectsOtherSources(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	server := Server{name: "test"}
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+	request := &socks5.Request{ClientConnection: writeConn, SourceAddr: writeConn.RemoteAddr()}
+	relay := startUDPAssociation(t, &server, request, readConn, make(chan bool))
+
+	client, _ := net.DialUDP("udp", nil, relay)
+	defer client.Close()
+	other, _ := net.DialUDP("udp", nil, relay)
+	defer other.Close()
+
+	datagram, _ := socks5.GetSocketUDPSerialized(
+		socks5.NewUDPPacket(echoAddr, []byte("ping")))
+
+	buffer := make([]byte, 2048)
+	client.Write(datagram)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(buffer); err != nil {
+		t.Fatalf("No datagram relayed back: %v", err)
+	}
+
+	// The association is bound to the first client source
+	other.Write(datagram)
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := other.Read(buffer); err == nil {
+		t.Errorf("Datagram from another source relayed")
+	}
+}
+
+// blockingResolver blocks every lookup until the context is done
+type blockingResolver struct{}
+
+func (blockingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestUDPAssociateSlowResolution(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	server := Server{name: "test"}
+	server.SetResolver(blockingResolver{})
+	writeConn, readConn := net.Pipe()
+	done := make(chan bool)
+	request := &socks5.Request{ClientConnection: writeConn, SourceAddr: writeConn.RemoteAddr()}
+	relay := startUDPAssociation(t, &server, request, readConn, done)
+
+	client, _ := net.DialUDP("udp", nil, relay)
+	defer client.Close()
+
+	host := "slow.example.com"
+	slow := []byte{0x00, 0x00, 0x00, byte(socks5.AtypDomain), byte(len(host))}
+	slow = append(slow, host...)
+	client.Write(append(slow, 0x00, 0x35, 'x'))
+
+	// The datagram to the slow domain does not hold up the others
+	datagram, _ := socks5.GetSocketUDPSerialized(
+		socks5.NewUDPPacket(echoAddr, []byte("ping")))
+	client.Write(datagram)
+
+	buffer := make([]byte, 2048)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := client.Read(buffer); err != nil {
+		t.Fatalf("No datagram relayed back: %v", err)
+	}
+
+	// Pending resolutions are abandoned with the association
+	readConn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("UDP association not torn down")
+	}
+}
+
+func TestUDPRemotesBounded(t *testing.T) {
+	association := &udpAssociation{remotes: make(map[string]time.Time)}
+
+	expired := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+	association.addRemote(expired)
+	association.remotes[expired.String()] = time.Now().Add(-udpRemoteTimeout - time.Second)
+	if association.isRemote(expired) {
+		t.Errorf("Expired destination accepted")
+	}
+
+	first := &net.UDPAddr{IP: net.IPv4(10, 0, 1, 0), Port: 53}
+	association.addRemote(first)
+	association.remotes[first.String()] = time.Now().Add(-time.Second)
+	for i := 1; i <= maxUDPRemotes; i++ {
+		association.addRemote(&net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8+1), byte(i)), Port: 53})
+	}
+
+	if len(association.remotes) != maxUDPRemotes {
+		t.Errorf("Destinations not bounded: %d", len(association.remotes))
+	}
+	if association.isRemote(first) {
+		t.Errorf("Least recently used destination not forgotten")
+	}
+}
+
+func TestUDPAssociateFragments(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+
+	server := Server{name: "test"}
+	writeConn, readConn := net.Pipe()
+	defer readConn.Close()
+	request := &socks5.Request{ClientConnection: writeConn, SourceAddr: writeConn.RemoteAddr()}
+	relay := startUDPAssociation(t, &server, request, readConn, make(chan bool))
+
+	client, _ := net.DialUDP("udp", nil, relay)
+	defer client.Close()
+
+	first := socks5.NewUDPPacket(echoAddr, []byte("pi"))
+	first.SetFragment(1)
+	last := socks5.NewUDPPacket(echoAddr, []byte("ng"))
+	last.SetFragment(2 | socks5.UDPFragmentEnd)
+
+	for _, packet := range []socks5.UDPPacket{first, last} {
+		datagram, _ := socks5.GetSocketUDPSerialized(packet)
+		client.Write(datagram)
+	}
+
+	buffer := make([]byte, 2048)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := client.Read(buffer)
+	if err != nil {
+		t.Fatalf("No datagram relayed back: %v", err)
+	}
+
+	packet, err := socks5.GetSocketUDPDeserialized(buffer[:n])
+	if err != nil || string(packet.GetData()) != "ping" {
+		t.Errorf("Reassembled datagram incorrect %q: %v", packet.GetData(), err)
+	}
+}
@@ -0,0 +1,167 @@
+package resolver
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultTTL is used for answers without a known TTL
+	DefaultTTL = 60 * time.Second
+	// DefaultNegativeTTL is how long failed lookups are cached for
+	DefaultNegativeTTL = 10 * time.Second
+	// DefaultMaxTTL caps the TTL reported by the upstream
+	DefaultMaxTTL = time.Hour
+	// DefaultMaxEntries is the number of names cached before
+	// the least recently used ones are evicted
+	DefaultMaxEntries = 10000
+)
+
+// cacheEntry holds a cached answer
+type cacheEntry struct {
+	name    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// CachingResolver caches the answers of the upstream resolver.
+// Positive answers are cached for their TTL and "not found"
+// answers are cached for the negative TTL. Once the cache is full,
+// the least recently used entries are evicted.
+type CachingResolver struct {
+	upstream    Resolver
+	defaultTTL  time.Duration
+	negativeTTL time.Duration
+	maxTTL      time.Duration
+	maxEntries  int
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	// recent orders the entries from the most recently used
+	recent *list.List
+	// now returns the current time. Overridden in tests.
+	now func() time.Time
+}
+
+// NewCachingResolver creates a caching resolver in front of upstream
+func NewCachingResolver(upstream Resolver) *CachingResolver {
+	return &CachingResolver{
+		upstream:    upstream,
+		defaultTTL:  DefaultTTL,
+		negativeTTL: DefaultNegativeTTL,
+		maxTTL:      DefaultMaxTTL,
+		maxEntries:  DefaultMaxEntries,
+		entries:     make(map[string]*list.Element),
+		recent:      list.New(),
+		now:         time.Now,
+	}
+}
+
+// SetTTLs overrides the TTL used when the upstream does not report
+// one, the negative TTL and the maximum TTL
+func (resolver *CachingResolver) SetTTLs(defaultTTL, negativeTTL, maxTTL time.Duration) {
+	resolver.defaultTTL = defaultTTL
+	resolver.negativeTTL = negativeTTL
+	resolver.maxTTL = maxTTL
+}
+
+// LookupIP implementation for the caching resolver
+func (resolver *CachingResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	name := canonicalName(host)
+
+	resolver.lock.Lock()
+	if element, ok := resolver.entries[name]; ok {
+		entry := element.Value.(*cacheEntry)
+		if resolver.now().Before(entry.expires) {
+			resolver.recent.MoveToFront(element)
+			resolver.lock.Unlock()
+			return copyIPs(entry.ips), entry.err
+		}
+		resolver.remove(element)
+	}
+	resolver.lock.Unlock()
+
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	if ttlResolver, ok := resolver.upstream.(TTLResolver); ok {
+		ips, ttl, err = ttlResolver.LookupIPTTL(ctx, host)
+	} else {
+		ips, err = resolver.upstream.LookupIP(ctx, host)
+	}
+
+	switch {
+	case err == nil:
+		if ttl <= 0 {
+			ttl = resolver.defaultTTL
+		}
+		if ttl > resolver.maxTTL {
+			ttl = resolver.maxTTL
+		}
+	case isNotFound(err):
+		ttl = resolver.negativeTTL
+	default:
+		// Do not cache temporary failures
+		return nil, err
+	}
+
+	if ttl > 0 {
+		resolver.store(&cacheEntry{name: name, ips: copyIPs(ips), err: err,
+			expires: resolver.now().Add(ttl)})
+	}
+	return ips, err
+}
+
+// store adds the entry to the cache, evicting the least
+// recently used entries if the cache is full
+func (resolver *CachingResolver) store(entry *cacheEntry) {
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+
+	// Concurrent lookups of the same name may race to store it
+	if element, ok := resolver.entries[entry.name]; ok {
+		resolver.remove(element)
+	}
+	for resolver.recent.Len() >= resolver.maxEntries && resolver.recent.Len() > 0 {
+		resolver.remove(resolver.recent.Back())
+	}
+	resolver.entries[entry.name] = resolver.recent.PushFront(entry)
+}
+
+// remove deletes a cached entry. The lock must be held.
+func (resolver *CachingResolver) remove(element *list.Element) {
+	resolver.recent.Remove(element)
+	delete(resolver.entries, element.Value.(*cacheEntry).name)
+}
+
+// Flush removes every cached entry
+func (resolver *CachingResolver) Flush() {
+	resolver.lock.Lock()
+	resolver.entries = make(map[string]*list.Element)
+	resolver.recent.Init()
+	resolver.lock.Unlock()
+}
+
+// copyIPs copies the addresses so the callers
+// cannot modify the cached answers
+func copyIPs(ips []net.IP) []net.IP {
+	if ips == nil {
+		return nil
+	}
+	copied := make([]net.IP, len(ips))
+	for i, ip := range ips {
+		copied[i] = append(net.IP(nil), ip...)
+	}
+	return copied
+}
+
+// isNotFound checks if the error reports a non existent name
+func isNotFound(err error) bool {
+	var dnsError *net.DNSError
+	return errors.As(err, &dnsError) && dnsError.IsNotFound
+}
@@ -0,0 +1,210 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultDNSTimeout is the timeout of a single DNS exchange
+	DefaultDNSTimeout = 5 * time.Second
+	// maxUDPMessageSize is the largest UDP answer accepted
+	maxUDPMessageSize = 4096
+)
+
+// DNSResolver resolves names by querying a specific DNS server.
+// Queries are sent over UDP and retried over TCP when the
+// answer is truncated.
+type DNSResolver struct {
+	server  string
+	timeout time.Duration
+}
+
+// NewDNSResolver creates a resolver querying the server at
+// address ("host:port"). The port defaults to 53.
+func NewDNSResolver(address string) *DNSResolver {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+	return &DNSResolver{server: address, timeout: DefaultDNSTimeout}
+}
+
+// LookupIP implementation for the DNS resolver
+func (resolver *DNSResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	ips, _, err := resolver.LookupIPTTL(ctx, host)
+	return ips, err
+}
+
+// LookupIPTTL queries the A and AAAA records of the host. The
+// returned TTL is the lowest TTL of the records in the answers.
+func (resolver *DNSResolver) LookupIPTTL(ctx context.Context,
+	host string) ([]net.IP, time.Duration, error) {
+
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	name, err := dnsmessage.NewName(canonicalName(host) + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: resolver.server}
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answerIPs, answerTTL, err := resolver.query(ctx, name, qtype)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return nil, 0, err
+		}
+		if len(answerIPs) > 0 && (len(ips) == 0 || answerTTL < ttl) {
+			ttl = answerTTL
+		}
+		ips = append(ips, answerIPs...)
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host,
+			Server: resolver.server, IsNotFound: true}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// query sends a single question to the server and
+// returns the addresses in the answer
+func (resolver *DNSResolver) query(ctx context.Context, name dnsmessage.Name,
+	qtype dnsmessage.Type) ([]net.IP, uint32, error) {
+
+	// Unpredictable IDs make forged answers harder to get accepted
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes)
+	question := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := resolver.exchange(ctx, "udp", packet)
+	if err == nil && response.Truncated {
+		response, err = resolver.exchange(ctx, "tcp", packet)
+	}
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name.String(),
+			Server: resolver.server, IsTemporary: true}
+	}
+
+	if response.ID != id {
+		return nil, 0, &net.DNSError{Err: "mismatched response id",
+			Name: name.String(), Server: resolver.server}
+	}
+	if !sameQuestion(response.Questions, question) {
+		return nil, 0, &net.DNSError{Err: "mismatched response question",
+			Name: name.String(), Server: resolver.server}
+	}
+
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name.String(),
+			Server: resolver.server, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server failure: " + response.RCode.String(),
+			Name: name.String(), Server: resolver.server, IsTemporary: true}
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for _, answer := range response.Answers {
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		if len(ips) == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+		ips = append(ips, ip)
+	}
+	return ips, ttl, nil
+}
+
+// exchange sends the packet to the server over the network
+// and reads a single response
+func (resolver *DNSResolver) exchange(ctx context.Context, network string,
+	packet []byte) (*dnsmessage.Message, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, resolver.timeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, resolver.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var response []byte
+	if network == "tcp" {
+		// TCP messages are prefixed with a two byte length
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(packet)))
+		if _, err = conn.Write(append(length, packet...)); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		response = make([]byte, binary.BigEndian.Uint16(length))
+		if _, err = io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err = conn.Write(packet); err != nil {
+			return nil, err
+		}
+		response = make([]byte, maxUDPMessageSize)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		response = response[:n]
+	}
+
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// sameQuestion checks that the response answers the question.
+// Names are compared case insensitively.
+func sameQuestion(questions []dnsmessage.Question, question dnsmessage.Question) bool {
+	return len(questions) == 1 && questions[0].Type == question.Type &&
+		questions[0].Class == question.Class &&
+		strings.EqualFold(questions[0].Name.String(), question.Name.String())
+}
@@ -0,0 +1,137 @@
+// Package resolver contains the name resolvers used by the proxy
+// to look up domain name destinations
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Resolver interface defines the function to be implemented
+// by a name resolver
+type Resolver interface {
+	// LookupIP returns the IP addresses of the host
+	LookupIP(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// TTLResolver is implemented by resolvers that know how long
+// the returned addresses remain valid
+type TTLResolver interface {
+	Resolver
+	// LookupIPTTL returns the IP addresses of the host and
+	// the time the addresses can be cached for
+	LookupIPTTL(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// SystemResolver resolves names using the operating
+// system resolver
+type SystemResolver struct{}
+
+// LookupIP implementation for the system resolver
+func (SystemResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addresses))
+	for _, address := range addresses {
+		ips = append(ips, address.IP)
+	}
+	return ips, nil
+}
+
+// HostsResolver answers from a static map of host names
+// to addresses and delegates every other name
+type HostsResolver struct {
+	hosts map[string][]net.IP
+	next  Resolver
+}
+
+// NewHostsResolver creates a resolver overriding the hosts in
+// the map. Names not in the map are resolved using next.
+func NewHostsResolver(hosts map[string][]net.IP, next Resolver) *HostsResolver {
+	normalized := make(map[string][]net.IP, len(hosts))
+	for host, ips := range hosts {
+		normalized[canonicalName(host)] = ips
+	}
+	return &HostsResolver{hosts: normalized, next: next}
+}
+
+// LookupIP implementation for the hosts resolver
+func (resolver *HostsResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ips, ok := resolver.hosts[canonicalName(host)]; ok {
+		return ips, nil
+	}
+	return resolver.next.LookupIP(ctx, host)
+}
+
+// SplitRule sends the names ending with Suffix to Resolver
+type SplitRule struct {
+	Suffix   string
+	Resolver Resolver
+}
+
+// SplitResolver implements split horizon DNS. Names are matched
+// against the rule suffixes and resolved with the resolver of the
+// longest matching suffix, or the fallback resolver if none match.
+type SplitResolver struct {
+	rules    []SplitRule
+	fallback Resolver
+}
+
+// NewSplitResolver creates a split horizon resolver
+func NewSplitResolver(rules []SplitRule, fallback Resolver) *SplitResolver {
+	normalized := make([]SplitRule, 0, len(rules))
+	for _, rule := range rules {
+		normalized = append(normalized,
+			SplitRule{Suffix: canonicalName(rule.Suffix), Resolver: rule.Resolver})
+	}
+	return &SplitResolver{rules: normalized, fallback: fallback}
+}
+
+// LookupIP implementation for the split resolver
+func (resolver *SplitResolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	return resolver.selectResolver(host).LookupIP(ctx, host)
+}
+
+// LookupIPTTL implementation for the split resolver. The TTL is
+// zero when the selected resolver does not report TTLs.
+func (resolver *SplitResolver) LookupIPTTL(ctx context.Context,
+	host string) ([]net.IP, time.Duration, error) {
+	selected := resolver.selectResolver(host)
+	if ttlResolver, ok := selected.(TTLResolver); ok {
+		return ttlResolver.LookupIPTTL(ctx, host)
+	}
+	ips, err := selected.LookupIP(ctx, host)
+	return ips, 0, err
+}
+
+// selectResolver returns the resolver of the longest
+// suffix matching the host
+func (resolver *SplitResolver) selectResolver(host string) Resolver {
+	name := canonicalName(host)
+	selected := resolver.fallback
+	matched := -1
+	for _, rule := range resolver.rules {
+		if len(rule.Suffix) > matched && matchesSuffix(name, rule.Suffix) {
+			selected = rule.Resolver
+			matched = len(rule.Suffix)
+		}
+	}
+	return selected
+}
+
+// matchesSuffix checks if name is the suffix domain
+// or one of its sub domains
+func matchesSuffix(name, suffix string) bool {
+	suffix = strings.TrimPrefix(suffix, ".")
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
+
+// canonicalName lower cases the name and strips the trailing dot
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
@@ -0,0 +1,304 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSServer is an in-process DNS server answering
+// A and AAAA queries from a static zone
+type testDNSServer struct {
+	conn    net.PacketConn
+	zone    map[string][]net.IP
+	ttl     uint32
+	lock    sync.Mutex
+	queries int
+	// answerName replaces the name in the question of the responses
+	answerName string
+}
+
+func newTestDNSServer(t *testing.T, zone map[string][]net.IP, ttl uint32) *testDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to start DNS server: %v", err)
+	}
+	server := &testDNSServer{conn: conn, zone: zone, ttl: ttl}
+	go server.serve()
+	return server
+}
+
+func (server *testDNSServer) address() string {
+	return server.conn.LocalAddr().String()
+}
+
+func (server *testDNSServer) queryCount() int {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.queries
+}
+
+func (server *testDNSServer) serve() {
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := server.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+
+		var query dnsmessage.Message
+		if err := query.Unpack(buffer[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		server.lock.Lock()
+		server.queries++
+		answerName := server.answerName
+		server.lock.Unlock()
+
+		question := query.Questions[0]
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true},
+			Questions: query.Questions,
+		}
+		if answerName != "" {
+			response.Questions = []dnsmessage.Question{{Name: dnsmessage.MustNewName(answerName),
+				Type: question.Type, Class: question.Class}}
+		}
+
+		ips, ok := server.zone[question.Name.String()]
+		if !ok {
+			response.RCode = dnsmessage.RCodeNameError
+		}
+		for _, ip := range ips {
+			header := dnsmessage.ResourceHeader{Name: question.Name,
+				Class: dnsmessage.ClassINET, TTL: server.ttl}
+			if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+				var a [4]byte
+				copy(a[:], ip4)
+				header.Type = dnsmessage.TypeA
+				response.Answers = append(response.Answers,
+					dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: a}})
+			} else if ip.To4() == nil && question.Type == dnsmessage.TypeAAAA {
+				var aaaa [16]byte
+				copy(aaaa[:], ip)
+				header.Type = dnsmessage.TypeAAAA
+				response.Answers = append(response.Answers,
+					dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: aaaa}})
+			}
+		}
+
+		packet, _ := response.Pack()
+		server.conn.WriteTo(packet, addr)
+	}
+}
+
+func (server *testDNSServer) Close() {
+	server.conn.Close()
+}
+
+func TestDNSResolver(t *testing.T) {
+	dnsServer := newTestDNSServer(t, map[string][]net.IP{
+		"host.example.com.": {net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+	}, 300)
+	defer dnsServer.Close()
+
+	resolver := NewDNSResolver(dnsServer.address())
+
+	ips, ttl, err := resolver.LookupIPTTL(context.Background(), "host.example.com")
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.0.1")) ||
+		!ips[1].Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("Incorrect addresses returned: %v", ips)
+	}
+
+	if ttl != 300*time.Second {
+		t.Errorf("Incorrect TTL returned: %v", ttl)
+	}
+
+	_, err = resolver.LookupIP(context.Background(), "missing.example.com")
+	if !isNotFound(err) {
+		t.Errorf("Missing name not reported as not found: %v", err)
+	}
+
+	// The question is matched case insensitively
+	if _, err := resolver.LookupIP(context.Background(), "HOST.Example.com"); err != nil {
+		t.Errorf("Lookup with mixed case failed: %v", err)
+	}
+
+	// Answers to another question are rejected
+	dnsServer.lock.Lock()
+	dnsServer.answerName = "other.example.com."
+	dnsServer.lock.Unlock()
+	if ips, err := resolver.LookupIP(context.Background(), "host.example.com"); err == nil {
+		t.Errorf("Answer to another question accepted: %v", ips)
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	dnsServer := newTestDNSServer(t, map[string][]net.IP{
+		"host.example.com.": {net.ParseIP("10.0.0.1")},
+	}, 30)
+	defer dnsServer.Close()
+
+	now := time.Now()
+	resolver := NewCachingResolver(NewDNSResolver(dnsServer.address()))
+	resolver.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ips, err := resolver.LookupIP(context.Background(), "HOST.example.com.")
+		if err != nil || len(ips) != 1 {
+			t.Fatalf("Lookup failed: %v %v", ips, err)
+		}
+	}
+
+	// A and AAAA queries for a single lookup
+	if dnsServer.queryCount() != 2 {
+		t.Errorf("Answer not cached, %d queries sent", dnsServer.queryCount())
+	}
+
+	now = now.Add(31 * time.Second)
+	resolver.LookupIP(context.Background(), "host.example.com")
+	if dnsServer.queryCount() != 4 {
+		t.Errorf("Expired answer not refreshed, %d queries sent", dnsServer.queryCount())
+	}
+
+	// Negative answers are cached for the negative TTL
+	for i := 0; i < 2; i++ {
+		if _, err := resolver.LookupIP(context.Background(), "missing.example.com"); err == nil {
+			t.Errorf("Missing name resolved")
+		}
+	}
+	if dnsServer.queryCount() != 6 {
+		t.Errorf("Negative answer not cached, %d queries sent", dnsServer.queryCount())
+	}
+
+	now = now.Add(DefaultNegativeTTL + time.Second)
+	resolver.LookupIP(context.Background(), "missing.example.com")
+	if dnsServer.queryCount() != 8 {
+		t.Errorf("Expired negative answer not refreshed, %d queries sent",
+			dnsServer.queryCount())
+	}
+
+	// The cached answer cannot be modified by the caller
+	ips, _ := resolver.LookupIP(context.Background(), "host.example.com")
+	ips[0][0] = 192
+	ips, _ = resolver.LookupIP(context.Background(), "host.example.com")
+	if !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Cached answer modified: %v", ips)
+	}
+}
+
+func TestCachingResolverEviction(t *testing.T) {
+	dnsServer := newTestDNSServer(t, map[string][]net.IP{
+		"a.example.com.": {net.ParseIP("10.0.0.1")},
+		"b.example.com.": {net.ParseIP("10.0.0.2")},
+		"c.example.com.": {net.ParseIP("10.0.0.3")},
+	}, 300)
+	defer dnsServer.Close()
+
+	resolver := NewCachingResolver(NewDNSResolver(dnsServer.address()))
+	resolver.maxEntries = 2
+
+	lookup := func(host string) {
+		if _, err := resolver.LookupIP(context.Background(), host); err != nil {
+			t.Fatalf("Lookup of %s failed: %v", host, err)
+		}
+	}
+
+	lookup("a.example.com")
+	lookup("b.example.com")
+	// a is used again so b is the least recently used
+	lookup("a.example.com")
+	lookup("c.example.com")
+	if dnsServer.queryCount() != 6 {
+		t.Errorf("Unexpected queries before eviction: %d", dnsServer.queryCount())
+	}
+	if len(resolver.entries) != 2 || resolver.recent.Len() != 2 {
+		t.Errorf("Cache not bounded: %d entries", len(resolver.entries))
+	}
+
+	lookup("a.example.com")
+	if dnsServer.queryCount() != 6 {
+		t.Errorf("Recently used entry evicted, %d queries sent", dnsServer.queryCount())
+	}
+	lookup("b.example.com")
+	if dnsServer.queryCount() != 8 {
+		t.Errorf("Least recently used entry not evicted, %d queries sent",
+			dnsServer.queryCount())
+	}
+}
+
+func TestHostsResolver(t *testing.T) {
+	dnsServer := newTestDNSServer(t, map[string][]net.IP{
+		"host.example.com.":     {net.ParseIP("10.0.0.1")},
+		"override.example.com.": {net.ParseIP("10.0.0.2")},
+	}, 30)
+	defer dnsServer.Close()
+
+	resolver := NewHostsResolver(map[string][]net.IP{
+		"Override.example.com": {net.ParseIP("192.168.1.1")},
+	}, NewDNSResolver(dnsServer.address()))
+
+	ips, err := resolver.LookupIP(context.Background(), "override.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("Static override not used: %v %v", ips, err)
+	}
+
+	ips, err = resolver.LookupIP(context.Background(), "host.example.com")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Lookup not delegated: %v %v", ips, err)
+	}
+}
+
+func TestSplitResolver(t *testing.T) {
+	corpServer := newTestDNSServer(t, map[string][]net.IP{
+		"wiki.corp.":         {net.ParseIP("10.1.0.1")},
+		"build.eu.corp.":     {net.ParseIP("10.2.0.1")},
+		"www.example.com.":   {net.ParseIP("10.1.0.2")},
+		"notcorp.":           {net.ParseIP("10.1.0.3")},
+		"corp.":              {net.ParseIP("10.1.0.4")},
+		"build.eu.corp.net.": {net.ParseIP("10.1.0.5")},
+	}, 30)
+	defer corpServer.Close()
+
+	euServer := newTestDNSServer(t, map[string][]net.IP{
+		"build.eu.corp.": {net.ParseIP("10.3.0.1")},
+	}, 30)
+	defer euServer.Close()
+
+	publicServer := newTestDNSServer(t, map[string][]net.IP{
+		"www.example.com.": {net.ParseIP("93.184.216.34")},
+		"notcorp.":         {net.ParseIP("93.184.216.35")},
+	}, 30)
+	defer publicServer.Close()
+
+	resolver := NewSplitResolver([]SplitRule{
+		{Suffix: ".corp", Resolver: NewDNSResolver(corpServer.address())},
+		{Suffix: "eu.corp.", Resolver: NewDNSResolver(euServer.address())},
+	}, NewDNSResolver(publicServer.address()))
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"wiki.corp", "10.1.0.1"},
+		{"corp", "10.1.0.4"},
+		{"build.eu.corp", "10.3.0.1"},
+		{"www.example.com", "93.184.216.34"},
+		{"notcorp", "93.184.216.35"},
+	}
+
+	for _, test := range tests {
+		ips, err := resolver.LookupIP(context.Background(), test.host)
+		if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP(test.expected)) {
+			t.Errorf("%s resolved to %v %v, expected %s", test.host, ips, err, test.expected)
+		}
+	}
+}
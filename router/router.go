@@ -0,0 +1,148 @@
+// Package router selects the outbound route of the connections:
+// directly to the destination, through an upstream or blocked
+package router
+
+import (
+	"fmt"
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/config"
+)
+
+// Kind is how a route reaches the destinations
+type Kind int
+
+// Kinds of routes
+const (
+	// Direct routes connect to the destination
+	Direct Kind = iota
+	// Upstream routes connect through an upstream
+	Upstream
+	// Block routes refuse the connection
+	Block
+)
+
+// String implementation of Kind for logging
+func (kind Kind) String() string {
+	switch kind {
+	case Direct:
+		return config.RouteDirect
+	case Upstream:
+		return config.RouteUpstream
+	case Block:
+		return config.RouteBlock
+	}
+	return fmt.Sprintf("Kind(%d)", int(kind))
+}
+
+// Route is a named way of reaching destinations
+type Route struct {
+	// Name of the route
+	Name string
+	// Kind of the route
+	Kind Kind
+	// Upstreams is the chain of upstreams of Upstream routes,
+	// the first one is connected to
+	Upstreams []string
+}
+
+// Builtin routes, always defined
+var (
+	// DirectRoute connects to every destination directly
+	DirectRoute = &Route{Name: config.RouteDirect, Kind: Direct}
+	// BlockRoute refuses every connection
+	BlockRoute = &Route{Name: config.RouteBlock, Kind: Block}
+)
+
+// rule selects its route for the requests it matches
+type rule struct {
+	*acl.Rule
+	route *Route
+}
+
+// Router is an ordered list of rules, the first rule matching
+// a request selects its route
+type Router struct {
+	rules    []rule
+	routes   map[string]*Route
+	fallback *Route
+}
+
+// New builds the router of the routing configuration
+func New(routing config.Routing) (*Router, error) {
+	router := &Router{routes: map[string]*Route{
+		DirectRoute.Name: DirectRoute,
+		BlockRoute.Name:  BlockRoute,
+	}}
+
+	for i, route := range routing.Routes {
+		compiled := &Route{Name: route.Name, Upstreams: route.Upstreams}
+		switch route.Type {
+		case config.RouteDirect:
+			compiled.Kind = Direct
+		case config.RouteUpstream:
+			compiled.Kind = Upstream
+			if len(route.Upstreams) == 0 {
+				return nil, fmt.Errorf("routes[%d]: upstream route without upstreams", i)
+			}
+		case config.RouteBlock:
+			compiled.Kind = Block
+		default:
+			return nil, fmt.Errorf("routes[%d]: unknown route type %q", i, route.Type)
+		}
+		router.routes[route.Name] = compiled
+	}
+
+	router.fallback = DirectRoute
+	if routing.Default != "" {
+		router.fallback = router.routes[routing.Default]
+		if router.fallback == nil {
+			return nil, fmt.Errorf("unknown default route %q", routing.Default)
+		}
+	}
+
+	// The conditions are matched by the access control engine
+	for i, routeRule := range routing.Rules {
+		route := router.routes[routeRule.Route]
+		if route == nil {
+			return nil, fmt.Errorf("rules[%d]: unknown route %q", i, routeRule.Route)
+		}
+		compiled, err := acl.NewRule(config.Rule{
+			Name:         routeRule.Name,
+			Action:       "allow",
+			Users:        routeRule.Users,
+			Destinations: routeRule.Destinations,
+			Domains:      routeRule.Domains,
+			Ports:        routeRule.Ports,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %v", i, err)
+		}
+		if compiled.Name == "" {
+			compiled.Name = fmt.Sprintf("rules[%d]", i)
+		}
+		router.rules = append(router.rules, rule{compiled, route})
+	}
+	return router, nil
+}
+
+// Routes returns the routes by name, including the builtin ones
+func (router *Router) Routes() map[string]*Route {
+	routes := make(map[string]*Route, len(router.routes))
+	for name, route := range router.routes {
+		routes[name] = route
+	}
+	return routes
+}
+
+// Route returns the route of the request and the name of the rule
+// selecting it, "default" when no rule matches. The request is
+// matched as received: rules on destination networks only match
+// destinations given by address.
+func (router *Router) Route(request *acl.Request) (*Route, string) {
+	for _, rule := range router.rules {
+		if rule.Match(request) {
+			return rule.route, rule.Name
+		}
+	}
+	return router.fallback, "default"
+}
@@ -0,0 +1,79 @@
+package router
+
+import (
+	"hiteshkotian/ssl-tunnel/acl"
+	"hiteshkotian/ssl-tunnel/config"
+	"net"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	router, err := New(config.Routing{
+		Default: "parent",
+		Routes: []config.Route{
+			{Name: "parent", Type: "upstream", Upstreams: []string{"parent-proxy"}},
+			{Name: "sink", Type: "block"},
+		},
+		Rules: []config.RouteRule{
+			{Name: "local", Route: "direct", Domains: []string{".intranet.example"}},
+			{Name: "office", Route: "direct", Destinations: []string{"10.0.0.0/8"}, Ports: []string{"443"}},
+			{Route: "sink", Domains: []string{"*.ads.example"}},
+			{Name: "admins", Route: "direct", Users: []string{"root"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		request acl.Request
+		route   string
+		kind    Kind
+		rule    string
+	}{
+		{acl.Request{Domain: "wiki.intranet.example", Port: 80}, "direct", Direct, "local"},
+		{acl.Request{IP: net.ParseIP("10.1.2.3"), Port: 443}, "direct", Direct, "office"},
+		{acl.Request{IP: net.ParseIP("10.1.2.3"), Port: 80}, "parent", Upstream, "default"},
+		{acl.Request{Domain: "cdn.ads.example", Port: 443}, "sink", Block, "rules[2]"},
+		{acl.Request{User: "root", Domain: "www.example.com", Port: 443}, "direct", Direct, "admins"},
+		{acl.Request{User: "alice", Domain: "www.example.com", Port: 443}, "parent", Upstream, "default"},
+	}
+
+	for _, test := range tests {
+		route, rule := router.Route(&test.request)
+		if route.Name != test.route || route.Kind != test.kind || rule != test.rule {
+			t.Errorf("%s: expected %s (%s) by %s, received %s (%s) by %s", &test.request,
+				test.route, test.kind, test.rule, route.Name, route.Kind, rule)
+		}
+	}
+	if route, _ := router.Route(&acl.Request{Port: 443}); len(route.Upstreams) != 1 ||
+		route.Upstreams[0] != "parent-proxy" {
+		t.Errorf("Unexpected upstreams %q", route.Upstreams)
+	}
+}
+
+func TestDefaultRoute(t *testing.T) {
+	router, err := New(config.Routing{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route, rule := router.Route(&acl.Request{Domain: "example.com"}); route != DirectRoute || rule != "default" {
+		t.Errorf("Unexpected default route %+v by %s", route, rule)
+	}
+}
+
+func TestInvalidRouting(t *testing.T) {
+	invalid := []config.Routing{
+		{Default: "missing"},
+		{Routes: []config.Route{{Name: "parent", Type: "tunnel"}}},
+		{Routes: []config.Route{{Name: "parent", Type: "upstream"}}},
+		{Rules: []config.RouteRule{{Route: "missing"}}},
+		{Rules: []config.RouteRule{{Route: "direct", Destinations: []string{"10.0.0.0/33"}}}},
+		{Rules: []config.RouteRule{{Route: "direct", Domains: []string{"~("}}}},
+	}
+	for _, routing := range invalid {
+		if _, err := New(routing); err == nil {
+			t.Errorf("Invalid routing %+v not reported", routing)
+		}
+	}
+}
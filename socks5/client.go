@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/netutil"
+	"io"
+	"net"
+	"strconv"
+)
+
+// ReplyError is returned by the client when the
+// server does not accept a request
+type ReplyError struct {
+	Reply ReplyType
+}
+
+// Error implementation of ReplyError
+func (err *ReplyError) Error() string {
+	return fmt.Sprintf("Socks5Client: Request failed with reply 0x%02x", uint8(err.Reply))
+}
+
+// ErrAuthFailed is returned when the server rejects the credentials
+var ErrAuthFailed = errors.New("Socks5Client: Authentication failed")
+
+// Client connects to destinations through a SOCKS5 server. Servers
+// are chained by dialing a client with the client of the previous
+// hop, the domain names are then resolved by the last server.
+type Client struct {
+	// Address of the server
+	Address string
+	// Username and Password are sent when the server requires the
+	// username/password authentication (RFC 1929). Only no
+	// authentication is offered without Username.
+	Username string
+	Password string
+	// Dialer opens the connection to the server,
+	// a net.Dialer when nil
+	Dialer netutil.Dialer
+}
+
+// DialContext connects to the address through the server. The
+// address is a host:port pair, the host an IP address or a name.
+func (client *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("Socks5Client: Network %s not supported", network)
+	}
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Socks5Client: Invalid port %q", portString)
+	}
+	request, err := NewSockRequest(CmdConnect, host, uint16(port))
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer netutil.Dialer = &net.Dialer{}
+	if client.Dialer != nil {
+		dialer = client.Dialer
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", client.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := client.Connect(ctx, conn, request); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Connect negotiates the request on a connection to the server and
+// returns the reply. The handshake is abandoned when the context is
+// done, the connection is then left in an undefined state.
+func (client *Client) Connect(ctx context.Context, conn net.Conn, request SockRequest) (reply SockReply, err error) {
+	err = netutil.Interruptible(ctx, conn, func() (err error) {
+		reply, err = client.handshake(conn, request)
+		return
+	})
+	return
+}
+
+// handshake performs the method negotiation, the authentication
+// and sends the request
+func (client *Client) handshake(conn net.Conn, request SockRequest) (reply SockReply, err error) {
+	methods := NewMethodSelectionReq(MethodNoAuth)
+	if client.Username != "" {
+		methods = NewMethodSelectionReq(MethodNoAuth, MethodUserAuth)
+	}
+	packet, err := GetSocketMethodSerialized(methods)
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(packet); err != nil {
+		return
+	}
+
+	response := make([]uint8, 2)
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return
+	}
+	selection, err := GetSocketMethodResponseDeserialized(response)
+	if err != nil {
+		return
+	}
+
+	switch selection.GetMethod() {
+	case MethodNoAuth:
+	case MethodUserAuth:
+		if client.Username == "" {
+			err = errors.New("Socks5Client: Server selected a method not offered")
+			return
+		}
+		if err = client.authenticate(conn); err != nil {
+			return
+		}
+	case MethodNoAcceptable:
+		err = errors.New("Socks5Client: No acceptable authentication method")
+		return
+	default:
+		err = errors.New("Socks5Client: Server selected a method not offered")
+		return
+	}
+
+	if packet, err = GetSocketRequestSerialized(request); err != nil {
+		return
+	}
+	if _, err = conn.Write(packet); err != nil {
+		return
+	}
+	if reply, err = ReadReply(conn); err != nil {
+		return
+	}
+	if reply.GetReply() != ReplySucceeded {
+		err = &ReplyError{Reply: reply.GetReply()}
+	}
+	return
+}
+
+// authenticate performs the username/password sub-negotiation
+func (client *Client) authenticate(conn net.Conn) error {
+	credentials := UserAuthRequest{Username: client.Username, Password: client.Password}
+	packet, err := GetSocketUserAuthSerialized(credentials)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(packet); err != nil {
+		return err
+	}
+
+	response := make([]uint8, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	status, err := GetSocketUserAuthResponseDeserialized(response)
+	if err != nil {
+		return err
+	}
+	if status.Status != UserAuthSuccess {
+		return ErrAuthFailed
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRequestSerializedRoundTrip(t *testing.T) {
+	tests := []struct {
+		host  string
+		atype atype
+		size  int
+	}{
+		{"192.0.2.1", AtypIPV4, 4},
+		{"2001:db8::1", AtypIPV6, 16},
+		{"www.example.com", AtypDomain, 15},
+	}
+
+	for _, test := range tests {
+		request, err := NewSockRequest(CmdConnect, test.host, 443)
+		if err != nil {
+			t.Fatalf("Socks5Client: %s: %v", test.host, err)
+		}
+		msg, err := GetSocketRequestSerialized(request)
+		if err != nil {
+			t.Fatalf("Socks5Client: %s: %v", test.host, err)
+		}
+
+		decoded, err := GetSocketRequestDeserialized(msg)
+		if err != nil || decoded.GetAddressType() != test.atype ||
+			len(decoded.GetDestinationAddress()) != test.size ||
+			decoded.GetDestinationPort() != 443 || decoded.GetCommand() != CmdConnect {
+			t.Errorf("Socks5Client: %s: decoded %+v, %v", test.host, decoded, err)
+		}
+	}
+
+	if _, err := NewSockRequest(CmdConnect, "", 443); err == nil {
+		t.Errorf("Socks5Client: Empty host not flagged as error")
+	}
+}
+
+func TestMethodSerializedRoundTrip(t *testing.T) {
+	msg, err := GetSocketMethodSerialized(NewMethodSelectionReq(MethodNoAuth, MethodUserAuth))
+	if err != nil || !CompareSlices(msg, []uint8{Socks5, 2, 0x00, 0x02}) {
+		t.Errorf("Socks5Client: Unexpected method selection %v, %v", msg, err)
+	}
+
+	response, _ := GetSocketMethodResponse(MethodSelectionResp{MethodUserAuth})
+	selection, err := GetSocketMethodResponseDeserialized(response)
+	if err != nil || selection.GetMethod() != MethodUserAuth {
+		t.Errorf("Socks5Client: Unexpected method response %+v, %v", selection, err)
+	}
+}
+
+// serveHandshake answers a client requiring the credentials
+// and replies to its request with the status
+func serveHandshake(t *testing.T, conn net.Conn, status ReplyType) {
+	defer conn.Close()
+
+	initial, err := ReadMethodSelection(conn)
+	if err != nil || !initial.SupportsMethod(MethodUserAuth) {
+		t.Errorf("Socks5Client: Unexpected method selection %+v, %v", initial, err)
+		return
+	}
+	response, _ := GetSocketMethodResponse(MethodSelectionResp{MethodUserAuth})
+	conn.Write(response)
+
+	credentials, err := ReadUserAuth(conn)
+	if err != nil || credentials.Username != "edge" || credentials.Password != "secret" {
+		t.Errorf("Socks5Client: Unexpected credentials %+v, %v", credentials, err)
+		return
+	}
+	response, _ = GetSocketUserAuthResponseSerialized(UserAuthResponse{Status: UserAuthSuccess})
+	conn.Write(response)
+
+	request, err := ReadRequest(conn)
+	if err != nil || string(request.GetDestinationAddress()) != "www.example.com" {
+		t.Errorf("Socks5Client: Unexpected request %+v, %v", request, err)
+		return
+	}
+	response, _ = GetSocketResponseSerialized(NewSocksReply(status,
+		&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}))
+	conn.Write(response)
+	io.Copy(conn, conn)
+}
+
+func TestClientConnect(t *testing.T) {
+	client := &Client{Username: "edge", Password: "secret"}
+
+	for _, status := range []ReplyType{ReplySucceeded, ReplyHostUnreachable} {
+		clientSide, serverSide := net.Pipe()
+		go serveHandshake(t, serverSide, status)
+
+		request, _ := NewSockRequest(CmdConnect, "www.example.com", 443)
+		reply, err := client.Connect(context.Background(), clientSide, request)
+
+		var replyError *ReplyError
+		switch {
+		case status == ReplySucceeded && err != nil:
+			t.Errorf("Socks5Client: Connect failed %v", err)
+		case status != ReplySucceeded && (!errors.As(err, &replyError) || replyError.Reply != status):
+			t.Errorf("Socks5Client: Expected reply 0x%02x, received %v", status, err)
+		case reply.GetBindPort() != 1080:
+			t.Errorf("Socks5Client: Unexpected reply %+v", reply)
+		}
+		clientSide.Close()
+	}
+}
+
+func TestClientConnectCancelled(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	go io.Copy(ioutil.Discard, serverSide)
+
+	// The server never answers the method selection
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request, _ := NewSockRequest(CmdConnect, "192.0.2.1", 80)
+	if _, err := (&Client{}).Connect(ctx, clientSide, request); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Socks5Client: Expected the handshake to be abandoned, received %v", err)
+	}
+}
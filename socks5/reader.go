@@ -0,0 +1,143 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+)
+
+// The Read functions decode a single packet from a stream. Exactly the
+// bytes required by the framing are consumed so anything the client
+// pipelined after the packet is left in the reader.
+
+// ReadMethodSelection reads the initial method selection request
+func ReadMethodSelection(reader io.Reader) (initial SocksInitial, err error) {
+	header := make([]uint8, 2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+
+	if err = CheckMessageVersion(header); err != nil {
+		return
+	}
+
+	if header[1] == 0 {
+		err = errors.New("Socks5Packet: No methods in initial request")
+		return
+	}
+
+	methods := make([]uint8, header[1])
+	if _, err = io.ReadFull(reader, methods); err != nil {
+		return
+	}
+
+	initial.version = header[0]
+	initial.authCount = header[1]
+	initial.authOptions = methods
+	return
+}
+
+// ReadUserAuth reads the username/password sub-negotiation request
+func ReadUserAuth(reader io.Reader) (req UserAuthRequest, err error) {
+	header := make([]uint8, 2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+
+	if header[0] != UserAuthVersion {
+		err = errors.New("Socks5Packet: User auth version incorrect")
+		return
+	}
+
+	if header[1] == 0 {
+		err = errors.New("Socks5Packet: Empty username in user auth request")
+		return
+	}
+
+	username := make([]uint8, header[1])
+	if _, err = io.ReadFull(reader, username); err != nil {
+		return
+	}
+
+	plen := make([]uint8, 1)
+	if _, err = io.ReadFull(reader, plen); err != nil {
+		return
+	}
+
+	password := make([]uint8, plen[0])
+	if _, err = io.ReadFull(reader, password); err != nil {
+		return
+	}
+
+	req.Username = string(username)
+	req.Password = string(password)
+	return
+}
+
+// ReadRequest reads a CONNECT, BIND or UDP ASSOCIATE request
+func ReadRequest(reader io.Reader) (request SockRequest, err error) {
+	header := make([]uint8, 4)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+
+	if err = CheckMessageVersion(header); err != nil {
+		return
+	}
+
+	request.cmd = cmd(header[1])
+	request.atype = atype(header[3])
+	request.destaddr, request.destport, err = readAddress(reader, request.atype)
+	return
+}
+
+// ReadReply reads the reply to a request
+func ReadReply(reader io.Reader) (reply SockReply, err error) {
+	header := make([]uint8, 4)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+
+	if err = CheckMessageVersion(header); err != nil {
+		return
+	}
+
+	reply.reply = ReplyType(header[1])
+	reply.atype = atype(header[3])
+	reply.bindaddr, reply.bindport, err = readAddress(reader, reply.atype)
+	return
+}
+
+// readAddress reads the address and port fields
+// following the address type
+func readAddress(reader io.Reader, addressType atype) (address []uint8, port uint16, err error) {
+	var size uint8
+
+	switch addressType {
+	case AtypIPV4:
+		size = AddrIPV4Size
+	case AtypIPV6:
+		size = AddrIPV6Size
+	case AtypDomain:
+		length := make([]uint8, 1)
+		if _, err = io.ReadFull(reader, length); err != nil {
+			return
+		}
+		size = length[0]
+		if size == 0 {
+			err = ErrEmptyDomain
+			return
+		}
+	default:
+		err = ErrAddressTypeUnsupported
+		return
+	}
+
+	fields := make([]uint8, int(size)+2)
+	if _, err = io.ReadFull(reader, fields); err != nil {
+		return
+	}
+
+	address = fields[:size]
+	port = uint16(fields[size])<<8 | uint16(fields[size+1])
+	return
+}
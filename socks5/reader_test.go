@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadMethodSelection(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []uint8
+		methods []uint8
+		fail    bool
+	}{
+		{"single method", []uint8{Socks5, 0x01, 0x00}, []uint8{0x00}, false},
+		{"two methods", []uint8{Socks5, 0x02, 0x00, 0x02}, []uint8{0x00, 0x02}, false},
+		{"no methods", []uint8{Socks5, 0x00}, nil, true},
+		{"wrong version", []uint8{0x04, 0x01, 0x00}, nil, true},
+		{"truncated", []uint8{Socks5, 0x03, 0x00}, nil, true},
+		{"empty", []uint8{}, nil, true},
+	}
+
+	for _, test := range tests {
+		// Deliver a single byte per read to simulate split segments
+		reader := iotest.OneByteReader(bytes.NewReader(test.msg))
+		initial, err := ReadMethodSelection(reader)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Socks5Packet: %s: error not detected", test.name)
+			}
+			continue
+		}
+		if err != nil || !CompareSlices(initial.authOptions, test.methods) {
+			t.Errorf("Socks5Packet: %s: decoded %v, %v", test.name, initial.authOptions, err)
+		}
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []uint8
+		atype   atype
+		address []uint8
+		port    uint16
+		err     error
+	}{
+		{"ipv4", []uint8{Socks5, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x01, 0xbb},
+			AtypIPV4, []uint8{10, 0, 0, 1}, 443, nil},
+		{"ipv6", []uint8{Socks5, 0x01, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x50}, AtypIPV6,
+			[]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 80, nil},
+		{"domain", []uint8{Socks5, 0x01, 0x00, 0x03, 0x04, 'a', '.', 'i', 'o', 0x00, 0x50},
+			AtypDomain, []uint8("a.io"), 80, nil},
+		{"bad address type", []uint8{Socks5, 0x01, 0x00, 0x02, 10, 0, 0, 1, 0x00, 0x50},
+			0, nil, 0, ErrAddressTypeUnsupported},
+		{"empty domain", []uint8{Socks5, 0x01, 0x00, 0x03, 0x00, 0x00, 0x50},
+			0, nil, 0, ErrEmptyDomain},
+		{"truncated", []uint8{Socks5, 0x01, 0x00, 0x01, 10, 0},
+			0, nil, 0, io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		reader := iotest.OneByteReader(bytes.NewReader(test.msg))
+		request, err := ReadRequest(reader)
+		if test.err != nil {
+			if err != test.err {
+				t.Errorf("Socks5Packet: %s: expected %v, received %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Socks5Packet: %s: unexpected error %v", test.name, err)
+			continue
+		}
+		if request.cmd != CmdConnect || request.atype != test.atype ||
+			!CompareSlices(request.destaddr, test.address) || request.destport != test.port {
+			t.Errorf("Socks5Packet: %s: decoded %+v", test.name, request)
+		}
+	}
+}
+
+func TestReadUserAuth(t *testing.T) {
+	msg := []uint8{0x01, 0x03, 'b', 'o', 'b', 0x02, 'p', 'w'}
+	req, err := ReadUserAuth(iotest.OneByteReader(bytes.NewReader(msg)))
+	if err != nil || req.Username != "bob" || req.Password != "pw" {
+		t.Errorf("Socks5Packet: User auth decoded %+v, %v", req, err)
+	}
+
+	if _, err := ReadUserAuth(bytes.NewReader(msg[:5])); err == nil {
+		t.Errorf("Socks5Packet: Truncated user auth not detected")
+	}
+}
+
+func TestReadPipelined(t *testing.T) {
+	// Greeting, request and payload sent in a single write
+	stream := []uint8{Socks5, 0x01, 0x00,
+		Socks5, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50,
+		'G', 'E', 'T'}
+	reader := bufio.NewReader(bytes.NewReader(stream))
+
+	if _, err := ReadMethodSelection(reader); err != nil {
+		t.Fatalf("Socks5Packet: Pipelined greeting failed %v", err)
+	}
+
+	request, err := ReadRequest(reader)
+	if err != nil || request.destport != 80 {
+		t.Fatalf("Socks5Packet: Pipelined request failed %+v, %v", request, err)
+	}
+
+	rest := make([]uint8, 3)
+	if _, err := io.ReadFull(reader, rest); err != nil || string(rest) != "GET" {
+		t.Errorf("Socks5Packet: Pipelined payload lost %q, %v", rest, err)
+	}
+}
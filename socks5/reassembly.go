@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	//UDPFragmentEnd High bit of FRAG marking the end of a fragment sequence
+	UDPFragmentEnd uint8 = 0x80
+	//UDPFragmentPosition Mask of the fragment position in FRAG
+	UDPFragmentPosition uint8 = 0x7F
+	//DefaultReassemblyTimeout Reassembly timer value, RFC 1928 requires at least 5 seconds
+	DefaultReassemblyTimeout = 5 * time.Second
+	//MaxReassembledSize Maximum size of the data of a reassembled datagram
+	MaxReassembledSize = 65507
+)
+
+// UDPReassembler implements the fragment reassembly queue
+// of RFC 1928 for a single UDP association. Fragments carry
+// their position (1-127) in FRAG and the last fragment has
+// the high bit set. The queue is reinitialized when the timer
+// expires or when a fragment with a position lower than or
+// equal to the highest position seen arrives.
+type UDPReassembler struct {
+	timeout   time.Duration
+	fragments []UDPPacket
+	size      int
+	highest   uint8
+	expires   time.Time
+	// now returns the current time. Overridden in tests.
+	now func() time.Time
+}
+
+// NewUDPReassembler creates a reassembly queue using the
+// provided timer value
+func NewUDPReassembler(timeout time.Duration) *UDPReassembler {
+	if timeout < DefaultReassemblyTimeout {
+		timeout = DefaultReassemblyTimeout
+	}
+	return &UDPReassembler{timeout: timeout, now: time.Now}
+}
+
+// Add adds the packet to the queue. The reassembled packet is
+// returned with done set to true once the sequence is complete.
+// Standalone packets (FRAG 0) are returned as is.
+func (reassembler *UDPReassembler) Add(packet UDPPacket) (complete UDPPacket, done bool, err error) {
+	if packet.fragment == 0 {
+		reassembler.reset()
+		return packet, true, nil
+	}
+
+	position := packet.fragment & UDPFragmentPosition
+	end := packet.fragment&UDPFragmentEnd != 0
+	if position == 0 {
+		reassembler.reset()
+		return complete, false, errors.New("Socks5Packet: Invalid fragment position")
+	}
+
+	now := reassembler.now()
+	if len(reassembler.fragments) > 0 &&
+		(now.After(reassembler.expires) || position <= reassembler.highest) {
+		reassembler.reset()
+	}
+
+	if len(reassembler.fragments) == 0 {
+		reassembler.expires = now.Add(reassembler.timeout)
+	}
+
+	reassembler.size += len(packet.data)
+	if reassembler.size > MaxReassembledSize {
+		reassembler.reset()
+		return complete, false, errors.New("Socks5Packet: Reassembled datagram too large")
+	}
+
+	reassembler.fragments = append(reassembler.fragments, packet)
+	reassembler.highest = position
+
+	if !end {
+		return complete, false, nil
+	}
+
+	// Every position up to the last one must have been received
+	defer reassembler.reset()
+	if len(reassembler.fragments) != int(position) {
+		return complete, false, errors.New("Socks5Packet: Fragments missing in sequence")
+	}
+
+	first := reassembler.fragments[0]
+	complete = UDPPacket{atype: first.atype, address: first.address, port: first.port,
+		data: make([]uint8, 0, reassembler.size)}
+	for _, fragment := range reassembler.fragments {
+		complete.data = append(complete.data, fragment.data...)
+	}
+	return complete, true, nil
+}
+
+// reset discards the queued fragments
+func (reassembler *UDPReassembler) reset() {
+	reassembler.fragments = nil
+	reassembler.size = 0
+	reassembler.highest = 0
+}
@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+)
+
+func fragment(frag uint8, data string) UDPPacket {
+	return UDPPacket{fragment: frag, atype: AtypIPV4,
+		address: []uint8{10, 0, 0, 1}, port: 53, data: []uint8(data)}
+}
+
+func TestReassemblySequences(t *testing.T) {
+	tests := []struct {
+		name      string
+		fragments []UDPPacket
+		expected  string
+		done      bool
+		fail      bool
+	}{
+		{"standalone", []UDPPacket{fragment(0, "abc")}, "abc", true, false},
+		{"in order", []UDPPacket{fragment(1, "ab"), fragment(2, "cd"),
+			fragment(3|UDPFragmentEnd, "ef")}, "abcdef", true, false},
+		{"single fragment", []UDPPacket{fragment(1|UDPFragmentEnd, "ab")}, "ab", true, false},
+		{"incomplete", []UDPPacket{fragment(1, "ab"), fragment(2, "cd")}, "", false, false},
+		{"missing fragment", []UDPPacket{fragment(1, "ab"),
+			fragment(3|UDPFragmentEnd, "ef")}, "", false, true},
+		{"restart on lower position", []UDPPacket{fragment(1, "xx"), fragment(2, "yy"),
+			fragment(1, "ab"), fragment(2|UDPFragmentEnd, "cd")}, "abcd", true, false},
+		{"restart on repeated position", []UDPPacket{fragment(1, "xx"),
+			fragment(1, "ab"), fragment(2|UDPFragmentEnd, "cd")}, "abcd", true, false},
+		{"standalone discards queue", []UDPPacket{fragment(1, "xx"), fragment(0, "ab"),
+			fragment(2|UDPFragmentEnd, "cd")}, "", false, true},
+		{"invalid position", []UDPPacket{fragment(UDPFragmentEnd, "ab")}, "", false, true},
+	}
+
+	for _, test := range tests {
+		reassembler := NewUDPReassembler(0)
+		var complete UDPPacket
+		var done bool
+		var err error
+		for _, packet := range test.fragments {
+			complete, done, err = reassembler.Add(packet)
+		}
+
+		if test.fail {
+			if err == nil {
+				t.Errorf("Socks5Packet: %s: error not detected", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Socks5Packet: %s: unexpected error %v", test.name, err)
+			continue
+		}
+		if done != test.done || string(complete.data) != test.expected {
+			t.Errorf("Socks5Packet: %s: reassembled %t %q", test.name, done, complete.data)
+		}
+		if done && (complete.fragment != 0 || complete.port != 53) {
+			t.Errorf("Socks5Packet: %s: reassembled header incorrect", test.name)
+		}
+	}
+}
+
+func TestReassemblyTimer(t *testing.T) {
+	now := time.Now()
+	reassembler := NewUDPReassembler(DefaultReassemblyTimeout)
+	reassembler.now = func() time.Time { return now }
+
+	reassembler.Add(fragment(1, "ab"))
+	now = now.Add(DefaultReassemblyTimeout + time.Second)
+	_, done, err := reassembler.Add(fragment(2|UDPFragmentEnd, "cd"))
+
+	if done || err == nil {
+		t.Errorf("Socks5Packet: Fragments reassembled after timer expired")
+	}
+}
+
+func TestReassemblyTooLarge(t *testing.T) {
+	reassembler := NewUDPReassembler(0)
+	data := string(make([]byte, MaxReassembledSize/2+1))
+
+	reassembler.Add(fragment(1, data))
+	if _, _, err := reassembler.Add(fragment(2, data)); err == nil {
+		t.Errorf("Socks5Packet: Oversized reassembly not detected")
+	}
+}
+
+func TestUDPLargeDatagram(t *testing.T) {
+	data := make([]uint8, 1400)
+	for i := range data {
+		data[i] = uint8(i)
+	}
+	packet := UDPPacket{atype: AtypIPV4, address: []uint8{10, 0, 0, 1}, port: 0x1234, data: data}
+
+	msg, err := GetSocketUDPSerialized(packet)
+	if err != nil {
+		t.Fatalf("Socks5Packet: Error serializing large datagram: %v", err)
+	}
+
+	if msg[8] != 0x12 || msg[9] != 0x34 {
+		t.Errorf("Socks5Packet: Port not in network byte order")
+	}
+
+	decoded, err := GetSocketUDPDeserialized(msg)
+	if err != nil {
+		t.Fatalf("Socks5Packet: Error decoding large datagram: %v", err)
+	}
+
+	if decoded.port != 0x1234 || !CompareSlices(decoded.data, data) {
+		t.Errorf("Socks5Packet: Large datagram round trip incorrect")
+	}
+}
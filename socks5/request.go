@@ -1,6 +1,11 @@
 package socks5
 
-import "net"
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+)
 
 // RequestState type is used to indicate
 // the current state a request is in
@@ -19,16 +24,26 @@ const (
 	RequestStateProxying RequestState = 2
 	// RequestStateTerminating : Terminating connection state
 	RequestStateTerminating RequestState = 3
+	// RequestStateAuthenticating : Username/password sub-negotiation state
+	RequestStateAuthenticating RequestState = 4
+	// RequestStateRelayingUDP : Relaying datagrams for a UDP associate request
+	RequestStateRelayingUDP RequestState = 5
 )
 
 // Request holds the properties of a single request
 type Request struct {
-	State              RequestState // state of the connection
-	SourceAddr         net.Addr     // address of the client
-	DestinationFQDN    string       // Domain address of the destination. For Socks connect request 0x03
-	DestinationAddr    net.Addr     // address of the destination server
-	ClientConnection   net.Conn     // Client Connection
-	OutboundConnection net.Conn     // Outbound connection
+	State              RequestState    // state of the connection
+	SourceAddr         net.Addr        // address of the client
+	DestinationFQDN    string          // Domain address of the destination. For Socks connect request 0x03
+	DestinationAddr    net.Addr        // address of the destination server
+	Username           string          // Authenticated user. Empty when no authentication was performed
+	ClientConnection   net.Conn        // Client Connection
+	OutboundConnection net.Conn        // Outbound connection
+	RelayConnection    net.PacketConn  // UDP relay socket for UDP associate requests
+	reader             *bufio.Reader   // Buffered reader over the client connection
+	ctx                context.Context // Context of the session the request belongs to
+	closeOnce          sync.Once       // Ensures the connections are closed once
+	closeErr           error           // Error closing the client connection
 }
 
 // NewRequest creates a new instance of request
@@ -41,7 +56,41 @@ func NewRequest(clientConnection net.Conn) *Request {
 	return request
 }
 
+// Context returns the context of the session the request belongs
+// to. It is cancelled when the session must end.
+func (request *Request) Context() context.Context {
+	if request.ctx == nil {
+		return context.Background()
+	}
+	return request.ctx
+}
+
+// SetContext sets the context of the session the request belongs to
+func (request *Request) SetContext(ctx context.Context) {
+	request.ctx = ctx
+}
+
+// Reader returns the buffered reader used to decode the packets
+// sent by the client. Bytes pipelined by the client after the
+// handshake remain buffered in the reader.
+func (request *Request) Reader() *bufio.Reader {
+	if request.reader == nil {
+		request.reader = bufio.NewReader(request.ClientConnection)
+	}
+	return request.reader
+}
+
+// Close closes the connections of the request. The connections are
+// only closed by the first call, later calls return the same error.
 func (request *Request) Close() error {
-	err := request.ClientConnection.Close()
-	return err
+	request.closeOnce.Do(func() {
+		if request.OutboundConnection != nil {
+			request.OutboundConnection.Close()
+		}
+		if request.RelayConnection != nil {
+			request.RelayConnection.Close()
+		}
+		request.closeErr = request.ClientConnection.Close()
+	})
+	return request.closeErr
 }
@@ -0,0 +1,57 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// Session describes the client session a request belongs to.
+// It is carried by the context of the request.
+type Session struct {
+	// ID identifies the session within the server
+	ID uint64
+	// ClientAddr is the address of the client
+	ClientAddr net.Addr
+	// Started is the time the session was accepted
+	Started time.Time
+	// HandshakeDeadline is the time the handshake, including the
+	// outbound connection of a CONNECT request, must complete by
+	HandshakeDeadline time.Time
+	// Expires is the time the session is closed at,
+	// zero when its lifetime is not limited
+	Expires time.Time
+
+	lock sync.RWMutex
+	user string
+}
+
+// sessionKey is the context key of the session
+type sessionKey struct{}
+
+// NewSessionContext returns a context carrying the session
+func NewSessionContext(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// SessionFromContext returns the session carried by the context
+func SessionFromContext(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionKey{}).(*Session)
+	return session, ok
+}
+
+// User returns the authenticated user of the session,
+// empty when no authentication was performed
+func (session *Session) User() string {
+	session.lock.RLock()
+	defer session.lock.RUnlock()
+	return session.user
+}
+
+// SetUser records the authenticated user of the session
+func (session *Session) SetUser(user string) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	session.user = user
+}
@@ -0,0 +1,40 @@
+package socks5
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSessionContext(t *testing.T) {
+	if _, ok := SessionFromContext(context.Background()); ok {
+		t.Errorf("Session found in an empty context")
+	}
+
+	session := &Session{ID: 7}
+	ctx := NewSessionContext(context.Background(), session)
+	found, ok := SessionFromContext(ctx)
+	if !ok || found != session {
+		t.Fatalf("Session not found in the context")
+	}
+
+	if found.User() != "" {
+		t.Errorf("Unexpected user %q", found.User())
+	}
+	found.SetUser("alice")
+	if session.User() != "alice" {
+		t.Errorf("Unexpected user %q", session.User())
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	request := &Request{}
+	if request.Context() != context.Background() {
+		t.Errorf("Expected the background context")
+	}
+
+	ctx := NewSessionContext(context.Background(), &Session{ID: 1})
+	request.SetContext(ctx)
+	if request.Context() != ctx {
+		t.Errorf("Context not recorded")
+	}
+}
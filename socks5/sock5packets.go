@@ -5,6 +5,7 @@
 package socks5
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -16,6 +17,13 @@ type cmd uint8
 type atype uint8
 type ReplyType uint8
 
+// ErrAddressTypeUnsupported is returned when a request
+// carries an unknown address type
+var ErrAddressTypeUnsupported = errors.New("Socks5Packet: Wrong address type in request")
+
+// ErrEmptyDomain is returned when a domain address has no name
+var ErrEmptyDomain = errors.New("Socks5Packet: Empty domain name in request")
+
 const (
 	//Socks5 Version field of the socks protocol
 	Socks5 uint8 = 0x05
@@ -118,10 +126,95 @@ func CreateSocksReply(connectRequest SockRequest) SockReply {
 	return reply
 }
 
-func (reply SockReply) SetReply(status ReplyType) {
+// NewSocksReply creates a reply with the status and the
+// provided address as the bind address
+func NewSocksReply(status ReplyType, addr net.Addr) SockReply {
+	reply := SockReply{reply: status, atype: AtypIPV4,
+		bindaddr: []uint8(net.IPv4zero.To4())}
+
+	var ip net.IP
+	var port int
+	switch address := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = address.IP, address.Port
+	case *net.UDPAddr:
+		ip, port = address.IP, address.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		reply.bindaddr = []uint8(ip4)
+	} else if len(ip) == net.IPv6len {
+		reply.atype = AtypIPV6
+		reply.bindaddr = []uint8(ip)
+	}
+	reply.bindport = uint16(port)
+	return reply
+}
+
+func (reply *SockReply) SetReply(status ReplyType) {
 	reply.reply = status
 }
 
+func (reply SockReply) GetReply() ReplyType {
+	return reply.reply
+}
+
+func (reply SockReply) GetAddressType() atype {
+	return reply.atype
+}
+
+func (reply SockReply) GetBindAddress() []byte {
+	return reply.bindaddr
+}
+
+func (reply SockReply) GetBindPort() uint16 {
+	return reply.bindport
+}
+
+// NewUDPPacket creates a UDP packet carrying the data
+// with the provided address in the header
+func NewUDPPacket(addr *net.UDPAddr, data []byte) UDPPacket {
+	packet := UDPPacket{atype: AtypIPV4, address: []uint8(net.IPv4zero.To4()),
+		data: data}
+
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		packet.address = []uint8(ip4)
+	} else if len(addr.IP) == net.IPv6len {
+		packet.atype = AtypIPV6
+		packet.address = []uint8(addr.IP)
+	}
+	packet.port = uint16(addr.Port)
+	return packet
+}
+
+func (packet *UDPPacket) SetFragment(fragment uint8) {
+	packet.fragment = fragment
+}
+
+func (packet UDPPacket) GetFragment() uint8 {
+	return packet.fragment
+}
+
+func (packet UDPPacket) GetAddressType() atype {
+	return packet.atype
+}
+
+func (packet UDPPacket) GetDestinationAddress() []byte {
+	return packet.address
+}
+
+func (packet UDPPacket) GetDestinationPort() uint16 {
+	return packet.port
+}
+
+func (packet UDPPacket) GetData() []byte {
+	return packet.data
+}
+
+func (request SockRequest) GetCommand() cmd {
+	return request.cmd
+}
+
 func (request SockRequest) GetAddressType() atype {
 	return request.atype
 }
@@ -173,6 +266,102 @@ func GetSocketMethodResponse(resp MethodSelectionResp) ([]uint8, error) {
 	return ret, nil
 }
 
+// NewMethodSelectionReq creates a method selection
+// request offering the methods
+func NewMethodSelectionReq(methods ...method) MethodSelectionReq {
+	return MethodSelectionReq{nmethods: nmethods(len(methods)), methods: methods}
+}
+
+// GetMethod returns the method selected by the server
+func (resp MethodSelectionResp) GetMethod() method {
+	return resp.method
+}
+
+//GetSocketMethodSerialized Get serialized Method selection request
+func GetSocketMethodSerialized(req MethodSelectionReq) ([]uint8, error) {
+	if len(req.methods) == 0 || len(req.methods) >= int(MaxMethodSize) {
+		return nil, errors.New("Sock5Packet: Wrong number of methods in method negotiation")
+	}
+
+	ret := make([]uint8, 0, 2+len(req.methods))
+	ret = append(ret, Socks5, uint8(len(req.methods)))
+	for _, m := range req.methods {
+		ret = append(ret, uint8(m))
+	}
+	return ret, nil
+}
+
+//GetSocketMethodResponseDeserialized Get deserialized Method response
+func GetSocketMethodResponseDeserialized(msg []uint8) (MethodSelectionResp, error) {
+	var ret MethodSelectionResp
+
+	if len(msg) != 2 {
+		return ret, errors.New("Sock5Packet: Method response wrong size")
+	}
+
+	if err := CheckMessageVersion(msg); err != nil {
+		return ret, err
+	}
+
+	ret.method = method(msg[1])
+	return ret, nil
+}
+
+// NewSockRequest creates a request for the command. The host is
+// sent as an address when it is an IP address, as a domain otherwise.
+func NewSockRequest(command cmd, host string, port uint16) (SockRequest, error) {
+	request := SockRequest{cmd: command, destport: port}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		request.atype = AtypIPV4
+		request.destaddr = []uint8(ip.To4())
+	case ip != nil:
+		request.atype = AtypIPV6
+		request.destaddr = []uint8(ip.To16())
+	case len(host) == 0 || len(host) > 0xFF:
+		return request, errors.New("Socks5Packet: Domain size incorrect in request")
+	default:
+		request.atype = AtypDomain
+		request.destaddr = []uint8(host)
+	}
+	return request, nil
+}
+
+//GetSocketRequestSerialized Serializes the socket request
+func GetSocketRequestSerialized(req SockRequest) ([]uint8, error) {
+	ret := make([]uint8, 4)
+
+	ret[0] = Socks5
+	ret[1] = uint8(req.cmd)
+	ret[2] = 0x00
+	ret[3] = uint8(req.atype)
+
+	var size uint8
+
+	switch req.atype {
+	case AtypIPV4:
+		size = AddrIPV4Size
+	case AtypIPV6:
+		size = AddrIPV6Size
+	case AtypDomain:
+		size = uint8(len(req.destaddr))
+		ret = append(ret, size)
+	default:
+		return ret, ErrAddressTypeUnsupported
+	}
+
+	if len(req.destaddr) != int(size) {
+		return ret, errors.New("Socks5Packet: Destination address size is not same as type")
+	}
+
+	ret = append(ret, req.destaddr...)
+	ret = append(ret, uint8(req.destport>>8), uint8(req.destport&0xFF))
+
+	return ret, nil
+}
+
 //GetSocketRequestDeserialized Get deserialized socket request
 func GetSocketRequestDeserialized(msg []uint8) (SockRequest, error) {
 	var ret SockRequest
@@ -199,8 +388,11 @@ func GetSocketRequestDeserialized(msg []uint8) (SockRequest, error) {
 	case AtypDomain:
 		size = msg[4]
 		addrStart = 5
+		if size == 0 {
+			return ret, ErrEmptyDomain
+		}
 	default:
-		return ret, errors.New("Socks5Packet: Wrong address type in request")
+		return ret, ErrAddressTypeUnsupported
 	}
 
 	if len(msg[addrStart:]) < int(size)+2 {
@@ -267,25 +459,25 @@ func GetSocketResponseSerialized(resp SockReply) ([]uint8, error) {
 		return ret, errors.New("Socks5Packet: Bind address size is not same as type")
 	}
 
-	for _, v := range resp.bindaddr {
-		ret = append(ret, v)
-	}
-
-	ret = append(ret, uint8(resp.bindport&0xFF))
-	ret = append(ret, uint8((resp.bindport>>8)&0xFF))
+	ret = append(ret, resp.bindaddr...)
+	ret = append(ret, uint8(resp.bindport>>8), uint8(resp.bindport&0xFF))
 
 	return ret, nil
 }
 
-//GetSocketUDPDeserialized Deserializes a UDP packet
-func GetSocketUDPDeserialized(msg []uint8) (UDPPacket, error) {
-	var ret UDPPacket
+//GetSocketResponseDeserialized Deserializes the socket reply
+func GetSocketResponseDeserialized(msg []uint8) (SockReply, error) {
+	var ret SockReply
 
-	if len(msg) < 4 {
-		return ret, errors.New("Sock5Packet: UDP packet too small")
+	if len(msg) < 5 {
+		return ret, errors.New("Socks5Packet: Packet too small for a reply")
 	}
 
-	ret.fragment = msg[2]
+	if err := CheckMessageVersion(msg); err != nil {
+		return ret, err
+	}
+
+	ret.reply = ReplyType(msg[1])
 	ret.atype = atype(msg[3])
 
 	var size uint8
@@ -300,22 +492,63 @@ func GetSocketUDPDeserialized(msg []uint8) (UDPPacket, error) {
 		size = msg[4]
 		addrStart = 5
 	default:
-		return ret, errors.New("Socks5Packet: Wrong address type in UDP request")
+		return ret, errors.New("Socks5Packet: Wrong address type in reply")
 	}
 
-	if len(msg) > 255 || (addrStart+size+2) >= uint8(len(msg)) {
-		return ret, errors.New("Socks5Packet: Packet wrong size in UDP request")
+	if len(msg[addrStart:]) != int(size)+2 {
+		return ret, errors.New("Socks5Packet: Packet wrong size for reply")
 	}
+	ret.bindaddr = msg[addrStart : addrStart+size]
+
+	ret.bindport = binary.BigEndian.Uint16(msg[addrStart+size:])
+	return ret, nil
+}
 
-	for _, v := range msg[addrStart : addrStart+size] {
-		ret.address = append(ret.address, v)
+//GetSocketUDPDeserialized Deserializes a UDP packet
+func GetSocketUDPDeserialized(msg []uint8) (UDPPacket, error) {
+	// udp_pkt {
+	//		rsv (2) = 0x0000
+	//		frag (1)
+	//		atyp (1) = [0x01, 0x03, 0x04]
+	//		dst.addr (...)
+	//		dst.port (2)
+	//		data (...)
+	// }
+	var ret UDPPacket
+
+	if len(msg) < 5 {
+		return ret, errors.New("Sock5Packet: UDP packet too small")
 	}
 
-	ret.port = (uint16(msg[addrStart+size+1]) << 8) | uint16(msg[addrStart+size])
+	ret.fragment = msg[2]
+	ret.atype = atype(msg[3])
+
+	var size int
+	addrStart := 4
 
-	for _, v := range msg[addrStart+size+2:] {
-		ret.data = append(ret.data, v)
+	switch ret.atype {
+	case AtypIPV4:
+		size = int(AddrIPV4Size)
+	case AtypIPV6:
+		size = int(AddrIPV6Size)
+	case AtypDomain:
+		size = int(msg[4])
+		addrStart = 5
+		if size == 0 {
+			return ret, ErrEmptyDomain
+		}
+	default:
+		return ret, errors.New("Socks5Packet: Wrong address type in UDP request")
 	}
+
+	dataStart := addrStart + size + 2
+	if dataStart >= len(msg) {
+		return ret, errors.New("Socks5Packet: Packet wrong size in UDP request")
+	}
+
+	ret.address = append([]uint8(nil), msg[addrStart:addrStart+size]...)
+	ret.port = binary.BigEndian.Uint16(msg[addrStart+size:])
+	ret.data = append([]uint8(nil), msg[dataStart:]...)
 	return ret, nil
 }
 
@@ -346,20 +579,13 @@ func GetSocketUDPSerialized(resp UDPPacket) ([]uint8, error) {
 		return ret, errors.New("Socks5Packet: Address size is not same as type")
 	}
 
-	for _, v := range resp.address {
-		ret = append(ret, v)
-	}
-
-	ret = append(ret, uint8(resp.port&0xFF))
-	ret = append(ret, uint8((resp.port>>8)&0xFF))
-
 	if len(resp.data) <= 0 {
 		return ret, errors.New("Sock5Packet: Response data for UDP incorrect")
 	}
 
-	for _, v := range resp.data {
-		ret = append(ret, v)
-	}
+	ret = append(ret, resp.address...)
+	ret = append(ret, uint8(resp.port>>8), uint8(resp.port&0xFF))
+	ret = append(ret, resp.data...)
 
 	return ret, nil
 }
@@ -5,6 +5,7 @@
 package socks5
 
 import (
+	"net"
 	"testing"
 )
 
@@ -196,6 +197,11 @@ func TestSocketRequestDecodeWrongSize(t *testing.T) {
 	if rerr == nil {
 		t.Errorf("Sock5Packet: Didnot detect wrong size")
 	}
+
+	emptyDomain := []uint8{Socks5, uint8(CmdConnect), 0x00, uint8(AtypDomain), 0x00, 0x00, 0x50}
+	if _, err := GetSocketRequestDeserialized(emptyDomain); err != ErrEmptyDomain {
+		t.Errorf("Sock5Packet: Didnot detect empty domain, received %v", err)
+	}
 }
 
 func TestSocketResponseCorrect(t *testing.T) {
@@ -215,7 +221,7 @@ func TestSocketResponseCorrect(t *testing.T) {
 		counter++
 	}
 
-	if msg[8] != 0x45 || msg[9] != 0x56 {
+	if msg[8] != 0x56 || msg[9] != 0x45 {
 		t.Errorf("Sock5Packet: Bind port is wrong in reply")
 	}
 }
@@ -240,7 +246,7 @@ func TestSocketResponseIPV6(t *testing.T) {
 		counter++
 	}
 
-	if msg[20] != 0x67 || msg[21] != 0x54 {
+	if msg[20] != 0x54 || msg[21] != 0x67 {
 		t.Errorf("Socks5Packet: Bind port is incorrect")
 	}
 }
@@ -288,7 +294,7 @@ func TestUDPHeaderIPV4Request(t *testing.T) {
 		}
 	}
 
-	if respDeserial.port != 0x4523 {
+	if respDeserial.port != 0x2345 {
 		t.Errorf("Socks5Packet: Inccorect decoding of UDP packet IPV4 port")
 	}
 
@@ -322,7 +328,7 @@ func TestUDPHeaderIPV6Request(t *testing.T) {
 		}
 	}
 
-	if respDeserial.port != 0x5545 {
+	if respDeserial.port != 0x4555 {
 		t.Errorf("Socks5Packet: Inccorect decoding of UDP packet IPV6 port")
 	}
 
@@ -356,7 +362,7 @@ func TestUDPHeaderIPV6DomainName(t *testing.T) {
 		}
 	}
 
-	if respDeserial.port != 0xbe55 || respDeserial.data[0] != 0xab || respDeserial.data[1] != 0xcd {
+	if respDeserial.port != 0x55be || respDeserial.data[0] != 0xab || respDeserial.data[1] != 0xcd {
 		t.Errorf("Socks5Packet: Incorrect decoding of UDP packet IPV6 port")
 	}
 }
@@ -369,6 +375,11 @@ func TestUDPHeaderSmallSize(t *testing.T) {
 	if err == nil {
 		t.Errorf("Sock5Packet: Incorrect decoding not detected")
 	}
+
+	emptyDomain := []uint8{0x00, 0x00, 0x00, uint8(AtypDomain), 0x00, 0x00, 0x50, 0xab}
+	if _, err := GetSocketUDPDeserialized(emptyDomain); err != ErrEmptyDomain {
+		t.Errorf("Sock5Packet: Empty domain not detected, received %v", err)
+	}
 }
 
 func TestUDPSerializeIPV4(t *testing.T) {
@@ -389,7 +400,7 @@ func TestUDPSerializeIPV4(t *testing.T) {
 		t.Errorf("Socks5Packet: Error serializing IPV4 packet address")
 	}
 
-	if ret[8] != 0x56 || ret[9] != 0x45 {
+	if ret[8] != 0x45 || ret[9] != 0x56 {
 		t.Errorf("Sock5Packet: Error serializin IPV4 packet port")
 	}
 
@@ -422,7 +433,7 @@ func TestUDPPacketSerializeIPV6(t *testing.T) {
 		}
 	}
 
-	if ret[20] != 0x34 || ret[21] != 0x67 {
+	if ret[20] != 0x67 || ret[21] != 0x34 {
 		t.Errorf("Sock5Packet: Error serializin IPV6 packet port")
 	}
 
@@ -451,7 +462,7 @@ func TestUDPPacketSerializeDomain(t *testing.T) {
 		}
 	}
 
-	if ret[8] != 0x63 || ret[9] != 0x45 {
+	if ret[8] != 0x45 || ret[9] != 0x63 {
 		t.Errorf("Sock5Packet: Error serializin IPV6 packet port")
 	}
 
@@ -459,3 +470,104 @@ func TestUDPPacketSerializeDomain(t *testing.T) {
 		t.Errorf("Socks5Packet: Error serializing IPV6 packet data")
 	}
 }
+
+func TestSocketResponseRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   SockReply
+		encoded []uint8
+	}{
+		{"ipv4 success", SockReply{ReplySucceeded, AtypIPV4, []uint8{192, 168, 1, 10}, 1080},
+			[]uint8{0x05, 0x00, 0x00, 0x01, 192, 168, 1, 10, 0x04, 0x38}},
+		{"ipv4 refused", SockReply{ReplyConnRefused, AtypIPV4, []uint8{0, 0, 0, 0}, 0},
+			[]uint8{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0x00, 0x00}},
+		{"ipv6 success", SockReply{ReplySucceeded, AtypIPV6,
+			[]uint8{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 0xc350},
+			[]uint8{0x05, 0x00, 0x00, 0x04, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 1, 0xc3, 0x50}},
+		{"domain host unreachable", SockReply{ReplyHostUnreachable, AtypDomain,
+			[]uint8("a.io"), 443},
+			[]uint8{0x05, 0x04, 0x00, 0x03, 0x04, 'a', '.', 'i', 'o', 0x01, 0xbb}},
+	}
+
+	for _, test := range tests {
+		encoded, err := GetSocketResponseSerialized(test.reply)
+		if err != nil {
+			t.Errorf("Socks5Packet: %s: encoding failed %v", test.name, err)
+			continue
+		}
+
+		if !CompareSlices(encoded, test.encoded) {
+			t.Errorf("Socks5Packet: %s: encoded % x, expected % x", test.name,
+				encoded, test.encoded)
+		}
+
+		decoded, err := GetSocketResponseDeserialized(encoded)
+		if err != nil {
+			t.Errorf("Socks5Packet: %s: decoding failed %v", test.name, err)
+			continue
+		}
+
+		if decoded.reply != test.reply.reply || decoded.atype != test.reply.atype ||
+			!CompareSlices(decoded.bindaddr, test.reply.bindaddr) ||
+			decoded.bindport != test.reply.bindport {
+			t.Errorf("Socks5Packet: %s: round trip mismatch %+v", test.name, decoded)
+		}
+	}
+}
+
+func TestSocketResponseDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  []uint8
+	}{
+		{"too small", []uint8{0x05, 0x00, 0x00}},
+		{"wrong version", []uint8{0x04, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0, 80}},
+		{"wrong address type", []uint8{0x05, 0x00, 0x00, 0x02, 1, 2, 3, 4, 0, 80}},
+		{"truncated ipv4", []uint8{0x05, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0}},
+		{"trailing bytes", []uint8{0x05, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0, 80, 0}},
+		{"truncated domain", []uint8{0x05, 0x00, 0x00, 0x03, 0x05, 'a', 'b', 0, 80}},
+	}
+
+	for _, test := range tests {
+		if _, err := GetSocketResponseDeserialized(test.msg); err == nil {
+			t.Errorf("Socks5Packet: %s: error not detected", test.name)
+		}
+	}
+}
+
+func TestNewSocksReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  ReplyType
+		addr    net.Addr
+		encoded []uint8
+	}{
+		{"tcp ipv4", ReplySucceeded, &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000},
+			[]uint8{0x05, 0x00, 0x00, 0x01, 10, 1, 2, 3, 0x9c, 0x40}},
+		{"tcp ipv6", ReplySucceeded, &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 22},
+			[]uint8{0x05, 0x00, 0x00, 0x04, 0xfe, 0x80, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x16}},
+		{"udp ipv4", ReplySucceeded, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53},
+			[]uint8{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x35}},
+		{"no address", ReplyGeneralFail, nil,
+			[]uint8{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0x00, 0x00}},
+	}
+
+	for _, test := range tests {
+		encoded, err := GetSocketResponseSerialized(NewSocksReply(test.status, test.addr))
+		if err != nil || !CompareSlices(encoded, test.encoded) {
+			t.Errorf("Socks5Packet: %s: encoded % x, expected % x (%v)", test.name,
+				encoded, test.encoded, err)
+		}
+	}
+}
+
+func TestSetReply(t *testing.T) {
+	reply := NewSocksReply(ReplySucceeded, nil)
+	reply.SetReply(ReplyConnDenied)
+
+	if reply.GetReply() != ReplyConnDenied {
+		t.Errorf("Socks5Packet: Reply status not updated")
+	}
+}
@@ -0,0 +1,124 @@
+package socks5
+
+import (
+	"errors"
+)
+
+const (
+	//UserAuthVersion Version of the username/password sub-negotiation (RFC 1929)
+	UserAuthVersion uint8 = 0x01
+	//UserAuthSuccess Status sent to client when authentication succeeded
+	UserAuthSuccess uint8 = 0x00
+	//UserAuthFailure Status sent to client when authentication failed
+	UserAuthFailure uint8 = 0x01
+	//MaxUserAuthFieldSize Maximum length of the username and password fields
+	MaxUserAuthFieldSize = 0xFF
+)
+
+// UserAuthRequest Username/password sub-negotiation request packet
+type UserAuthRequest struct {
+	Username string
+	Password string
+}
+
+// UserAuthResponse Username/password sub-negotiation response packet
+type UserAuthResponse struct {
+	Status uint8
+}
+
+// SupportsMethod checks if the client offered the given
+// authentication method in its initial request
+func (initial SocksInitial) SupportsMethod(m method) bool {
+	for _, option := range initial.authOptions {
+		if method(option) == m {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSocketUserAuthDeserialized Deserializes the username/password request
+func GetSocketUserAuthDeserialized(msg []uint8) (UserAuthRequest, error) {
+	// user_auth_req_pkt {
+	//		version (1) = 0x01
+	//		ulen (1)
+	//		uname (1...255)
+	//		plen (1)
+	//		passwd (1...255)
+	// }
+	var ret UserAuthRequest
+
+	if len(msg) < 2 {
+		return ret, errors.New("Socks5Packet: Packet too small for user auth request")
+	}
+
+	if msg[0] != UserAuthVersion {
+		return ret, errors.New("Socks5Packet: User auth version incorrect")
+	}
+
+	ulen := int(msg[1])
+	if ulen == 0 {
+		return ret, errors.New("Socks5Packet: Empty username in user auth request")
+	}
+
+	if len(msg) < 2+ulen+1 {
+		return ret, errors.New("Socks5Packet: Packet too small for username")
+	}
+	ret.Username = string(msg[2 : 2+ulen])
+
+	plen := int(msg[2+ulen])
+	passStart := 2 + ulen + 1
+	if len(msg) != passStart+plen {
+		return ret, errors.New("Socks5Packet: Packet wrong size for password")
+	}
+	ret.Password = string(msg[passStart : passStart+plen])
+
+	return ret, nil
+}
+
+// GetSocketUserAuthSerialized Serializes the username/password request
+func GetSocketUserAuthSerialized(req UserAuthRequest) ([]uint8, error) {
+	if len(req.Username) == 0 || len(req.Username) > MaxUserAuthFieldSize {
+		return nil, errors.New("Socks5Packet: Username size incorrect in user auth request")
+	}
+
+	if len(req.Password) > MaxUserAuthFieldSize {
+		return nil, errors.New("Socks5Packet: Password size incorrect in user auth request")
+	}
+
+	ret := make([]uint8, 0, 3+len(req.Username)+len(req.Password))
+	ret = append(ret, UserAuthVersion, uint8(len(req.Username)))
+	ret = append(ret, req.Username...)
+	ret = append(ret, uint8(len(req.Password)))
+	ret = append(ret, req.Password...)
+
+	return ret, nil
+}
+
+// GetSocketUserAuthResponseDeserialized Deserializes the username/password response
+func GetSocketUserAuthResponseDeserialized(msg []uint8) (UserAuthResponse, error) {
+	// user_auth_resp_pkt {
+	//		version (1) = 0x01
+	//		status (1)
+	// }
+	var ret UserAuthResponse
+
+	if len(msg) != 2 {
+		return ret, errors.New("Socks5Packet: User auth response wrong size")
+	}
+
+	if msg[0] != UserAuthVersion {
+		return ret, errors.New("Socks5Packet: User auth version incorrect")
+	}
+
+	ret.Status = msg[1]
+	return ret, nil
+}
+
+// GetSocketUserAuthResponseSerialized Serializes the username/password response
+func GetSocketUserAuthResponseSerialized(resp UserAuthResponse) ([]uint8, error) {
+	ret := make([]uint8, 2)
+	ret[0] = UserAuthVersion
+	ret[1] = resp.Status
+	return ret, nil
+}
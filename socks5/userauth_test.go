@@ -0,0 +1,125 @@
+package socks5
+
+import (
+	"testing"
+)
+
+func TestUserAuthDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      []uint8
+		username string
+		password string
+		fail     bool
+	}{
+		{"valid", []uint8{0x01, 0x03, 'b', 'o', 'b', 0x02, 'p', 'w'}, "bob", "pw", false},
+		{"empty password", []uint8{0x01, 0x01, 'a', 0x00}, "a", "", false},
+		{"wrong version", []uint8{0x05, 0x01, 'a', 0x01, 'b'}, "", "", true},
+		{"empty username", []uint8{0x01, 0x00, 0x01, 'b'}, "", "", true},
+		{"short username", []uint8{0x01, 0x05, 'a', 'b'}, "", "", true},
+		{"short password", []uint8{0x01, 0x01, 'a', 0x04, 'b'}, "", "", true},
+		{"trailing bytes", []uint8{0x01, 0x01, 'a', 0x01, 'b', 'c'}, "", "", true},
+		{"too small", []uint8{0x01}, "", "", true},
+	}
+
+	for _, test := range tests {
+		req, err := GetSocketUserAuthDeserialized(test.msg)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Socks5Packet: %s: error not detected", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Socks5Packet: %s: unexpected error %v", test.name, err)
+			continue
+		}
+		if req.Username != test.username || req.Password != test.password {
+			t.Errorf("Socks5Packet: %s: decoded %q/%q", test.name, req.Username, req.Password)
+		}
+	}
+}
+
+func TestUserAuthEncode(t *testing.T) {
+	long := make([]byte, 256)
+	for i := range long {
+		long[i] = 'x'
+	}
+
+	tests := []struct {
+		name     string
+		req      UserAuthRequest
+		expected []uint8
+		fail     bool
+	}{
+		{"valid", UserAuthRequest{"bob", "pw"}, []uint8{0x01, 0x03, 'b', 'o', 'b', 0x02, 'p', 'w'}, false},
+		{"empty password", UserAuthRequest{"a", ""}, []uint8{0x01, 0x01, 'a', 0x00}, false},
+		{"empty username", UserAuthRequest{"", "pw"}, nil, true},
+		{"long username", UserAuthRequest{string(long), "pw"}, nil, true},
+		{"long password", UserAuthRequest{"bob", string(long)}, nil, true},
+	}
+
+	for _, test := range tests {
+		msg, err := GetSocketUserAuthSerialized(test.req)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Socks5Packet: %s: error not detected", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Socks5Packet: %s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !CompareSlices(msg, test.expected) {
+			t.Errorf("Socks5Packet: %s: encoded % x", test.name, msg)
+		}
+	}
+}
+
+func TestUserAuthResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    []uint8
+		status uint8
+		fail   bool
+	}{
+		{"success", []uint8{0x01, UserAuthSuccess}, UserAuthSuccess, false},
+		{"failure", []uint8{0x01, UserAuthFailure}, UserAuthFailure, false},
+		{"wrong version", []uint8{0x05, 0x00}, 0, true},
+		{"wrong size", []uint8{0x01}, 0, true},
+	}
+
+	for _, test := range tests {
+		resp, err := GetSocketUserAuthResponseDeserialized(test.msg)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Socks5Packet: %s: error not detected", test.name)
+			}
+			continue
+		}
+		if err != nil || resp.Status != test.status {
+			t.Errorf("Socks5Packet: %s: decoded status 0x%02x, %v", test.name, resp.Status, err)
+			continue
+		}
+		msg, _ := GetSocketUserAuthResponseSerialized(resp)
+		if !CompareSlices(msg, test.msg) {
+			t.Errorf("Socks5Packet: %s: encoded % x", test.name, msg)
+		}
+	}
+}
+
+func TestInitialSupportsMethod(t *testing.T) {
+	initial, err := GetSocketInitialSerialized([]uint8{Socks5, 0x02, uint8(MethodNoAuth), uint8(MethodUserAuth)})
+	if err != nil {
+		t.Fatalf("Socks5Packet: Initial request decoding failed: %v", err)
+	}
+
+	if !initial.SupportsMethod(MethodUserAuth) || !initial.SupportsMethod(MethodNoAuth) {
+		t.Errorf("Socks5Packet: Offered methods not detected")
+	}
+
+	if initial.SupportsMethod(MethodGssAPI) {
+		t.Errorf("Socks5Packet: Method not offered detected as supported")
+	}
+}
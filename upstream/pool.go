@@ -0,0 +1,352 @@
+// Package upstream balances the connections over pools of upstream
+// proxies, ejecting the upstreams failing to connect
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"hiteshkotian/ssl-tunnel/httpconnect"
+	"hiteshkotian/ssl-tunnel/logging"
+	"hiteshkotian/ssl-tunnel/netutil"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies selecting the upstream of a connection
+const (
+	// RoundRobin uses the upstreams in turn
+	RoundRobin = "round_robin"
+	// LeastConn uses the upstream with the fewest open connections
+	LeastConn = "least_conn"
+	// ConsistentHash uses the same upstream for a destination
+	// host as long as it is available
+	ConsistentHash = "consistent_hash"
+)
+
+// Member is an upstream of a pool
+type Member struct {
+	// Name of the upstream, used for logging and hashing
+	Name string
+	// Dialer connects through the upstream
+	Dialer netutil.Dialer
+}
+
+// Options configure a pool. The zero value of a field disables
+// the feature it configures.
+type Options struct {
+	// Strategy is one of the strategy constants,
+	// RoundRobin when empty
+	Strategy string
+	// MaxFailures is the number of consecutive connection
+	// failures ejecting an upstream
+	MaxFailures int
+	// EjectTime is how long an upstream is ejected
+	EjectTime time.Duration
+	// AttemptTimeout limits each attempt through an upstream
+	AttemptTimeout time.Duration
+	// ProbeTarget is the host:port connected to through every
+	// upstream to check its health
+	ProbeTarget string
+	// ProbeInterval is the interval between two checks
+	ProbeInterval time.Duration
+	// ProbeTimeout is the timeout of a check
+	ProbeTimeout time.Duration
+}
+
+// member holds the state of an upstream of a pool
+type member struct {
+	// active is the number of open connections,
+	// first for the alignment of atomic operations
+	active int64
+	Member
+	// failures is the number of consecutive connection failures
+	failures int
+	// ejectedUntil is the end of the ejection of the upstream
+	ejectedUntil time.Time
+	// unhealthy is set while the health check fails
+	unhealthy bool
+}
+
+// Pool is a Dialer connecting through one of its upstreams. A
+// connection failing through an upstream is retried through the
+// next one, until one succeeds or an upstream answers that the
+// destination cannot be reached.
+type Pool struct {
+	// next is the counter of the round robin strategy
+	next uint32
+	// name of the pool
+	name    string
+	options Options
+	members []*member
+	// mutex guards the state of the members
+	mutex sync.Mutex
+	// quit is closed when the pool is closed
+	quit      chan struct{}
+	closeOnce sync.Once
+	checks    sync.WaitGroup
+}
+
+// NewPool creates a pool of the upstreams. The health checks are
+// started when a probe target is configured, see Close.
+func NewPool(name string, members []Member, options Options) (*Pool, error) {
+	switch options.Strategy {
+	case "":
+		options.Strategy = RoundRobin
+	case RoundRobin, LeastConn, ConsistentHash:
+	default:
+		return nil, fmt.Errorf("pool %s: unknown strategy %q", name, options.Strategy)
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("pool %s: no upstreams", name)
+	}
+
+	pool := &Pool{name: name, options: options, quit: make(chan struct{})}
+	for _, upstream := range members {
+		pool.members = append(pool.members, &member{Member: upstream})
+	}
+
+	if options.ProbeTarget != "" && options.ProbeInterval > 0 {
+		for _, upstream := range pool.members {
+			pool.checks.Add(1)
+			go pool.healthCheck(upstream)
+		}
+	}
+	return pool, nil
+}
+
+// Close stops the health checks. Connections
+// already open are not affected.
+func (pool *Pool) Close() error {
+	pool.closeOnce.Do(func() {
+		close(pool.quit)
+	})
+	pool.checks.Wait()
+	return nil
+}
+
+// DialContext implementation of the Dialer interface. The upstreams
+// are tried in the order of the strategy, the available ones first.
+func (pool *Pool) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	for _, upstream := range pool.order(address) {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if pool.options.AttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, pool.options.AttemptTimeout)
+		}
+		conn, err = upstream.Dialer.DialContext(attemptCtx, network, address)
+		cancel()
+
+		switch {
+		case err == nil:
+			pool.succeeded(upstream)
+			return pool.track(upstream, conn), nil
+		case ctx.Err() != nil:
+			return nil, err
+		case !upstreamFailed(err):
+			// The upstream is working, the destination is not
+			pool.succeeded(upstream)
+			return nil, err
+		}
+		pool.failed(upstream, err)
+	}
+	return nil, err
+}
+
+// upstreamFailed returns true when the error is caused by the
+// upstream rather than by the destination it connects to
+func upstreamFailed(err error) bool {
+	var replyError *socks5.ReplyError
+	var statusError *httpconnect.StatusError
+
+	switch {
+	case errors.As(err, &replyError):
+		return false
+	case errors.As(err, &statusError):
+		return statusError.StatusCode == http.StatusProxyAuthRequired
+	}
+	return true
+}
+
+// order returns the members in the order they are tried
+func (pool *Pool) order(address string) []*member {
+	members := make([]*member, len(pool.members))
+	switch pool.options.Strategy {
+	case ConsistentHash:
+		// Rendezvous hashing: the members are ordered by a score
+		// of the destination host, removing a member only moves
+		// the hosts it served
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		copy(members, pool.members)
+		scores := map[*member]uint64{}
+		for _, upstream := range members {
+			hash := fnv.New64a()
+			io.WriteString(hash, upstream.Name+"/"+host)
+			scores[upstream] = hash.Sum64()
+		}
+		sort.SliceStable(members, func(i, j int) bool {
+			return scores[members[i]] > scores[members[j]]
+		})
+	default:
+		// Round robin, also breaking the ties of least connections
+		start := int(atomic.AddUint32(&pool.next, 1)-1) % len(pool.members)
+		for i := range members {
+			members[i] = pool.members[(start+i)%len(pool.members)]
+		}
+		if pool.options.Strategy == LeastConn {
+			active := map[*member]int64{}
+			for _, upstream := range members {
+				active[upstream] = atomic.LoadInt64(&upstream.active)
+			}
+			sort.SliceStable(members, func(i, j int) bool {
+				return active[members[i]] < active[members[j]]
+			})
+		}
+	}
+
+	// The members unavailable are tried last, in
+	// case every member of the pool is unavailable
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	now := time.Now()
+	available := make([]*member, 0, len(members))
+	var unavailable []*member
+	for _, upstream := range members {
+		if upstream.unhealthy || now.Before(upstream.ejectedUntil) {
+			unavailable = append(unavailable, upstream)
+		} else {
+			available = append(available, upstream)
+		}
+	}
+	return append(available, unavailable...)
+}
+
+// succeeded resets the failures of the member
+func (pool *Pool) succeeded(upstream *member) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	upstream.failures = 0
+}
+
+// failed records a connection failure and ejects the member
+// once it failed MaxFailures times in a row
+func (pool *Pool) failed(upstream *member, err error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	logging.Debug("Pool %s: connection through %s failed: %s", pool.name, upstream.Name, err)
+	upstream.failures++
+	if pool.options.MaxFailures > 0 && upstream.failures >= pool.options.MaxFailures {
+		upstream.failures = 0
+		upstream.ejectedUntil = time.Now().Add(pool.options.EjectTime)
+		logging.Info("Pool %s: ejecting %s for %s after %d failures", pool.name,
+			upstream.Name, pool.options.EjectTime, pool.options.MaxFailures)
+	}
+}
+
+// healthCheck probes the member until the pool is closed
+func (pool *Pool) healthCheck(upstream *member) {
+	defer pool.checks.Done()
+
+	ticker := time.NewTicker(pool.options.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		pool.probe(upstream)
+		select {
+		case <-ticker.C:
+		case <-pool.quit:
+			return
+		}
+	}
+}
+
+// probe connects to the probe target through the
+// member and records whether it is healthy
+func (pool *Pool) probe(upstream *member) {
+	ctx := context.Background()
+	if pool.options.ProbeTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, pool.options.ProbeTimeout)
+		defer cancelTimeout()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-pool.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	conn, err := upstream.Dialer.DialContext(ctx, "tcp", pool.options.ProbeTarget)
+	if err == nil {
+		conn.Close()
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	select {
+	case <-pool.quit:
+		return
+	default:
+	}
+	switch {
+	case err != nil && !upstream.unhealthy:
+		logging.Info("Pool %s: %s failed its health check: %s", pool.name, upstream.Name, err)
+	case err == nil && upstream.unhealthy:
+		logging.Info("Pool %s: %s passed its health check", pool.name, upstream.Name)
+	}
+	upstream.unhealthy = err != nil
+}
+
+// track counts the open connections of the member when the
+// strategy needs it. Other connections are returned as is so
+// the relay can still copy them with splice(2).
+func (pool *Pool) track(upstream *member, conn net.Conn) net.Conn {
+	if pool.options.Strategy != LeastConn {
+		return conn
+	}
+	atomic.AddInt64(&upstream.active, 1)
+	return &trackedConn{Conn: conn, active: &upstream.active}
+}
+
+// trackedConn decrements the open connections
+// of its member once closed
+type trackedConn struct {
+	net.Conn
+	active    *int64
+	closeOnce sync.Once
+}
+
+// Close implementation of net.Conn
+func (conn *trackedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		atomic.AddInt64(conn.active, -1)
+	})
+	return conn.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the
+// connection when it supports half-close
+func (conn *trackedConn) CloseWrite() error {
+	return netutil.CloseWrite(conn.Conn)
+}
+
+// ReadFrom lets the relay copy to the connection
+// with the implementation of the connection
+func (conn *trackedConn) ReadFrom(reader io.Reader) (int64, error) {
+	if readerFrom, ok := conn.Conn.(io.ReaderFrom); ok {
+		return readerFrom.ReadFrom(reader)
+	}
+	return io.Copy(struct{ io.Writer }{conn.Conn}, reader)
+}
@@ -0,0 +1,204 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hiteshkotian/ssl-tunnel/socks5"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDialer returns pipes, or its error while set
+type fakeDialer struct {
+	mutex sync.Mutex
+	err   error
+	dials int
+}
+
+func (dialer *fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	dialer.dials++
+	if dialer.err != nil {
+		return nil, dialer.err
+	}
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, nil
+}
+
+func (dialer *fakeDialer) setError(err error) {
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	dialer.err = err
+}
+
+func (dialer *fakeDialer) count() int {
+	dialer.mutex.Lock()
+	defer dialer.mutex.Unlock()
+	dials := dialer.dials
+	dialer.dials = 0
+	return dials
+}
+
+func newTestPool(t *testing.T, size int, options Options) (*Pool, []*fakeDialer) {
+	dialers := make([]*fakeDialer, size)
+	members := make([]Member, size)
+	for i := range members {
+		dialers[i] = &fakeDialer{}
+		members[i] = Member{Name: fmt.Sprintf("upstream%d", i), Dialer: dialers[i]}
+	}
+	pool, err := NewPool("test", members, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool, dialers
+}
+
+func dial(t *testing.T, pool *Pool, address string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return pool.DialContext(ctx, "tcp", address)
+}
+
+func TestRoundRobin(t *testing.T) {
+	pool, dialers := newTestPool(t, 3, Options{})
+	defer pool.Close()
+
+	for i := 0; i < 6; i++ {
+		if _, err := dial(t, pool, "example.com:443"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, dialer := range dialers {
+		if dials := dialer.count(); dials != 2 {
+			t.Errorf("upstream%d: expected 2 connections, received %d", i, dials)
+		}
+	}
+}
+
+func TestLeastConn(t *testing.T) {
+	pool, dialers := newTestPool(t, 2, Options{Strategy: LeastConn})
+	defer pool.Close()
+
+	first, _ := dial(t, pool, "example.com:443")
+	second, _ := dial(t, pool, "example.com:443")
+	first.Close()
+	dialers[0].count()
+	dialers[1].count()
+
+	// The upstream of the first connection has none open
+	if _, err := dial(t, pool, "example.com:443"); err != nil || dialers[0].count() != 1 {
+		t.Errorf("Connection not opened through the first upstream: %v", err)
+	}
+	second.Close()
+	if _, err := dial(t, pool, "example.com:443"); err != nil || dialers[1].count() != 1 {
+		t.Errorf("Connection not opened through the second upstream: %v", err)
+	}
+}
+
+func TestConsistentHash(t *testing.T) {
+	pool, dialers := newTestPool(t, 3, Options{Strategy: ConsistentHash})
+	defer pool.Close()
+
+	used := map[int]bool{}
+	for host := 0; host < 30; host++ {
+		address := fmt.Sprintf("host%d.example.com:443", host)
+		selected := -1
+		for attempt := 0; attempt < 3; attempt++ {
+			dial(t, pool, address)
+			for i, dialer := range dialers {
+				if dialer.count() == 1 {
+					if selected != -1 && selected != i {
+						t.Errorf("%s: connected through upstream%d and upstream%d", address, selected, i)
+					}
+					selected = i
+				}
+			}
+		}
+		used[selected] = true
+	}
+	if len(used) != 3 {
+		t.Errorf("Destinations not spread over the upstreams %v", used)
+	}
+}
+
+func TestFailoverAndEjection(t *testing.T) {
+	pool, dialers := newTestPool(t, 2, Options{MaxFailures: 2, EjectTime: time.Hour})
+	defer pool.Close()
+	dialers[0].setError(errors.New("connection refused"))
+
+	// Every connection succeeds through the second upstream
+	for i := 0; i < 6; i++ {
+		if _, err := dial(t, pool, "example.com:443"); err != nil {
+			t.Fatalf("Connection not retried: %v", err)
+		}
+	}
+	if dials := dialers[0].count(); dials != 2 {
+		t.Errorf("Expected the first upstream to be ejected after 2 failures, tried %d times", dials)
+	}
+
+	// Ejected upstreams are tried when no other is available
+	dialers[0].setError(nil)
+	dialers[1].setError(errors.New("connection refused"))
+	if _, err := dial(t, pool, "example.com:443"); err != nil {
+		t.Errorf("Ejected upstream not used as a last resort: %v", err)
+	}
+}
+
+func TestDestinationErrorNotRetried(t *testing.T) {
+	pool, dialers := newTestPool(t, 2, Options{MaxFailures: 1, EjectTime: time.Hour})
+	defer pool.Close()
+	refused := &socks5.ReplyError{Reply: socks5.ReplyConnRefused}
+	dialers[0].setError(refused)
+	dialers[1].setError(refused)
+
+	if _, err := dial(t, pool, "example.com:443"); !errors.Is(err, refused) {
+		t.Errorf("Expected the reply of the upstream, received %v", err)
+	}
+	if dials := dialers[0].count() + dialers[1].count(); dials != 1 {
+		t.Errorf("Expected a single attempt, received %d", dials)
+	}
+	if !pool.members[0].ejectedUntil.IsZero() || !pool.members[1].ejectedUntil.IsZero() {
+		t.Errorf("Upstream ejected for an error of the destination")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	dialers := []*fakeDialer{{err: errors.New("unreachable")}, {}}
+	pool, err := NewPool("test", []Member{{"down", dialers[0]}, {"up", dialers[1]}}, Options{
+		ProbeTarget:   "probe.example.com:80",
+		ProbeInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	waitFor := func(unhealthy bool) {
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			pool.mutex.Lock()
+			state := pool.members[0].unhealthy
+			pool.mutex.Unlock()
+			if state == unhealthy {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("Health of the upstream not updated to unhealthy=%v", unhealthy)
+	}
+
+	waitFor(true)
+	for _, upstream := range pool.order("example.com:443")[:1] {
+		if upstream.Name != "up" {
+			t.Errorf("Unhealthy upstream tried first")
+		}
+	}
+
+	dialers[0].setError(nil)
+	waitFor(false)
+}